@@ -1,81 +1,70 @@
 package main
 
 import (
-	"encoding/json"
-	facebookprovider "github.com/ozankasikci/one-oauth/internal/provider/facebook"
-	githubprovider "github.com/ozankasikci/one-oauth/internal/provider/github"
-	"github.com/ozankasikci/one-oauth/internal/provider/google"
+	"context"
+	"flag"
+	"github.com/ozankasikci/one-oauth/internal/config"
 	"github.com/ozankasikci/one-oauth/internal/proxy"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	// Open our jsonFile
-	jsonFile, err := os.Open("cmd/proxy/creds.json")
+	configPath := flag.String("config", "cmd/proxy/config.yaml", "YAML or TOML configuration file")
+	flag.Parse()
+
+	file, err := config.Load(*configPath)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	defer jsonFile.Close()
 
-	bytes, _ := ioutil.ReadAll(jsonFile)
+	store, err := file.OpenSessionStore()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 
-	var res struct {
-		Google struct {
-			ClientID     string `json:"client_id"`
-			ClientSecret string `json:"client_secret"`
-		} `json:"google"`
-		Github struct {
-			ClientID     string `json:"client_id"`
-			ClientSecret string `json:"client_secret"`
-		} `json:"github"`
-		Facebook struct {
-			ClientID     string `json:"client_id"`
-			ClientSecret string `json:"client_secret"`
-		} `json:"facebook"`
+	proxyConfig, err := file.ProxyConfig(store)
+	if err != nil {
+		log.Fatal(err.Error())
 	}
-	err = json.Unmarshal(bytes, &res)
+
+	authProvider, err := proxy.New(proxyConfig)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	providerConfig := proxy.NewConfig(
-		"4999",
-		proxy.AddGoogleConfig(&googleprovider.Config{
-			ClientID:                   res.Google.ClientID,
-			ClientSecret:               res.Google.ClientSecret,
-			GoogleRedirectURL:          "http://localhost:5000/auth/google/callback",
-			UpstreamSuccessRedirectURL: "http://localhost:5000/auth/google/success/callback",
-			Scopes:                     []string{"profile", "email"},
-			CookieSessionName:          "example-google-app",
-			CookieSessionSecret:        "example cookie signing secret",
-			CookieSessionUserKey:       "googleID",
-		}),
+	// SIGINT and SIGTERM drain connections before exiting
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		proxy.AddGithubConfig(&githubprovider.Config{
-			ClientID:                   res.Github.ClientID,
-			ClientSecret:               res.Github.ClientSecret,
-			GithubRedirectURL:          "http://localhost:5000/auth/github/callback",
-			UpstreamSuccessRedirectURL: "http://localhost:5000/auth/github/success/callback",
-			Scopes:                     []string{"user"},
-			CookieSessionName:          "example-github-app",
-			CookieSessionSecret:        "example cookie signing secret",
-			CookieSessionUserKey:       "githubID",
-		}),
+	// the file is watched for changes and SIGHUP forces a reload
+	handler := proxy.NewHandler(authProvider)
+	reloader := config.NewReloader(*configPath, file, store, handler)
+	go reloader.Watch(ctx.Done())
 
-		proxy.AddFacebookConfig(&facebookprovider.Config{
-			ClientID:                   res.Facebook.ClientID,
-			ClientSecret:               res.Facebook.ClientSecret,
-			FacebookRedirectURL:        "http://localhost:5000/auth/facebook/callback",
-			UpstreamSuccessRedirectURL: "http://localhost:5000/auth/facebook/success/callback",
-			Scopes:                     []string{"email"},
-			CookieSessionName:          "example-facebook-app",
-			CookieSessionSecret:        "example cookie signing secret",
-			CookieSessionUserKey:       "facebookID",
-		}),
-	)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				cancel()
+				return
+			}
+			if err := reloader.Reload(); err != nil {
+				log.Printf("config: reload rejected, keeping the running configuration: %v", err)
+			}
+		}
+	}()
 
-	authProvider := proxy.New(providerConfig)
-	authProvider.Start()
+	if err := handler.Start(ctx); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// the drained proxy no longer touches the store
+	if closer, ok := store.(io.Closer); ok {
+		closer.Close()
+	}
 }
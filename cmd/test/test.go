@@ -1,19 +1,25 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/dghubble/sessions"
+	"github.com/ozankasikci/one-oauth/internal/jwt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"time"
 )
 
 const (
 	sessionName    = "example-google-app"
 	sessionSecret  = "example cookie signing secret"
 	sessionUserKey = "googleID"
+	jwksURL        = "http://localhost:4999/.well-known/jwks.json"
+	audience       = "http://localhost:5000"
 )
 
 // sessionStore encodes and decodes session data stored in signed cookies
@@ -37,30 +43,68 @@ func New() *http.ServeMux {
 	}
 	proxy := &httputil.ReverseProxy{Director: director}
 
+	mux.HandleFunc("/auth/sign_in", func(w http.ResponseWriter, r *http.Request) { proxy.ServeHTTP(w, r) })
+
 	mux.HandleFunc("/auth/google/login", func(w http.ResponseWriter, r *http.Request) { proxy.ServeHTTP(w, r) })
 	mux.HandleFunc("/auth/google/callback", func(w http.ResponseWriter, r *http.Request) { proxy.ServeHTTP(w, r) })
-	mux.HandleFunc("/auth/google/success/callback", func(w http.ResponseWriter, r *http.Request) {
-		println(r.URL.Query()["email"][0])
-		http.Redirect(w, r, "/profile", http.StatusFound)
-	})
+	mux.HandleFunc("/auth/google/success/callback", successHandler)
 
 	mux.HandleFunc("/auth/github/login", func(w http.ResponseWriter, r *http.Request) { proxy.ServeHTTP(w, r) })
 	mux.HandleFunc("/auth/github/callback", func(w http.ResponseWriter, r *http.Request) { proxy.ServeHTTP(w, r) })
-	mux.HandleFunc("/auth/github/success/callback", func(w http.ResponseWriter, r *http.Request) {
-		println(r.URL.Query()["email"][0])
-		http.Redirect(w, r, "/profile", http.StatusFound)
-	})
+	mux.HandleFunc("/auth/github/success/callback", successHandler)
 
 	mux.HandleFunc("/auth/facebook/login", func(w http.ResponseWriter, r *http.Request) { proxy.ServeHTTP(w, r) })
 	mux.HandleFunc("/auth/facebook/callback", func(w http.ResponseWriter, r *http.Request) { proxy.ServeHTTP(w, r) })
-	mux.HandleFunc("/auth/facebook/success/callback", func(w http.ResponseWriter, r *http.Request) {
-		println(r.URL.Query()["email"][0])
-		http.Redirect(w, r, "/profile", http.StatusFound)
-	})
+	mux.HandleFunc("/auth/facebook/success/callback", successHandler)
+
+	mux.HandleFunc("/auth/oidc/login", func(w http.ResponseWriter, r *http.Request) { proxy.ServeHTTP(w, r) })
+	mux.HandleFunc("/auth/oidc/callback", func(w http.ResponseWriter, r *http.Request) { proxy.ServeHTTP(w, r) })
+	mux.HandleFunc("/auth/oidc/success/callback", successHandler)
 
 	return mux
 }
 
+// successHandler verifies the identity assertion passed by the proxy.
+func successHandler(w http.ResponseWriter, req *http.Request) {
+	claims, err := verifyAssertion(req.FormValue("token"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	println(claims.String("email"))
+	http.Redirect(w, req, "/profile", http.StatusFound)
+}
+
+// verifyAssertion checks the token signature against the proxy's JWKS and
+// validates its lifetime and audience.
+func verifyAssertion(rawToken string) (jwt.Claims, error) {
+	token, err := jwt.Parse(rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Get(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var keySet jwt.KeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return nil, err
+	}
+	if err := token.VerifyKeySet(keySet); err != nil {
+		return nil, err
+	}
+	if err := token.Claims.ValidateTime(time.Now(), time.Minute); err != nil {
+		return nil, err
+	}
+	if token.Claims.String("aud") != audience {
+		return nil, errors.New("unexpected token audience")
+	}
+	return token.Claims, nil
+}
+
 // welcomeHandler shows a welcome message and login button.
 func welcomeHandler(w http.ResponseWriter, req *http.Request) {
 	if req.URL.Path != "/" {
@@ -3,10 +3,18 @@ module github.com/ozankasikci/one-oauth
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.3.1
+	github.com/alicebob/miniredis/v2 v2.11.4
 	github.com/davecgh/go-spew v1.1.0
 	github.com/dghubble/gologin/v2 v2.2.0
 	github.com/dghubble/sessions v0.1.0
+	github.com/gomodule/redigo v1.8.2
+	github.com/google/go-github v17.0.0+incompatible
 	github.com/gorilla/mux v1.7.4
 	github.com/gorilla/securecookie v1.1.1 // indirect
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	google.golang.org/api v0.7.0
+	gopkg.in/yaml.v2 v2.2.2
 )
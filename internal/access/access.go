@@ -0,0 +1,134 @@
+// Package access decides which authenticated users may be issued a
+// session, based on their email address and domain.
+package access
+
+import (
+	"fmt"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultReloadInterval = 5 * time.Second
+
+// Config lists who may sign in. Without any allow rule every user not on a
+// deny list is allowed.
+type Config struct {
+	// Domains allows users whose verified email address, or verified Google
+	// hosted domain, is in one of the domains.
+	Domains []string
+	// AllowEmails and DenyEmails are verified email addresses allowed
+	// regardless of their domain, and denied regardless of any allow rule.
+	AllowEmails []string
+	DenyEmails  []string
+	// AllowEmailsFile and DenyEmailsFile add one address per line to the
+	// lists, ignoring blank lines and lines starting with #. They are
+	// re-read when they change.
+	AllowEmailsFile string
+	DenyEmailsFile  string
+	// ReloadInterval is how often the files are checked for changes;
+	// defaults to 5 seconds.
+	ReloadInterval time.Duration
+}
+
+// Policy implements provider.Authorizer for a Config.
+type Policy struct {
+	domains     map[string]bool
+	allowEmails map[string]bool
+	denyEmails  map[string]bool
+	allowFile   *listFile
+	denyFile    *listFile
+}
+
+// DeniedError is returned by Authorize for users the policy rejects.
+type DeniedError struct {
+	Email  string
+	Reason string
+}
+
+func (t *DeniedError) Error() string {
+	return fmt.Sprintf("access: %s denied: %s", t.Email, t.Reason)
+}
+
+// New returns the policy for config, failing if a list file cannot be read.
+func New(config *Config) (*Policy, error) {
+	interval := config.ReloadInterval
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+
+	policy := &Policy{
+		domains:     set(config.Domains, normalizeDomain),
+		allowEmails: set(config.AllowEmails, normalizeEmail),
+		denyEmails:  set(config.DenyEmails, normalizeEmail),
+	}
+
+	var err error
+	if config.AllowEmailsFile != "" {
+		policy.allowFile, err = newListFile(config.AllowEmailsFile, interval)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.DenyEmailsFile != "" {
+		policy.denyFile, err = newListFile(config.DenyEmailsFile, interval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return policy, nil
+}
+
+// Authorize returns a *DeniedError unless user may be issued a session.
+// Unverified email addresses only match deny lists.
+func (t *Policy) Authorize(r *http.Request, user *provider.User) error {
+	email := normalizeEmail(user.Email)
+	if email != "" && (t.denyEmails[email] || t.denyFile.contains(email)) {
+		return &DeniedError{Email: user.Email, Reason: "email is on the deny list"}
+	}
+
+	if len(t.domains) == 0 && len(t.allowEmails) == 0 && t.allowFile == nil {
+		return nil
+	}
+
+	if email != "" && user.EmailVerified {
+		if t.allowEmails[email] || t.allowFile.contains(email) {
+			return nil
+		}
+		if t.domains[email[strings.LastIndexByte(email, '@')+1:]] {
+			return nil
+		}
+	}
+	if user.HostedDomain != "" && t.domains[normalizeDomain(user.HostedDomain)] {
+		return nil
+	}
+
+	if email != "" && !user.EmailVerified {
+		return &DeniedError{Email: user.Email, Reason: "email is not verified"}
+	}
+	return &DeniedError{Email: user.Email, Reason: "email and domain are not allowed"}
+}
+
+func set(values []string, normalize func(string) string) map[string]bool {
+	m := map[string]bool{}
+	for _, value := range values {
+		if value = normalize(value); value != "" {
+			m[value] = true
+		}
+	}
+	return m
+}
+
+func normalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !strings.Contains(email, "@") {
+		return ""
+	}
+	return email
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "@")
+}
@@ -0,0 +1,153 @@
+package access
+
+import (
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeList(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "one-oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestAuthorize(t *testing.T) {
+	dir := tempDir(t)
+	allowFile := filepath.Join(dir, "allow")
+	denyFile := filepath.Join(dir, "deny")
+	writeList(t, allowFile, "# contractors\n\ncarol@contractor.com\n")
+	writeList(t, denyFile, "Mallory@Example.com\n")
+
+	restricted := &Config{
+		Domains:         []string{"Example.com", "@corp.example"},
+		AllowEmails:     []string{"bob@gmail.com"},
+		DenyEmails:      []string{"eve@example.com"},
+		AllowEmailsFile: allowFile,
+		DenyEmailsFile:  denyFile,
+	}
+	open := &Config{DenyEmails: []string{"eve@example.com"}}
+
+	tests := []struct {
+		name    string
+		config  *Config
+		user    provider.User
+		allowed bool
+		reason  string
+	}{
+		{"domain", restricted, provider.User{Email: "alice@example.com", EmailVerified: true}, true, ""},
+		{"domain case", restricted, provider.User{Email: "Alice@EXAMPLE.com", EmailVerified: true}, true, ""},
+		{"domain with @", restricted, provider.User{Email: "alice@corp.example", EmailVerified: true}, true, ""},
+		{"subdomain", restricted, provider.User{Email: "alice@sub.example.com", EmailVerified: true}, false, "not allowed"},
+		{"hosted domain", restricted, provider.User{Email: "alice@elsewhere.com", HostedDomain: "example.com"}, true, ""},
+		{"other hosted domain", restricted, provider.User{Email: "alice@elsewhere.com", EmailVerified: true, HostedDomain: "other.com"}, false, "not allowed"},
+		{"allowed email", restricted, provider.User{Email: "bob@gmail.com", EmailVerified: true}, true, ""},
+		{"allow file", restricted, provider.User{Email: "carol@contractor.com", EmailVerified: true}, true, ""},
+		{"other email", restricted, provider.User{Email: "dave@gmail.com", EmailVerified: true}, false, "not allowed"},
+		{"unverified email", restricted, provider.User{Email: "bob@gmail.com"}, false, "not verified"},
+		{"unverified domain", restricted, provider.User{Email: "alice@example.com"}, false, "not verified"},
+		{"no email", restricted, provider.User{}, false, "not allowed"},
+		{"deny over domain", restricted, provider.User{Email: "eve@example.com", EmailVerified: true}, false, "deny list"},
+		{"deny file over domain", restricted, provider.User{Email: "mallory@example.com", EmailVerified: true}, false, "deny list"},
+		{"deny over hosted domain", restricted, provider.User{Email: "eve@example.com", EmailVerified: true, HostedDomain: "example.com"}, false, "deny list"},
+		{"deny unverified", open, provider.User{Email: "EVE@example.com"}, false, "deny list"},
+		{"no allow rules", open, provider.User{Email: "dave@gmail.com"}, true, ""},
+		{"no allow rules nor email", open, provider.User{}, true, ""},
+	}
+
+	for _, test := range tests {
+		policy, err := New(test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user := test.user
+		err = policy.Authorize(httptest.NewRequest(http.MethodGet, "/", nil), &user)
+		if test.allowed && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.allowed {
+			denied, ok := err.(*DeniedError)
+			if !ok || !strings.Contains(denied.Reason, test.reason) {
+				t.Errorf("%s: err = %v, want denied because %q", test.name, err, test.reason)
+			}
+		}
+	}
+}
+
+func TestListFileReload(t *testing.T) {
+	dir := tempDir(t)
+	allowFile := filepath.Join(dir, "allow")
+	denyFile := filepath.Join(dir, "deny")
+	writeList(t, allowFile, "alice@example.com\n")
+	writeList(t, denyFile, "")
+
+	policy, err := New(&Config{AllowEmailsFile: allowFile, DenyEmailsFile: denyFile, ReloadInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorize := func(email string) error {
+		return policy.Authorize(httptest.NewRequest(http.MethodGet, "/", nil), &provider.User{Email: email, EmailVerified: true})
+	}
+	if authorize("alice@example.com") != nil || authorize("bob@example.com") == nil {
+		t.Fatal("initial lists not applied")
+	}
+
+	writeList(t, allowFile, "alice@example.com\nbob@example.com\n")
+	writeList(t, denyFile, "alice@example.com\n")
+	if err := authorize("bob@example.com"); err != nil {
+		t.Errorf("reloaded allow list: %v", err)
+	}
+	if err := authorize("alice@example.com"); err == nil {
+		t.Error("reloaded deny list not applied")
+	}
+
+	// a broken file keeps the previous list
+	writeList(t, allowFile, "alice@example.com\nnot an email address\n")
+	if err := authorize("bob@example.com"); err != nil {
+		t.Errorf("after a broken reload: %v", err)
+	}
+
+	// without a due check the list is not re-read
+	policy.allowFile.interval = time.Hour
+	policy.allowFile.checked = time.Now()
+	writeList(t, allowFile, "carol@example.com\n")
+	if err := authorize("carol@example.com"); err == nil {
+		t.Error("re-read the list before the interval")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	dir := tempDir(t)
+	broken := filepath.Join(dir, "broken")
+	writeList(t, broken, "alice@example.com\nalice\n")
+
+	tests := []struct {
+		config *Config
+		want   string
+	}{
+		{&Config{AllowEmailsFile: filepath.Join(dir, "missing")}, "missing"},
+		{&Config{DenyEmailsFile: broken}, "broken:2"},
+	}
+	for _, test := range tests {
+		if _, err := New(test.config); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("New(%+v) = %v, want an error mentioning %q", test.config, err, test.want)
+		}
+	}
+}
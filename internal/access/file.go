@@ -0,0 +1,90 @@
+package access
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// listFile is an email list on disk, re-read when its modification time or
+// size changes. A file that fails to read keeps the previous list.
+type listFile struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	entries map[string]bool
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+func newListFile(path string, interval time.Duration) (*listFile, error) {
+	file := &listFile{path: path, interval: interval}
+	if err := file.load(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// contains reports whether the normalized email is listed; a nil file
+// lists nothing.
+func (t *listFile) contains(email string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.checked) >= t.interval {
+		if info, err := os.Stat(t.path); err == nil && (!info.ModTime().Equal(t.modTime) || info.Size() != t.size) {
+			if err := t.load(); err != nil {
+				log.Printf("access: keeping the current list: %v", err)
+			} else {
+				log.Printf("access: reloaded %s", t.path)
+			}
+		}
+		t.checked = time.Now()
+	}
+	return t.entries[email]
+}
+
+func (t *listFile) load() error {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return fmt.Errorf("access: %v", err)
+	}
+	data, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return fmt.Errorf("access: %v", err)
+	}
+
+	entries := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		email := normalizeEmail(string(text))
+		if email == "" {
+			return fmt.Errorf("access: %s:%d: %q is not an email address", t.path, line, text)
+		}
+		entries[email] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("access: %s: %v", t.path, err)
+	}
+
+	t.entries = entries
+	t.modTime = info.ModTime()
+	t.size = info.Size()
+	t.checked = time.Now()
+	return nil
+}
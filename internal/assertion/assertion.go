@@ -0,0 +1,152 @@
+package assertion
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/ozankasikci/one-oauth/internal/jwt"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// ModeQuery appends the token as a "token" query parameter.
+	ModeQuery = "query"
+	// ModeFormPost renders a self-submitting form posting the token.
+	ModeFormPost = "form_post"
+)
+
+const defaultTTL = 2 * time.Minute
+
+type Config struct {
+	Signer   *jwt.Signer
+	Issuer   string
+	Audience []string
+	TTL      time.Duration
+	Mode     string
+}
+
+// Assertion mints short-lived signed tokens carrying the normalized user and
+// implements provider.Upstream.
+type Assertion struct {
+	Config *Config
+}
+
+func New(config *Config) *Assertion {
+	return &Assertion{Config: config}
+}
+
+// Deliver signs user into a token and passes it to redirectURL.
+func (t *Assertion) Deliver(w http.ResponseWriter, r *http.Request, redirectURL string, user *provider.User) {
+	token, err := t.Sign(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if t.Config.Mode == ModeFormPost {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		err = formPostTemplate.Execute(w, struct{ Action, Token string }{redirectURL, token})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	successRedirectUrl, err := url.Parse(redirectURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	q := successRedirectUrl.Query()
+	q.Set("token", token)
+	successRedirectUrl.RawQuery = q.Encode()
+
+	http.Redirect(w, r, successRedirectUrl.String(), http.StatusFound)
+}
+
+// Sign returns a compact JWS for user valid for the configured TTL.
+func (t *Assertion) Sign(user *provider.User) (string, error) {
+	ttl := t.Config.TTL
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+
+	jti, err := randomID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.Claims{
+		"sub":            user.Subject,
+		"provider":       user.Provider,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"name":           user.Name,
+		"given_name":     user.GivenName,
+		"family_name":    user.FamilyName,
+		"picture":        user.Picture,
+		"locale":         user.Locale,
+		"iat":            now.Unix(),
+		"nbf":            now.Unix(),
+		"exp":            now.Add(ttl).Unix(),
+		"jti":            jti,
+	}
+	if len(user.Groups) > 0 {
+		claims["groups"] = user.Groups
+	}
+	if t.Config.Issuer != "" {
+		claims["iss"] = t.Config.Issuer
+	}
+	switch len(t.Config.Audience) {
+	case 0:
+	case 1:
+		claims["aud"] = t.Config.Audience[0]
+	default:
+		claims["aud"] = t.Config.Audience
+	}
+
+	return t.Config.Signer.Sign(claims)
+}
+
+// JWKSHandler serves the public signing key as a JWK set.
+func (t *Assertion) JWKSHandler() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		keySet := jwt.KeySet{Keys: []jwt.JSONWebKey{t.Config.Signer.JSONWebKey()}}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		err := json.NewEncoder(w).Encode(keySet)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+var formPostTemplate = template.Must(template.New("form_post").Parse(`<!doctype html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Signing in</title></head>
+<body onload="document.forms[0].submit()">
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<noscript><input type="submit" value="Continue"></noscript>
+</form>
+</body>
+</html>
+`))
@@ -0,0 +1,162 @@
+package assertion
+
+import (
+	"encoding/json"
+	"github.com/ozankasikci/one-oauth/internal/jwt"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var alice = &provider.User{
+	Subject:       "1",
+	Provider:      "google",
+	Email:         "alice@example.com",
+	EmailVerified: true,
+	Name:          "Alice",
+	Groups:        []string{"eng"},
+}
+
+func newTestAssertion(t *testing.T, alg string, config *Config) *Assertion {
+	t.Helper()
+	signer, err := jwt.GenerateSigner(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Signer = signer
+	return New(config)
+}
+
+// keySet fetches the JWK set served by a.
+func keySet(t *testing.T, a *Assertion) jwt.KeySet {
+	t.Helper()
+	w := httptest.NewRecorder()
+	a.JWKSHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("JWKS = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var set jwt.KeySet
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestSign(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256", "ES384", "ES512", "EdDSA"} {
+		a := newTestAssertion(t, alg, &Config{Issuer: "https://auth.example.com", Audience: []string{"app"}, TTL: time.Minute})
+
+		raw, err := a.Sign(alice)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		token, err := jwt.Parse(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		set := keySet(t, a)
+		if len(set.Keys) != 1 || set.Keys[0].Alg != alg || set.Keys[0].Kid != token.Header.Kid {
+			t.Errorf("%s: key set %+v for kid %s", alg, set, token.Header.Kid)
+		}
+		if err := token.VerifyKeySet(set); err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+
+		claims := token.Claims
+		if claims.String("sub") != "1" || claims.String("provider") != "google" || claims.String("email") != "alice@example.com" ||
+			!claims.Bool("email_verified") || claims.String("iss") != "https://auth.example.com" || claims.String("aud") != "app" {
+			t.Errorf("%s: claims = %v", alg, claims)
+		}
+		issued, _ := claims.Time("iat")
+		expires, _ := claims.Time("exp")
+		if expires.Sub(issued) != time.Minute || claims.ValidateTime(time.Now(), 0) != nil {
+			t.Errorf("%s: valid from %v to %v", alg, issued, expires)
+		}
+		if groups, ok := claims["groups"].([]interface{}); !ok || len(groups) != 1 || groups[0] != "eng" {
+			t.Errorf("%s: groups = %v", alg, claims["groups"])
+		}
+	}
+}
+
+func TestSignClaims(t *testing.T) {
+	a := newTestAssertion(t, "ES256", &Config{Audience: []string{"a", "b"}})
+	raw, err := a.Sign(&provider.User{Subject: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := jwt.Parse(raw)
+	if audience := token.Claims.Audience(); len(audience) != 2 {
+		t.Errorf("aud = %v, want both audiences", audience)
+	}
+	issued, _ := token.Claims.Time("iat")
+	expires, _ := token.Claims.Time("exp")
+	if expires.Sub(issued) != defaultTTL {
+		t.Errorf("ttl = %v, want the default", expires.Sub(issued))
+	}
+	for _, claim := range []string{"iss", "groups"} {
+		if _, ok := token.Claims[claim]; ok {
+			t.Errorf("%s set without a value", claim)
+		}
+	}
+
+	// every token has its own id
+	again, _ := a.Sign(&provider.User{Subject: "2"})
+	other, _ := jwt.Parse(again)
+	if token.Claims.String("jti") == "" || token.Claims.String("jti") == other.Claims.String("jti") {
+		t.Errorf("jti = %q and %q", token.Claims.String("jti"), other.Claims.String("jti"))
+	}
+}
+
+func TestDeliverQuery(t *testing.T) {
+	a := newTestAssertion(t, "ES256", &Config{})
+	w := httptest.NewRecorder()
+	a.Deliver(w, httptest.NewRequest(http.MethodGet, "/auth/google/callback", nil), "https://app.example.com/login?next=%2Fdocs&token=stale", alice)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil {
+		t.Fatalf("deliver = %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	query := location.Query()
+	if location.Host != "app.example.com" || query.Get("next") != "/docs" || len(query["token"]) != 1 {
+		t.Fatalf("redirected to %s", location)
+	}
+	token, err := jwt.Parse(query.Get("token"))
+	if err != nil || token.VerifyKeySet(keySet(t, a)) != nil {
+		t.Errorf("token %q does not verify", query.Get("token"))
+	}
+}
+
+func TestDeliverFormPost(t *testing.T) {
+	a := newTestAssertion(t, "ES256", &Config{Mode: ModeFormPost})
+
+	tests := []struct {
+		redirectURL string
+		action      string
+	}{
+		{"https://app.example.com/login?a=1&b=2", `action="https://app.example.com/login?a=1&amp;b=2"`},
+		{`https://app.example.com/"><script>alert(1)</script>`, `action="https://app.example.com/%22%3e%3cscript%3ealert%281%29%3c/script%3e"`},
+		{"javascript:alert(1)", `action="#ZgotmplZ"`},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		a.Deliver(w, httptest.NewRequest(http.MethodGet, "/auth/google/callback", nil), test.redirectURL, alice)
+		body := w.Body.String()
+		if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			t.Errorf("%s: %d %v", test.redirectURL, w.Code, w.Header())
+		}
+		if !strings.Contains(body, test.action) || strings.Contains(body, "<script>") {
+			t.Errorf("%s: form does not escape the action, want %s:\n%s", test.redirectURL, test.action, body)
+		}
+
+		start := strings.Index(body, `name="token" value="`) + len(`name="token" value="`)
+		end := strings.Index(body[start:], `"`)
+		token, err := jwt.Parse(body[start : start+end])
+		if err != nil || token.VerifyKeySet(keySet(t, a)) != nil {
+			t.Errorf("%s: posted token %q does not verify", test.redirectURL, body[start:start+end])
+		}
+	}
+}
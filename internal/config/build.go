@@ -0,0 +1,472 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/ozankasikci/one-oauth/internal/access"
+	"github.com/ozankasikci/one-oauth/internal/assertion"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/jwt"
+	"github.com/ozankasikci/one-oauth/internal/policy"
+	facebookprovider "github.com/ozankasikci/one-oauth/internal/provider/facebook"
+	genericprovider "github.com/ozankasikci/one-oauth/internal/provider/generic"
+	githubprovider "github.com/ozankasikci/one-oauth/internal/provider/github"
+	googleprovider "github.com/ozankasikci/one-oauth/internal/provider/google"
+	oidcprovider "github.com/ozankasikci/one-oauth/internal/provider/oidc"
+	"github.com/ozankasikci/one-oauth/internal/proxy"
+	"github.com/ozankasikci/one-oauth/internal/redirect"
+	"github.com/ozankasikci/one-oauth/internal/session"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultListen = ":4999"
+
+// OpenSessionStore opens the configured session store. It is separate from
+// ProxyConfig so the store can outlive a configuration reload.
+func (t *File) OpenSessionStore() (session.Store, error) {
+	switch t.Session.Store {
+	case "bolt":
+		return session.NewBoltStore(t.Session.Path)
+	case "redis":
+		return session.NewRedisStore(t.Session.RedisURL, t.Session.RedisPrefix), nil
+	default:
+		return session.NewMemoryStore(), nil
+	}
+}
+
+// ProxyConfig builds the proxy configuration, sharing store between all
+// providers.
+func (t *File) ProxyConfig(store session.Store) (*proxy.Config, error) {
+	previousDirectories := t.directories
+	t.directories = map[string]*directory{}
+
+	listen := t.Listen
+	if listen == "" {
+		listen = defaultListen
+	}
+
+	options := []func(*proxy.Config){
+		proxy.SetAddress(listen),
+		proxy.SetExternalURL(t.ExternalURL),
+		proxy.SetPassAccessToken(t.PassAccessToken),
+		proxy.SetDebug(t.Debug),
+		proxy.AddServerConfig(proxy.ServerConfig{
+			ReadHeaderTimeout: time.Duration(t.Server.ReadHeaderTimeout),
+			ReadTimeout:       time.Duration(t.Server.ReadTimeout),
+			WriteTimeout:      time.Duration(t.Server.WriteTimeout),
+			IdleTimeout:       time.Duration(t.Server.IdleTimeout),
+			MaxHeaderBytes:    t.Server.MaxHeaderBytes,
+			ShutdownTimeout:   time.Duration(t.Server.ShutdownTimeout),
+		}),
+		proxy.AddSessionStore(store),
+		proxy.AddSessionLifetime(session.Lifetime{
+			MaxAge:      time.Duration(t.Session.MaxAge),
+			IdleTimeout: time.Duration(t.Session.IdleTimeout),
+		}),
+		proxy.AddCookieOptions(t.Cookie.options()),
+	}
+
+	if t.TLS != nil {
+		options = append(options, proxy.AddTLSConfig(t.TLS.tlsConfig()))
+	}
+
+	if t.Access != nil {
+		options = append(options, proxy.AddAccessConfig(&access.Config{
+			Domains:         t.Access.Domains,
+			AllowEmails:     t.Access.AllowEmails,
+			DenyEmails:      t.Access.DenyEmails,
+			AllowEmailsFile: t.Access.AllowEmailsFile,
+			DenyEmailsFile:  t.Access.DenyEmailsFile,
+		}))
+	}
+
+	if t.ReturnTo != nil {
+		options = append(options, proxy.AddReturnToAllowlist(&redirect.Allowlist{
+			Hosts:        t.ReturnTo.Hosts,
+			PathPrefixes: t.ReturnTo.PathPrefixes,
+		}))
+	}
+
+	if t.SignIn != nil {
+		signInConfig, err := t.SignIn.signInConfig()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, proxy.AddSignInConfig(signInConfig))
+	}
+
+	for _, rule := range t.Rules {
+		options = append(options, proxy.AddRules(rule.rule()))
+	}
+	if t.Expression != "" {
+		options = append(options, proxy.SetExpression(t.Expression))
+	}
+
+	if t.Assertion != nil {
+		assertionConfig, err := t.Assertion.assertionConfig(t.signer)
+		if err != nil {
+			return nil, err
+		}
+		if t.Assertion.KeyFile == "" {
+			t.signer = assertionConfig.Signer
+		}
+		options = append(options, proxy.AddAssertionConfig(assertionConfig))
+	}
+
+	for name, p := range t.Providers {
+		providerType := p.providerType(name)
+		providerConfig, err := p.providerConfig(name, providerType, t, previousDirectories[name])
+		if err != nil {
+			return nil, err
+		}
+		options = append(options,
+			proxy.AddProvider(name, providerType, providerConfig),
+			proxy.SetProviderDisplay(name, proxy.ProviderDisplay{Name: p.DisplayName, Icon: p.Icon, Order: p.Order}),
+		)
+	}
+
+	for _, u := range t.Upstreams {
+		options = append(options, proxy.AddUpstreamConfig(&proxy.UpstreamConfig{
+			URL:         u.URL,
+			Host:        u.Host,
+			PathPrefix:  u.PathPrefix,
+			StripPrefix: u.StripPrefix,
+		}))
+	}
+
+	// Port only matters for TCP addresses; Address takes precedence
+	_, port, _ := net.SplitHostPort(listen)
+	return proxy.NewConfig(port, options...), nil
+}
+
+func (t *SignIn) signInConfig() (*proxy.SignInConfig, error) {
+	config := &proxy.SignInConfig{Title: t.Title}
+	if t.TemplateFile != "" {
+		data, err := ioutil.ReadFile(t.TemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("config: sign_in: %v", err)
+		}
+		config.Template = string(data)
+	}
+	if t.CSSFile != "" {
+		data, err := ioutil.ReadFile(t.CSSFile)
+		if err != nil {
+			return nil, fmt.Errorf("config: sign_in: %v", err)
+		}
+		config.CSS = string(data)
+	}
+	return config, nil
+}
+
+func (t *Rule) rule() *policy.Rule {
+	return &policy.Rule{
+		Name:       t.Name,
+		Hosts:      t.Hosts,
+		Paths:      t.Paths,
+		Methods:    t.Methods,
+		AnyOf:      t.AnyOf.requirement(),
+		AllOf:      t.AllOf.requirement(),
+		Expression: t.Expression,
+	}
+}
+
+func (t *Requirement) requirement() policy.Requirement {
+	if t == nil {
+		return policy.Requirement{}
+	}
+	return policy.Requirement{
+		Groups:    t.Groups,
+		Emails:    t.Emails,
+		Providers: t.Providers,
+		Claims:    t.Claims,
+	}
+}
+
+func (t *TLS) tlsConfig() *proxy.TLSConfig {
+	config := &proxy.TLSConfig{
+		CertFile:        t.CertFile,
+		KeyFile:         t.KeyFile,
+		ReloadInterval:  time.Duration(t.ReloadInterval),
+		ClientCAFile:    t.ClientCAFile,
+		RedirectAddress: t.RedirectAddress,
+	}
+	if t.ACME != nil {
+		config.ACME = &proxy.ACMEConfig{
+			Hosts:           t.ACME.Hosts,
+			CacheDir:        t.ACME.CacheDir,
+			Email:           t.ACME.Email,
+			DirectoryURL:    t.ACME.DirectoryURL,
+			DirectoryCAFile: t.ACME.DirectoryCAFile,
+			RenewBefore:     time.Duration(t.ACME.RenewBefore),
+		}
+	}
+
+	switch t.MinVersion {
+	case "1.0":
+		config.MinVersion = tls.VersionTLS10
+	case "1.1":
+		config.MinVersion = tls.VersionTLS11
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	ids := cipherSuiteIDs()
+	for _, name := range t.CipherSuites {
+		config.CipherSuites = append(config.CipherSuites, ids[name])
+	}
+
+	switch t.ClientAuth {
+	case "request":
+		config.ClientAuth = tls.RequestClientCert
+	case "require":
+		config.ClientAuth = tls.RequireAnyClientCert
+	case "verify_if_given":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require_and_verify":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+// cipherSuiteIDs maps the names of the cipher suites Go considers secure to
+// their IDs.
+func cipherSuiteIDs() map[string]uint16 {
+	ids := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		ids[suite.Name] = suite.ID
+	}
+	return ids
+}
+
+func (t *Cookie) options() cookie.Options {
+	return t.over(cookie.Default)
+}
+
+// over returns base with the attributes set in t replacing its own.
+func (t *Cookie) over(base cookie.Options) cookie.Options {
+	options := base
+	if t.DevMode {
+		options.DevMode = true
+		options.Secure = false
+	}
+
+	if t.Domain != "" {
+		options.Domain = t.Domain
+	}
+	if t.Path != "" {
+		options.Path = t.Path
+	}
+	if t.MaxAge != 0 {
+		options.MaxAge = time.Duration(t.MaxAge)
+	}
+	if t.HTTPOnly != nil {
+		options.HTTPOnly = *t.HTTPOnly
+	}
+	if t.Secure != nil {
+		options.Secure = *t.Secure
+	}
+	switch strings.ToLower(t.SameSite) {
+	case "lax":
+		options.SameSite = http.SameSiteLaxMode
+	case "strict":
+		options.SameSite = http.SameSiteStrictMode
+	case "none":
+		options.SameSite = http.SameSiteNoneMode
+	}
+	return options
+}
+
+func (t *SessionKey) sessionKey() session.Key {
+	return session.Key{ID: t.ID, Secret: t.Secret}
+}
+
+// assertionConfig loads the key file, or else reuses generated if it has the
+// configured algorithm, or generates a key.
+func (t *Assertion) assertionConfig(generated *jwt.Signer) (*assertion.Config, error) {
+	signer := generated
+	var err error
+	if t.KeyFile != "" {
+		signer, err = jwt.LoadSigner(t.KeyFile)
+	} else {
+		algorithm := t.Algorithm
+		if algorithm == "" {
+			algorithm = "ES256"
+		}
+		if signer == nil || signer.Alg != algorithm {
+			signer, err = jwt.GenerateSigner(algorithm)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: assertion: %v", err)
+	}
+
+	return &assertion.Config{
+		Signer:   signer,
+		Issuer:   t.Issuer,
+		Audience: t.Audience,
+		TTL:      time.Duration(t.TTL),
+		Mode:     t.Mode,
+	}, nil
+}
+
+// directory is a Google Directory client and the settings it was built with.
+type directory struct {
+	serviceAccount []byte
+	adminEmail     string
+	baseURL        string
+	cacheTTL       time.Duration
+	directory      *googleprovider.Directory
+}
+
+// directory returns the Google Directory client of t, reusing previous if it
+// was built with the same settings.
+func (t *Provider) directory(previous *directory) (*directory, error) {
+	serviceAccount, err := ioutil.ReadFile(t.ServiceAccountFile)
+	if err != nil {
+		return nil, err
+	}
+	d := &directory{
+		serviceAccount: serviceAccount,
+		adminEmail:     t.AdminEmail,
+		baseURL:        t.DirectoryURL,
+		cacheTTL:       time.Duration(t.GroupsCacheTTL),
+	}
+	if previous != nil && bytes.Equal(previous.serviceAccount, d.serviceAccount) && previous.adminEmail == d.adminEmail &&
+		previous.baseURL == d.baseURL && previous.cacheTTL == d.cacheTTL {
+		return previous, nil
+	}
+
+	d.directory, err = googleprovider.NewDirectory(serviceAccount, t.AdminEmail)
+	if err != nil {
+		return nil, err
+	}
+	d.directory.BaseURL = d.baseURL
+	d.directory.CacheTTL = d.cacheTTL
+	return d, nil
+}
+
+// providerConfig returns the type specific config proxy.AddProvider expects.
+// Google providers reuse previousDirectory when unchanged and record their
+// Directory in file.
+func (t *Provider) providerConfig(name, providerType string, file *File, previousDirectory *directory) (interface{}, error) {
+	cookieName := t.CookieName
+	if cookieName == "" {
+		cookieName = "one-oauth-" + name
+	}
+	successRedirectURL := t.SuccessRedirectURL
+	if successRedirectURL == "" {
+		successRedirectURL = file.SuccessRedirectURL
+	}
+	var keys []session.Key
+	for _, key := range file.Session.Keys {
+		keys = append(keys, key.sessionKey())
+	}
+	var cookieOptions *cookie.Options
+	if t.Cookie != nil {
+		options := t.Cookie.over(file.Cookie.options())
+		cookieOptions = &options
+	}
+
+	switch providerType {
+	case "google":
+		var googleDirectory *googleprovider.Directory
+		if t.ServiceAccountFile != "" {
+			d, err := t.directory(previousDirectory)
+			if err != nil {
+				return nil, fmt.Errorf("config: provider %q: %v", name, err)
+			}
+			file.directories[name] = d
+			googleDirectory = d.directory
+		}
+		return &googleprovider.Config{
+			CookieSessionName:          cookieName,
+			CookieSessionKeys:          keys,
+			ClientID:                   t.ClientID,
+			ClientSecret:               t.ClientSecret,
+			GoogleRedirectURL:          t.RedirectURL,
+			UpstreamSuccessRedirectURL: successRedirectURL,
+			Scopes:                     t.Scopes,
+			Cookie:                     cookieOptions,
+			DisablePKCE:                t.DisablePKCE,
+			HostedDomains:              t.HostedDomains,
+			Directory:                  googleDirectory,
+		}, nil
+	case "github":
+		return &githubprovider.Config{
+			CookieSessionName:          cookieName,
+			CookieSessionKeys:          keys,
+			ClientID:                   t.ClientID,
+			ClientSecret:               t.ClientSecret,
+			GithubRedirectURL:          t.RedirectURL,
+			UpstreamSuccessRedirectURL: successRedirectURL,
+			Scopes:                     t.Scopes,
+			Cookie:                     cookieOptions,
+			DisablePKCE:                t.DisablePKCE,
+			Organizations:              t.Organizations,
+			Teams:                      t.Teams,
+			Repositories:               t.Repositories,
+			EnterpriseURL:              t.EnterpriseURL,
+			APIURL:                     t.APIURL,
+		}, nil
+	case "facebook":
+		return &facebookprovider.Config{
+			CookieSessionName:          cookieName,
+			CookieSessionKeys:          keys,
+			ClientID:                   t.ClientID,
+			ClientSecret:               t.ClientSecret,
+			FacebookRedirectURL:        t.RedirectURL,
+			UpstreamSuccessRedirectURL: successRedirectURL,
+			Scopes:                     t.Scopes,
+			Cookie:                     cookieOptions,
+			DisablePKCE:                t.DisablePKCE,
+		}, nil
+	case "oidc":
+		return &oidcprovider.Config{
+			CookieSessionName:          cookieName,
+			CookieSessionKeys:          keys,
+			ClientID:                   t.ClientID,
+			ClientSecret:               t.ClientSecret,
+			IssuerURL:                  t.IssuerURL,
+			OIDCRedirectURL:            t.RedirectURL,
+			UpstreamSuccessRedirectURL: successRedirectURL,
+			Scopes:                     t.Scopes,
+			Cookie:                     cookieOptions,
+			DisablePKCE:                t.DisablePKCE,
+		}, nil
+	case "generic":
+		var fields genericprovider.FieldMapping
+		if t.Fields != nil {
+			fields = genericprovider.FieldMapping{
+				ID:            t.Fields.ID,
+				Email:         t.Fields.Email,
+				Name:          t.Fields.Name,
+				Picture:       t.Fields.Picture,
+				EmailVerified: t.Fields.EmailVerified,
+			}
+		}
+		return &genericprovider.Config{
+			CookieSessionName:          cookieName,
+			CookieSessionKeys:          keys,
+			ClientID:                   t.ClientID,
+			ClientSecret:               t.ClientSecret,
+			AuthURL:                    t.AuthURL,
+			TokenURL:                   t.TokenURL,
+			UserInfoURL:                t.UserInfoURL,
+			RedirectURL:                t.RedirectURL,
+			UpstreamSuccessRedirectURL: successRedirectURL,
+			Scopes:                     t.Scopes,
+			Fields:                     fields,
+			Cookie:                     cookieOptions,
+			DisablePKCE:                t.DisablePKCE,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("config: provider %q has unsupported type %q", name, providerType)
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	githubprovider "github.com/ozankasikci/one-oauth/internal/provider/github"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const cookieConfig = `
+success_redirect_url: https://app.example.com/
+cookie:
+  domain: example.com
+  max_age: 1h
+  same_site: strict
+session:
+  keys:
+    - id: test
+      secret: test secret, at least 32 bytes long
+providers:
+  github:
+    client_id: id
+    client_secret: secret
+    redirect_url: https://auth.example.com/auth/github/callback
+    cookie:
+      path: /app
+      same_site: lax
+`
+
+func TestProviderCookie(t *testing.T) {
+	file, err := Parse([]byte(cookieConfig), "yaml", lookup(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	providerConfig, err := file.Providers["github"].providerConfig("github", "github", file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unset attributes are inherited from the top-level section
+	want := cookie.Options{
+		Domain:   "example.com",
+		Path:     "/app",
+		MaxAge:   time.Hour,
+		HTTPOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if options := providerConfig.(*githubprovider.Config).Cookie; options == nil || *options != want {
+		t.Errorf("provider cookie = %+v, want %+v", options, want)
+	}
+}
+
+func TestProviderCookieValidate(t *testing.T) {
+	// the provider cookie is validated layered over the top-level section,
+	// which here drops Secure in dev mode
+	data := strings.Replace(cookieConfig, "  same_site: strict", "  same_site: strict\n  dev_mode: true", 1)
+	data = strings.Replace(data, "same_site: lax", "same_site: none", 1)
+	if _, err := Parse([]byte(data), "yaml", lookup(nil)); err == nil || !strings.Contains(err.Error(), "providers.github.cookie") {
+		t.Errorf("err = %v, want SameSite=None without Secure rejected", err)
+	}
+
+	data = strings.Replace(data, "same_site: none", "same_site: none\n      secure: true", 1)
+	if _, err := Parse([]byte(data), "yaml", lookup(nil)); err != nil {
+		t.Error(err)
+	}
+}
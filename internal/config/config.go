@@ -0,0 +1,332 @@
+// Package config loads the proxy configuration from a YAML or TOML file.
+//
+// String values may reference environment variables as ${NAME} or
+// ${NAME:-default}, and any value may be overridden by an ONEOAUTH_*
+// variable named after its path, e.g. ONEOAUTH_LISTEN or
+// ONEOAUTH_PROVIDERS_GOOGLE_CLIENT_SECRET.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/ozankasikci/one-oauth/internal/jwt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File is the configuration file layout.
+type File struct {
+	// Listen is the listen address: ":4999", "127.0.0.1:4999",
+	// "unix:/run/one-oauth.sock", "systemd" or "systemd:<socket name>".
+	Listen string `yaml:"listen" toml:"listen"`
+	Server Server `yaml:"server" toml:"server"`
+	// TLS serves HTTPS when set.
+	TLS *TLS `yaml:"tls" toml:"tls"`
+	// ExternalURL is the base URL browsers use to reach the proxy.
+	ExternalURL string `yaml:"external_url" toml:"external_url"`
+	// SuccessRedirectURL is the default upstream success redirect of providers.
+	SuccessRedirectURL string     `yaml:"success_redirect_url" toml:"success_redirect_url"`
+	PassAccessToken    bool       `yaml:"pass_access_token" toml:"pass_access_token"`
+	Cookie             Cookie     `yaml:"cookie" toml:"cookie"`
+	Session            Session    `yaml:"session" toml:"session"`
+	Assertion          *Assertion `yaml:"assertion" toml:"assertion"`
+	Access             *Access    `yaml:"access" toml:"access"`
+	// ReturnTo allows return URLs passed to login on these hosts and paths.
+	ReturnTo *ReturnTo `yaml:"return_to" toml:"return_to"`
+	// SignIn customizes the sign-in page listing the providers.
+	SignIn *SignIn `yaml:"sign_in" toml:"sign_in"`
+	// Rules restrict signed in users per host, path and method; the first
+	// matching rule decides.
+	Rules []*Rule `yaml:"rules" toml:"rules"`
+	// Expression must hold at sign in and for every request, see
+	// policy.Expression. At sign in, request is the return URL of the login.
+	Expression string               `yaml:"expression" toml:"expression"`
+	Providers  map[string]*Provider `yaml:"providers" toml:"providers"`
+	Upstreams  []*Upstream          `yaml:"upstreams" toml:"upstreams"`
+	// Debug also logs allowed authorization decisions.
+	Debug bool `yaml:"debug" toml:"debug"`
+
+	// signer is the assertion key generated without a key file, kept by
+	// the Reloader so reloads do not rotate it
+	signer *jwt.Signer
+	// directories are the Google Directory clients built per provider name,
+	// kept by the Reloader so reloads keep their tokens and group caches
+	directories map[string]*directory
+}
+
+// Server mirrors proxy.ServerConfig.
+type Server struct {
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout" toml:"read_header_timeout"`
+	ReadTimeout       Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout      Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout       Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	MaxHeaderBytes    int      `yaml:"max_header_bytes" toml:"max_header_bytes"`
+	ShutdownTimeout   Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+}
+
+// TLS mirrors proxy.TLSConfig.
+type TLS struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	// ACME obtains certificates automatically instead of cert_file and
+	// key_file.
+	ACME           *ACME    `yaml:"acme" toml:"acme"`
+	ReloadInterval Duration `yaml:"reload_interval" toml:"reload_interval"`
+	// MinVersion is one of "1.0", "1.1", "1.2" (default) or "1.3".
+	MinVersion string `yaml:"min_version" toml:"min_version"`
+	// CipherSuites are Go cipher suite names, e.g.
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+	CipherSuites []string `yaml:"cipher_suites" toml:"cipher_suites"`
+	ClientCAFile string   `yaml:"client_ca_file" toml:"client_ca_file"`
+	// ClientAuth is one of "none", "request", "require", "verify_if_given"
+	// (default with a client CA file) or "require_and_verify".
+	ClientAuth string `yaml:"client_auth" toml:"client_auth"`
+	// RedirectAddress, e.g. ":80", redirects plain HTTP to HTTPS.
+	RedirectAddress string `yaml:"redirect_address" toml:"redirect_address"`
+}
+
+// ACME mirrors proxy.ACMEConfig.
+type ACME struct {
+	// Hosts default to the hosts of the provider redirect URLs and
+	// external_url.
+	Hosts    []string `yaml:"hosts" toml:"hosts"`
+	CacheDir string   `yaml:"cache_dir" toml:"cache_dir"`
+	Email    string   `yaml:"email" toml:"email"`
+	// DirectoryURL defaults to Let's Encrypt production.
+	DirectoryURL    string   `yaml:"directory_url" toml:"directory_url"`
+	DirectoryCAFile string   `yaml:"directory_ca_file" toml:"directory_ca_file"`
+	RenewBefore     Duration `yaml:"renew_before" toml:"renew_before"`
+}
+
+// Cookie mirrors cookie.Options. HTTPOnly defaults to true and Secure to
+// true outside dev mode.
+type Cookie struct {
+	Domain   string   `yaml:"domain" toml:"domain"`
+	Path     string   `yaml:"path" toml:"path"`
+	MaxAge   Duration `yaml:"max_age" toml:"max_age"`
+	HTTPOnly *bool    `yaml:"http_only" toml:"http_only"`
+	Secure   *bool    `yaml:"secure" toml:"secure"`
+	// SameSite is one of "lax" (default), "strict" or "none".
+	SameSite string `yaml:"same_site" toml:"same_site"`
+	DevMode  bool   `yaml:"dev_mode" toml:"dev_mode"`
+}
+
+type Session struct {
+	// Store is one of "memory" (default), "bolt" or "redis".
+	Store string `yaml:"store" toml:"store"`
+	// Path is the bolt database file.
+	Path string `yaml:"path" toml:"path"`
+	// RedisURL and RedisPrefix configure the redis store.
+	RedisURL    string   `yaml:"redis_url" toml:"redis_url"`
+	RedisPrefix string   `yaml:"redis_prefix" toml:"redis_prefix"`
+	MaxAge      Duration `yaml:"max_age" toml:"max_age"`
+	IdleTimeout Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	// Keys encrypt session cookies, newest first.
+	Keys []*SessionKey `yaml:"keys" toml:"keys"`
+}
+
+type SessionKey struct {
+	ID string `yaml:"id" toml:"id"`
+	// Secret must be at least 32 bytes, e.g. from openssl rand -base64 32.
+	Secret string `yaml:"secret" toml:"secret"`
+}
+
+type Assertion struct {
+	// KeyFile is a PEM private key; without it an ephemeral key of
+	// Algorithm is generated, which is kept across reloads and upstreams
+	// only see until a restart.
+	KeyFile   string   `yaml:"key_file" toml:"key_file"`
+	Algorithm string   `yaml:"algorithm" toml:"algorithm"`
+	Issuer    string   `yaml:"issuer" toml:"issuer"`
+	Audience  []string `yaml:"audience" toml:"audience"`
+	TTL       Duration `yaml:"ttl" toml:"ttl"`
+	Mode      string   `yaml:"mode" toml:"mode"`
+}
+
+// Access mirrors access.Config.
+type Access struct {
+	Domains         []string `yaml:"domains" toml:"domains"`
+	AllowEmails     []string `yaml:"allow_emails" toml:"allow_emails"`
+	DenyEmails      []string `yaml:"deny_emails" toml:"deny_emails"`
+	AllowEmailsFile string   `yaml:"allow_emails_file" toml:"allow_emails_file"`
+	DenyEmailsFile  string   `yaml:"deny_emails_file" toml:"deny_emails_file"`
+}
+
+// ReturnTo mirrors redirect.Allowlist.
+type ReturnTo struct {
+	Hosts        []string `yaml:"hosts" toml:"hosts"`
+	PathPrefixes []string `yaml:"path_prefixes" toml:"path_prefixes"`
+}
+
+// SignIn mirrors proxy.SignInConfig, reading the template and CSS from
+// files.
+type SignIn struct {
+	Title        string `yaml:"title" toml:"title"`
+	TemplateFile string `yaml:"template_file" toml:"template_file"`
+	CSSFile      string `yaml:"css_file" toml:"css_file"`
+}
+
+// Rule mirrors policy.Rule.
+type Rule struct {
+	Name    string       `yaml:"name" toml:"name"`
+	Hosts   []string     `yaml:"hosts" toml:"hosts"`
+	Paths   []string     `yaml:"paths" toml:"paths"`
+	Methods []string     `yaml:"methods" toml:"methods"`
+	AnyOf   *Requirement `yaml:"any_of" toml:"any_of"`
+	AllOf   *Requirement `yaml:"all_of" toml:"all_of"`
+	// Expression must also hold, see policy.Expression.
+	Expression string `yaml:"expression" toml:"expression"`
+}
+
+// Requirement mirrors policy.Requirement.
+type Requirement struct {
+	Groups    []string            `yaml:"groups" toml:"groups"`
+	Emails    []string            `yaml:"emails" toml:"emails"`
+	Providers []string            `yaml:"providers" toml:"providers"`
+	Claims    map[string][]string `yaml:"claims" toml:"claims"`
+}
+
+// Provider holds the settings of all provider types; each type uses the
+// subset it needs.
+type Provider struct {
+	// Type defaults to the provider name.
+	Type string `yaml:"type" toml:"type"`
+	// DisplayName, Icon and Order list the provider on the sign-in page, see
+	// proxy.ProviderDisplay.
+	DisplayName        string   `yaml:"display_name" toml:"display_name"`
+	Icon               string   `yaml:"icon" toml:"icon"`
+	Order              int      `yaml:"order" toml:"order"`
+	ClientID           string   `yaml:"client_id" toml:"client_id"`
+	ClientSecret       string   `yaml:"client_secret" toml:"client_secret"`
+	RedirectURL        string   `yaml:"redirect_url" toml:"redirect_url"`
+	SuccessRedirectURL string   `yaml:"success_redirect_url" toml:"success_redirect_url"`
+	Scopes             []string `yaml:"scopes" toml:"scopes"`
+	DisablePKCE        bool     `yaml:"disable_pkce" toml:"disable_pkce"`
+	// CookieName defaults to "one-oauth-<name>".
+	CookieName string `yaml:"cookie_name" toml:"cookie_name"`
+	// Cookie overrides attributes of the top-level cookie section for this
+	// provider; those it leaves unset are inherited.
+	Cookie *Cookie `yaml:"cookie" toml:"cookie"`
+	// Organizations, Teams ("org/team-slug"), Repositories ("owner/repo"),
+	// EnterpriseURL and APIURL are used by github.
+	Organizations []string `yaml:"organizations" toml:"organizations"`
+	Teams         []string `yaml:"teams" toml:"teams"`
+	Repositories  []string `yaml:"repositories" toml:"repositories"`
+	EnterpriseURL string   `yaml:"enterprise_url" toml:"enterprise_url"`
+	APIURL        string   `yaml:"api_url" toml:"api_url"`
+	// HostedDomains, and the Directory API settings resolving Google Groups,
+	// are used by google.
+	HostedDomains      []string `yaml:"hosted_domains" toml:"hosted_domains"`
+	ServiceAccountFile string   `yaml:"service_account_file" toml:"service_account_file"`
+	AdminEmail         string   `yaml:"admin_email" toml:"admin_email"`
+	DirectoryURL       string   `yaml:"directory_url" toml:"directory_url"`
+	GroupsCacheTTL     Duration `yaml:"groups_cache_ttl" toml:"groups_cache_ttl"`
+	// IssuerURL is used by oidc.
+	IssuerURL string `yaml:"issuer_url" toml:"issuer_url"`
+	// AuthURL, TokenURL, UserInfoURL and Fields are used by generic.
+	AuthURL     string  `yaml:"auth_url" toml:"auth_url"`
+	TokenURL    string  `yaml:"token_url" toml:"token_url"`
+	UserInfoURL string  `yaml:"userinfo_url" toml:"userinfo_url"`
+	Fields      *Fields `yaml:"fields" toml:"fields"`
+}
+
+type Fields struct {
+	ID            string `yaml:"id" toml:"id"`
+	Email         string `yaml:"email" toml:"email"`
+	Name          string `yaml:"name" toml:"name"`
+	Picture       string `yaml:"picture" toml:"picture"`
+	EmailVerified string `yaml:"email_verified" toml:"email_verified"`
+}
+
+type Upstream struct {
+	URL         string `yaml:"url" toml:"url"`
+	Host        string `yaml:"host" toml:"host"`
+	PathPrefix  string `yaml:"path_prefix" toml:"path_prefix"`
+	StripPrefix bool   `yaml:"strip_prefix" toml:"strip_prefix"`
+}
+
+// Duration parses Go duration strings like "30m" in both formats.
+type Duration time.Duration
+
+func (t *Duration) UnmarshalText(text []byte) error {
+	d, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*t = Duration(d)
+	return nil
+}
+
+func (t *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return t.UnmarshalText([]byte(s))
+}
+
+// Load reads path, picking the format from its extension, expands
+// environment references, applies ONEOAUTH_* overrides and validates the
+// result.
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var format string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = "yaml"
+	case ".toml":
+		format = "toml"
+	default:
+		return nil, fmt.Errorf("config: %s: unknown format, use a .yaml, .yml or .toml file", path)
+	}
+
+	file, err := Parse(data, format, os.LookupEnv)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s: %v", path, err)
+	}
+	return file, nil
+}
+
+// Parse decodes data in format, "yaml" or "toml", and resolves environment
+// references and overrides through lookupEnv before validating.
+func Parse(data []byte, format string, lookupEnv func(string) (string, bool)) (*File, error) {
+	file := &File{}
+
+	switch format {
+	case "yaml":
+		if err := yaml.UnmarshalStrict(data, file); err != nil {
+			return nil, err
+		}
+	case "toml":
+		meta, err := toml.DecodeReader(bytes.NewReader(data), file)
+		if err != nil {
+			return nil, err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("unknown key %q", undecoded[0].String())
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	if err := expandEnv(file, lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := applyOverrides(file, lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := file.Validate(); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// environment overrides are named ONEOAUTH_ followed by the value's path
+const overridePrefix = "ONEOAUTH_"
+
+var envReferencePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// expandEnv replaces ${NAME} and ${NAME:-default} in every string value.
+// Referencing an unset variable without default is an error, so a missing
+// secret does not silently become an empty string.
+func expandEnv(file *File, lookupEnv func(string) (string, bool)) error {
+	return walk(reflect.ValueOf(file), nil, func(v reflect.Value, path []string) error {
+		switch {
+		case v.Kind() == reflect.String:
+			s, err := expand(v.String(), lookupEnv)
+			if err != nil {
+				return fmt.Errorf("%s: %v", strings.Join(path, "."), err)
+			}
+			v.SetString(s)
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+			for i := 0; i < v.Len(); i++ {
+				s, err := expand(v.Index(i).String(), lookupEnv)
+				if err != nil {
+					return fmt.Errorf("%s[%d]: %v", strings.Join(path, "."), i, err)
+				}
+				v.Index(i).SetString(s)
+			}
+		}
+		return nil
+	})
+}
+
+func expand(s string, lookupEnv func(string) (string, bool)) (string, error) {
+	var missing string
+	expanded := envReferencePattern.ReplaceAllStringFunc(s, func(reference string) string {
+		match := envReferencePattern.FindStringSubmatch(reference)
+		if value, ok := lookupEnv(match[1]); ok {
+			return value
+		}
+		if match[2] != "" {
+			return match[3]
+		}
+		if missing == "" {
+			missing = match[1]
+		}
+		return ""
+	})
+
+	if missing != "" {
+		return "", fmt.Errorf("environment variable %s is not set", missing)
+	}
+	return expanded, nil
+}
+
+// applyOverrides sets values from ONEOAUTH_* variables named after their
+// path, e.g. ONEOAUTH_SESSION_IDLE_TIMEOUT or ONEOAUTH_UPSTREAMS_0_URL.
+// Map entries, list items and optional sections are only overridden when
+// present in the file. Lists of strings are comma separated.
+func applyOverrides(file *File, lookupEnv func(string) (string, bool)) error {
+	return walk(reflect.ValueOf(file), nil, func(v reflect.Value, path []string) error {
+		name := overrideName(path)
+		raw, ok := lookupEnv(name)
+		if !ok {
+			return nil
+		}
+		if err := setValue(v, raw); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return nil
+	})
+}
+
+func overrideName(path []string) string {
+	name := overridePrefix + strings.ToUpper(strings.Join(path, "_"))
+	return strings.NewReplacer("-", "_", ".", "_").Replace(name)
+}
+
+func setValue(v reflect.Value, raw string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(&b))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var values []string
+		for _, value := range strings.Split(raw, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		v.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("cannot override values of type %s", v.Type())
+	}
+	return nil
+}
+
+// walk calls fn for every leaf value below v with its path of field names,
+// map keys and list indexes. Nil sections are skipped.
+func walk(v reflect.Value, path []string, fn func(v reflect.Value, path []string) error) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return fn(v, path)
+		}
+		if v.IsNil() {
+			return nil
+		}
+		return walk(v.Elem(), path, fn)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			name := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			if err := walk(v.Field(i), append(path[:len(path):len(path)], name), fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		keys := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			k := reflect.ValueOf(key)
+			elem := v.MapIndex(k)
+			if elem.Kind() == reflect.Ptr {
+				if err := walk(elem, append(path[:len(path):len(path)], key), fn); err != nil {
+					return err
+				}
+				continue
+			}
+			// map values are not addressable, so a copy is walked and stored
+			// back
+			copied := reflect.New(elem.Type()).Elem()
+			copied.Set(elem)
+			if err := walk(copied, append(path[:len(path):len(path)], key), fn); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, copied)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			return fn(v, path)
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := walk(v.Index(i), append(path[:len(path):len(path)], strconv.Itoa(i)), fn); err != nil {
+				return err
+			}
+		}
+	default:
+		return fn(v, path)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+listen: ":4999"
+success_redirect_url: https://app.example.com/
+session:
+  idle_timeout: 30m
+  keys:
+    - id: test
+      secret: test secret, at least 32 bytes long
+rules:
+  - name: admin
+    paths: [/admin]
+    any_of:
+      groups: [ops]
+      claims:
+        role: ["${ROLE:-owner}"]
+providers:
+  google:
+    client_id: ${GOOGLE_CLIENT_ID}
+    client_secret: secret
+    redirect_url: https://auth.example.com/auth/google/callback
+`
+
+func lookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(t *testing.T, file *File)
+	}{
+		{
+			name: "references",
+			env:  map[string]string{"GOOGLE_CLIENT_ID": "id"},
+			check: func(t *testing.T, file *File) {
+				if got := file.Providers["google"].ClientID; got != "id" {
+					t.Errorf("client_id = %q, want id", got)
+				}
+				if got := file.Rules[0].AnyOf.Claims["role"]; !reflect.DeepEqual(got, []string{"owner"}) {
+					t.Errorf("claims.role = %q, want default [owner]", got)
+				}
+			},
+		},
+		{
+			name: "reference in a map value",
+			env:  map[string]string{"GOOGLE_CLIENT_ID": "id", "ROLE": "admin"},
+			check: func(t *testing.T, file *File) {
+				if got := file.Rules[0].AnyOf.Claims["role"]; !reflect.DeepEqual(got, []string{"admin"}) {
+					t.Errorf("claims.role = %q, want [admin]", got)
+				}
+			},
+		},
+		{
+			name: "rule overrides",
+			env: map[string]string{
+				"GOOGLE_CLIENT_ID":                       "id",
+				"ONEOAUTH_RULES_0_PATHS":                 "/admin, /ops",
+				"ONEOAUTH_RULES_0_ANY_OF_GROUPS":         "admins",
+				"ONEOAUTH_RULES_0_ANY_OF_CLAIMS_ROLE":    "admin,root",
+				"ONEOAUTH_SESSION_IDLE_TIMEOUT":          "1h",
+				"ONEOAUTH_PROVIDERS_GOOGLE_CLIENT_ID":    "override",
+				"ONEOAUTH_RULES_1_PATHS":                 "/ignored",
+				"ONEOAUTH_RULES_0_ANY_OF_CLAIMS_MISSING": "ignored",
+			},
+			check: func(t *testing.T, file *File) {
+				rule := file.Rules[0]
+				if !reflect.DeepEqual(rule.Paths, []string{"/admin", "/ops"}) {
+					t.Errorf("paths = %q", rule.Paths)
+				}
+				if !reflect.DeepEqual(rule.AnyOf.Groups, []string{"admins"}) {
+					t.Errorf("any_of.groups = %q", rule.AnyOf.Groups)
+				}
+				if !reflect.DeepEqual(rule.AnyOf.Claims, map[string][]string{"role": {"admin", "root"}}) {
+					t.Errorf("any_of.claims = %q", rule.AnyOf.Claims)
+				}
+				if len(file.Rules) != 1 {
+					t.Errorf("%d rules, want overrides not to add any", len(file.Rules))
+				}
+				if got := time.Duration(file.Session.IdleTimeout); got != time.Hour {
+					t.Errorf("idle_timeout = %v, want 1h", got)
+				}
+				if got := file.Providers["google"].ClientID; got != "override" {
+					t.Errorf("client_id = %q, want override", got)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := Parse([]byte(testConfig), "yaml", lookup(test.env))
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.check(t, file)
+		})
+	}
+}
+
+func TestParseEnvErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"unset reference", map[string]string{}, "GOOGLE_CLIENT_ID is not set"},
+		{"invalid duration", map[string]string{"GOOGLE_CLIENT_ID": "id", "ONEOAUTH_SESSION_IDLE_TIMEOUT": "soon"}, "ONEOAUTH_SESSION_IDLE_TIMEOUT"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(testConfig), "yaml", lookup(test.env))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("err = %v, want it to mention %q", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"github.com/ozankasikci/one-oauth/internal/proxy"
+	"github.com/ozankasikci/one-oauth/internal/session"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const defaultWatchInterval = 2 * time.Second
+
+// Reloader rebuilds the proxy from its configuration file and swaps it into
+// a proxy.Handler. A file that fails to load or build is rejected and the
+// running proxy kept. The session store is opened once and shared by every
+// generation, and a generated assertion key carried over, so reloads keep
+// sessions and issued assertions valid. Unchanged Google Directory clients
+// are carried over too, keeping their group caches.
+type Reloader struct {
+	Path    string
+	Store   session.Store
+	Handler *proxy.Handler
+	// Interval between checks of the file for changes; defaults to two
+	// seconds.
+	Interval time.Duration
+
+	mu      sync.Mutex
+	file    *File
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader returns a Reloader for the proxy built from file, loaded from
+// path, and store.
+func NewReloader(path string, file *File, store session.Store, handler *proxy.Handler) *Reloader {
+	reloader := &Reloader{
+		Path:    path,
+		Store:   store,
+		Handler: handler,
+		file:    file,
+	}
+	if info, err := os.Stat(path); err == nil {
+		reloader.modTime = info.ModTime()
+		reloader.size = info.Size()
+	}
+	return reloader
+}
+
+// Reload loads the file and, if it is valid, atomically replaces the served
+// proxy.
+func (t *Reloader) Reload() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if info, err := os.Stat(t.Path); err == nil {
+		t.modTime = info.ModTime()
+		t.size = info.Size()
+	}
+
+	file, err := Load(t.Path)
+	if err != nil {
+		return err
+	}
+	// a generated assertion key stays valid for upstreams caching the JWKS
+	file.signer = t.file.signer
+	file.directories = t.file.directories
+	proxyConfig, err := file.ProxyConfig(t.Store)
+	if err != nil {
+		return err
+	}
+	p, err := proxy.New(proxyConfig)
+	if err != nil {
+		return err
+	}
+
+	if file.Listen != t.file.Listen || file.Server != t.file.Server || !reflect.DeepEqual(file.TLS, t.file.TLS) {
+		log.Printf("config: listen, server or tls settings changed, restart to apply")
+	}
+	if !file.Session.sameStore(t.file.Session) {
+		log.Printf("config: session store changed, restart to apply")
+	}
+
+	t.Handler.Store(p)
+	t.file = file
+	log.Printf("config: reloaded %s", t.Path)
+	return nil
+}
+
+// Watch reloads the proxy whenever the file's modification time or size
+// changes, until stop is closed. Failed reloads are logged.
+func (t *Reloader) Watch(stop <-chan struct{}) {
+	interval := t.Interval
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !t.changed() {
+				continue
+			}
+			if err := t.Reload(); err != nil {
+				log.Printf("config: reload rejected, keeping the running configuration: %v", err)
+			}
+		}
+	}
+}
+
+func (t *Reloader) changed() bool {
+	info, err := os.Stat(t.Path)
+	if err != nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !info.ModTime().Equal(t.modTime) || info.Size() != t.size
+}
+
+// sameStore reports whether other opens the same session store.
+func (t Session) sameStore(other Session) bool {
+	return t.Store == other.Store &&
+		t.Path == other.Path &&
+		t.RedisURL == other.RedisURL &&
+		t.RedisPrefix == other.RedisPrefix
+}
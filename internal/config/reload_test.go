@@ -0,0 +1,194 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/ozankasikci/one-oauth/internal/proxy"
+	"github.com/ozankasikci/one-oauth/internal/session"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const reloadConfig = `
+success_redirect_url: https://app.example.com/
+session:
+  keys:
+    - id: test
+      secret: test secret, at least 32 bytes long
+assertion:
+  algorithm: ES256
+  issuer: https://auth.example.com
+providers:
+  github:
+    client_id: id
+    client_secret: secret
+    redirect_url: https://auth.example.com/auth/github/callback
+`
+
+func writeConfig(t *testing.T, path, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signerKid(t *testing.T, handler *proxy.Handler) string {
+	t.Helper()
+	return handler.Load().Assertion.Config.Signer.Kid
+}
+
+func TestReloadKeepsGeneratedAssertionKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "one-oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig(t, path, reloadConfig)
+
+	file, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := session.NewMemoryStore()
+	proxyConfig, err := file.ProxyConfig(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := proxy.New(proxyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := proxy.NewHandler(p)
+	reloader := NewReloader(path, file, store, handler)
+	kid := signerKid(t, handler)
+
+	writeConfig(t, path, strings.Replace(reloadConfig, "auth.example.com/auth", "auth.example.com:8443/auth", 1))
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if handler.Load() == p {
+		t.Fatal("proxy was not replaced")
+	}
+	if got := signerKid(t, handler); got != kid {
+		t.Errorf("reload rotated the generated key from %s to %s", kid, got)
+	}
+
+	writeConfig(t, path, strings.Replace(reloadConfig, "ES256", "RS256", 1))
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := handler.Load().Assertion.Config.Signer; got.Kid == kid || got.Alg != "RS256" {
+		t.Errorf("signer = %s %s, want a new RS256 key", got.Alg, got.Kid)
+	}
+}
+
+const googleConfig = `
+success_redirect_url: https://app.example.com/
+session:
+  keys:
+    - id: test
+      secret: test secret, at least 32 bytes long
+providers:
+  google:
+    client_id: id
+    client_secret: secret
+    redirect_url: https://auth.example.com/auth/google/callback
+    service_account_file: SERVICE_ACCOUNT_FILE
+    admin_email: admin@example.com
+`
+
+// writeServiceAccount writes the JSON key of a new service account to path.
+func writeServiceAccount(t *testing.T, path string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "proxy@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":    "https://oauth2.example.com/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, account, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadKeepsGoogleDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "one-oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	accountPath := filepath.Join(dir, "service-account.json")
+	writeServiceAccount(t, accountPath)
+	path := filepath.Join(dir, "config.yaml")
+	config := strings.Replace(googleConfig, "SERVICE_ACCOUNT_FILE", accountPath, 1)
+	writeConfig(t, path, config)
+
+	file, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := session.NewMemoryStore()
+	proxyConfig, err := file.ProxyConfig(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := proxy.New(proxyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := NewReloader(path, file, store, proxy.NewHandler(p))
+	directory := func() interface{} {
+		return reloader.file.directories["google"].directory
+	}
+	first := directory()
+
+	// unrelated changes keep the client and its group cache
+	writeConfig(t, path, strings.Replace(config, "auth.example.com/auth", "auth.example.com:8443/auth", 1))
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if directory() != first {
+		t.Error("reload replaced an unchanged directory")
+	}
+
+	// a new admin or service account key builds a new one
+	writeConfig(t, path, strings.Replace(config, "admin@example.com", "root@example.com", 1))
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	second := directory()
+	if second == first {
+		t.Error("reload kept the directory of another admin")
+	}
+	writeServiceAccount(t, accountPath)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if directory() == second {
+		t.Error("reload kept the directory of a replaced service account key")
+	}
+
+	// a failed reload leaves the running directories alone
+	writeConfig(t, path, strings.Replace(config, "admin@example.com", "admin@example.com\n    bogus: true", 1))
+	current := directory()
+	if err := reloader.Reload(); err == nil {
+		t.Fatal("reloaded an invalid file")
+	}
+	if directory() != current {
+		t.Error("failed reload replaced the directory")
+	}
+}
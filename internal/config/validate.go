@@ -0,0 +1,438 @@
+package config
+
+import (
+	"fmt"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/policy"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// provider names become a path segment of the /auth/{name}/... routes
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ValidationError lists every problem found in a configuration, each
+// prefixed with the path of the offending value.
+type ValidationError struct {
+	Problems []string
+}
+
+func (t *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(t.Problems, "\n  ")
+}
+
+type validator struct {
+	problems []string
+}
+
+func (t *validator) addf(path, format string, args ...interface{}) {
+	t.problems = append(t.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (t *validator) required(path, value string) bool {
+	if value == "" {
+		t.addf(path, "required")
+		return false
+	}
+	return true
+}
+
+func (t *validator) absoluteURL(path, value string) {
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		t.addf(path, "%q is not an absolute URL", value)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		t.addf(path, "%q must use http or https", value)
+	}
+}
+
+func (t *validator) oneOf(path, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	t.addf(path, "%q must be one of %s", value, strings.Join(allowed, ", "))
+}
+
+// Validate checks the whole file and reports all problems at once.
+func (t *File) Validate() error {
+	v := &validator{}
+
+	switch {
+	case t.Listen == "", t.Listen == "systemd", strings.HasPrefix(t.Listen, "systemd:"):
+	case strings.HasPrefix(t.Listen, "unix:"):
+		if strings.TrimPrefix(t.Listen, "unix:") == "" {
+			v.addf("listen", "unix socket path is empty")
+		}
+	default:
+		if _, _, err := net.SplitHostPort(t.Listen); err != nil {
+			v.addf("listen", "%q is not a host:port, unix:/path or systemd address", t.Listen)
+		}
+	}
+	t.Server.validate(v)
+	if t.TLS != nil {
+		t.TLS.validate(v)
+	}
+	v.absoluteURL("external_url", t.ExternalURL)
+	v.absoluteURL("success_redirect_url", t.SuccessRedirectURL)
+
+	t.Cookie.validate(v, "cookie", cookie.Default)
+	t.Session.validate(v)
+	if t.Assertion != nil {
+		t.Assertion.validate(v)
+	}
+	if t.Access != nil {
+		t.Access.validate(v)
+	}
+
+	if t.ReturnTo != nil {
+		t.ReturnTo.validate(v)
+	}
+
+	for i, rule := range t.Rules {
+		path := fmt.Sprintf("rules[%d]", i)
+		if rule == nil {
+			v.addf(path, "empty rule")
+			continue
+		}
+		rule.validate(v, path)
+	}
+	if t.Expression != "" {
+		if _, err := policy.Compile(t.Expression); err != nil {
+			v.addf("expression", "%s", strings.TrimPrefix(err.Error(), "policy: "))
+		}
+	}
+
+	if len(t.Providers) == 0 {
+		v.addf("providers", "at least one provider is required")
+	}
+	names := make([]string, 0, len(t.Providers))
+	for name := range t.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := "providers." + name
+		if !providerNamePattern.MatchString(name) {
+			v.addf(path, "name must match %s", providerNamePattern)
+		}
+		if t.Providers[name] == nil {
+			v.addf(path, "empty provider")
+			continue
+		}
+		t.Providers[name].validate(v, path, name, t.SuccessRedirectURL, t.Cookie.options())
+	}
+
+	for i, upstream := range t.Upstreams {
+		path := fmt.Sprintf("upstreams[%d]", i)
+		if upstream == nil {
+			v.addf(path, "empty upstream")
+			continue
+		}
+		if v.required(path+".url", upstream.URL) {
+			v.absoluteURL(path+".url", upstream.URL)
+		}
+		if upstream.PathPrefix != "" && !strings.HasPrefix(upstream.PathPrefix, "/") {
+			v.addf(path+".path_prefix", "%q must start with /", upstream.PathPrefix)
+		}
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+func (t *Server) validate(v *validator) {
+	durations := []struct {
+		field string
+		value Duration
+	}{
+		{"server.read_header_timeout", t.ReadHeaderTimeout},
+		{"server.read_timeout", t.ReadTimeout},
+		{"server.write_timeout", t.WriteTimeout},
+		{"server.idle_timeout", t.IdleTimeout},
+		{"server.shutdown_timeout", t.ShutdownTimeout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			v.addf(d.field, "must not be negative")
+		}
+	}
+	if t.MaxHeaderBytes < 0 {
+		v.addf("server.max_header_bytes", "must not be negative")
+	}
+}
+
+func (t *TLS) validate(v *validator) {
+	if t.ACME != nil {
+		if t.CertFile != "" || t.KeyFile != "" {
+			v.addf("tls.acme", "cannot be combined with cert_file and key_file")
+		}
+		t.ACME.validate(v)
+	} else {
+		v.required("tls.cert_file", t.CertFile)
+		v.required("tls.key_file", t.KeyFile)
+	}
+	if t.ReloadInterval < 0 {
+		v.addf("tls.reload_interval", "must not be negative")
+	}
+	v.oneOf("tls.min_version", t.MinVersion, "1.0", "1.1", "1.2", "1.3")
+	for i, name := range t.CipherSuites {
+		if _, ok := cipherSuiteIDs()[name]; !ok {
+			v.addf(fmt.Sprintf("tls.cipher_suites[%d]", i), "%q is not a supported cipher suite", name)
+		}
+	}
+	v.oneOf("tls.client_auth", t.ClientAuth, "none", "request", "require", "verify_if_given", "require_and_verify")
+	if t.ClientCAFile == "" && (t.ClientAuth == "verify_if_given" || t.ClientAuth == "require_and_verify") {
+		v.addf("tls.client_ca_file", "required to verify client certificates")
+	}
+	if t.RedirectAddress != "" {
+		if _, _, err := net.SplitHostPort(t.RedirectAddress); err != nil {
+			v.addf("tls.redirect_address", "%q is not a host:port address", t.RedirectAddress)
+		}
+	}
+}
+
+func (t *ACME) validate(v *validator) {
+	v.required("tls.acme.cache_dir", t.CacheDir)
+	v.absoluteURL("tls.acme.directory_url", t.DirectoryURL)
+	for i, host := range t.Hosts {
+		if host == "" || strings.ContainsAny(host, ":/") {
+			v.addf(fmt.Sprintf("tls.acme.hosts[%d]", i), "%q is not a hostname", host)
+		}
+	}
+	if t.RenewBefore < 0 {
+		v.addf("tls.acme.renew_before", "must not be negative")
+	}
+}
+
+// validate checks t layered over base.
+func (t *Cookie) validate(v *validator, path string, base cookie.Options) {
+	v.oneOf(path+".same_site", strings.ToLower(t.SameSite), "lax", "strict", "none")
+	if err := t.over(base).Validate(); err != nil {
+		v.addf(path, "%s", strings.TrimPrefix(err.Error(), "cookie: "))
+	}
+}
+
+func (t *Session) validate(v *validator) {
+	v.oneOf("session.store", t.Store, "memory", "bolt", "redis")
+	switch t.Store {
+	case "bolt":
+		v.required("session.path", t.Path)
+	case "redis":
+		if v.required("session.redis_url", t.RedisURL) {
+			if u, err := url.Parse(t.RedisURL); err != nil || u.Scheme != "redis" && u.Scheme != "rediss" {
+				v.addf("session.redis_url", "%q must be a redis:// or rediss:// URL", t.RedisURL)
+			}
+		}
+	}
+	if t.MaxAge < 0 {
+		v.addf("session.max_age", "must not be negative")
+	}
+	if t.IdleTimeout < 0 {
+		v.addf("session.idle_timeout", "must not be negative")
+	}
+
+	if len(t.Keys) == 0 {
+		v.addf("session.keys", "at least one key is required")
+	}
+	seen := map[string]bool{}
+	for i, key := range t.Keys {
+		path := fmt.Sprintf("session.keys[%d]", i)
+		if key == nil {
+			v.addf(path, "empty key")
+			continue
+		}
+		if err := key.sessionKey().Validate(); err != nil {
+			v.addf(path, "%s", strings.TrimPrefix(err.Error(), "session: "))
+		}
+		if key.ID != "" && seen[key.ID] {
+			v.addf(path+".id", "duplicate id %q", key.ID)
+		}
+		seen[key.ID] = true
+	}
+}
+
+func (t *Assertion) validate(v *validator) {
+	v.oneOf("assertion.algorithm", t.Algorithm, "RS256", "ES256", "ES384", "ES512", "EdDSA")
+	v.oneOf("assertion.mode", t.Mode, "query", "form_post")
+	v.required("assertion.issuer", t.Issuer)
+	if t.TTL < 0 {
+		v.addf("assertion.ttl", "must not be negative")
+	}
+}
+
+func (t *Access) validate(v *validator) {
+	for i, domain := range t.Domains {
+		if domain == "" || strings.ContainsAny(domain, "@:/ ") {
+			v.addf(fmt.Sprintf("access.domains[%d]", i), "%q is not a domain", domain)
+		}
+	}
+	lists := []struct {
+		field  string
+		emails []string
+	}{
+		{"access.allow_emails", t.AllowEmails},
+		{"access.deny_emails", t.DenyEmails},
+	}
+	for _, list := range lists {
+		for i, email := range list.emails {
+			if !strings.Contains(email, "@") {
+				v.addf(fmt.Sprintf("%s[%d]", list.field, i), "%q is not an email address", email)
+			}
+		}
+	}
+}
+
+func (t *ReturnTo) validate(v *validator) {
+	for i, host := range t.Hosts {
+		if host == "" || strings.ContainsAny(host, "@:/ ") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			v.addf(fmt.Sprintf("return_to.hosts[%d]", i), "%q is not a host name or *.domain wildcard", host)
+		}
+	}
+	for i, prefix := range t.PathPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			v.addf(fmt.Sprintf("return_to.path_prefixes[%d]", i), "%q must start with /", prefix)
+		}
+	}
+}
+
+func (t *Rule) validate(v *validator, path string) {
+	if t.Expression != "" {
+		if _, err := policy.Compile(t.Expression); err != nil {
+			v.addf(path+".expression", "%s", strings.TrimPrefix(err.Error(), "policy: "))
+		}
+	}
+	for i, host := range t.Hosts {
+		if host == "" || strings.ContainsAny(host, "@:/ ") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			v.addf(fmt.Sprintf("%s.hosts[%d]", path, i), "%q is not a host name or *.domain wildcard", host)
+		}
+	}
+	for i, p := range t.Paths {
+		if !strings.HasPrefix(p, "/") {
+			v.addf(fmt.Sprintf("%s.paths[%d]", path, i), "%q must start with /", p)
+		}
+	}
+	for i, method := range t.Methods {
+		if method == "" || strings.ContainsAny(method, " /") {
+			v.addf(fmt.Sprintf("%s.methods[%d]", path, i), "%q is not an HTTP method", method)
+		}
+	}
+	requirements := []struct {
+		field       string
+		requirement *Requirement
+	}{
+		{".any_of", t.AnyOf},
+		{".all_of", t.AllOf},
+	}
+	for _, r := range requirements {
+		if r.requirement == nil {
+			continue
+		}
+		for i, email := range r.requirement.Emails {
+			if !strings.Contains(email, "@") {
+				v.addf(fmt.Sprintf("%s%s.emails[%d]", path, r.field, i), "%q is not an email address or @domain", email)
+			}
+		}
+		for claim := range r.requirement.Claims {
+			if claim == "" {
+				v.addf(path+r.field+".claims", "empty claim name")
+			}
+		}
+	}
+}
+
+func (t *Provider) validate(v *validator, path, name, defaultSuccessRedirectURL string, defaultCookie cookie.Options) {
+	providerType := t.providerType(name)
+	v.oneOf(path+".type", providerType, "google", "github", "facebook", "oidc", "generic")
+
+	v.required(path+".client_id", t.ClientID)
+	v.required(path+".client_secret", t.ClientSecret)
+	if v.required(path+".redirect_url", t.RedirectURL) {
+		v.absoluteURL(path+".redirect_url", t.RedirectURL)
+	}
+	if t.SuccessRedirectURL == "" && defaultSuccessRedirectURL == "" {
+		v.addf(path+".success_redirect_url", "required unless success_redirect_url is set at the top level")
+	}
+	v.absoluteURL(path+".success_redirect_url", t.SuccessRedirectURL)
+	if t.Icon != "" && !strings.HasPrefix(t.Icon, "data:image/") && !strings.HasPrefix(t.Icon, "/") {
+		v.absoluteURL(path+".icon", t.Icon)
+	}
+	if t.Cookie != nil {
+		t.Cookie.validate(v, path+".cookie", defaultCookie)
+	}
+
+	switch providerType {
+	case "google":
+		for i, domain := range t.HostedDomains {
+			if domain == "" || strings.ContainsAny(domain, "@:/ ") {
+				v.addf(fmt.Sprintf("%s.hosted_domains[%d]", path, i), "%q is not a domain", domain)
+			}
+		}
+		if t.ServiceAccountFile != "" {
+			if v.required(path+".admin_email", t.AdminEmail) && !strings.Contains(t.AdminEmail, "@") {
+				v.addf(path+".admin_email", "%q is not an email address", t.AdminEmail)
+			}
+		} else if t.AdminEmail != "" || t.DirectoryURL != "" {
+			v.addf(path+".service_account_file", "required with admin_email or directory_url")
+		}
+		v.absoluteURL(path+".directory_url", t.DirectoryURL)
+		if t.GroupsCacheTTL < 0 {
+			v.addf(path+".groups_cache_ttl", "must not be negative")
+		}
+	case "github":
+		v.absoluteURL(path+".enterprise_url", t.EnterpriseURL)
+		v.absoluteURL(path+".api_url", t.APIURL)
+		names := []struct {
+			field  string
+			values []string
+			format string
+		}{
+			{".teams", t.Teams, "org/team-slug"},
+			{".repositories", t.Repositories, "owner/repo"},
+		}
+		for _, n := range names {
+			for i, value := range n.values {
+				parts := strings.Split(value, "/")
+				if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+					v.addf(fmt.Sprintf("%s%s[%d]", path, n.field, i), "%q must have the form %s", value, n.format)
+				}
+			}
+		}
+	case "oidc":
+		if v.required(path+".issuer_url", t.IssuerURL) {
+			v.absoluteURL(path+".issuer_url", t.IssuerURL)
+		}
+	case "generic":
+		endpoints := []struct{ field, value string }{
+			{".auth_url", t.AuthURL},
+			{".token_url", t.TokenURL},
+			{".userinfo_url", t.UserInfoURL},
+		}
+		for _, endpoint := range endpoints {
+			if v.required(path+endpoint.field, endpoint.value) {
+				v.absoluteURL(path+endpoint.field, endpoint.value)
+			}
+		}
+	}
+}
+
+func (t *Provider) providerType(name string) string {
+	if t.Type == "" {
+		return name
+	}
+	return t.Type
+}
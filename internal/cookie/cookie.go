@@ -0,0 +1,154 @@
+// Package cookie holds the cookie attributes shared by a provider's
+// short-lived login cookie and its session cookie.
+package cookie
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// lifetime of the login cookie carrying state, PKCE verifier and nonce
+const loginMaxAge = 60 * time.Second
+
+// Options configures the attributes of the cookies a provider issues.
+type Options struct {
+	// Domain scopes cookies to a parent domain, e.g. "example.com" to share
+	// the session between the proxy and upstreams on its subdomains. Defaults
+	// to the host of the responding server.
+	Domain string
+	// Path defaults to "/".
+	Path string
+	// MaxAge caps the session cookie lifetime, which otherwise follows the
+	// session lifetime. A negative value issues cookies without Max-Age that
+	// browsers drop when they close.
+	MaxAge time.Duration
+	// HTTPOnly hides cookies from JavaScript.
+	HTTPOnly bool
+	// Secure restricts cookies to HTTPS. Only dev mode may disable it.
+	Secure bool
+	// SameSite applies to the session cookie. The login cookie uses Lax
+	// unless None is set, since Strict cookies are not sent on the redirect
+	// back from the provider.
+	SameSite http.SameSite
+	// DevMode allows cookies without Secure so logins work over plain HTTP
+	// on localhost. Never enable it in production.
+	DevMode bool
+}
+
+// Default is used by providers without options: host-only, HttpOnly, Secure
+// and SameSite=Lax.
+var Default = Options{
+	Path:     "/",
+	HTTPOnly: true,
+	Secure:   true,
+	SameSite: http.SameSiteLaxMode,
+}
+
+// Dev is Default with dev mode enabled and Secure dropped, for development
+// over plain HTTP.
+var Dev = Options{
+	Path:     "/",
+	HTTPOnly: true,
+	SameSite: http.SameSiteLaxMode,
+	DevMode:  true,
+}
+
+// Validate rejects insecure combinations outside dev mode.
+func (t Options) Validate() error {
+	if !t.Secure && !t.DevMode {
+		return errors.New("cookie: Secure may only be disabled in dev mode")
+	}
+	if t.SameSite == http.SameSiteNoneMode && !t.Secure {
+		return errors.New("cookie: SameSite=None requires Secure")
+	}
+	if t.Path != "" && !strings.HasPrefix(t.Path, "/") {
+		return errors.New("cookie: Path must start with /")
+	}
+	return nil
+}
+
+// Config describes a single cookie, like gologin.CookieConfig with SameSite.
+type Config struct {
+	Name   string
+	Domain string
+	Path   string
+	// MaxAge in seconds: zero omits Max-Age, negative deletes the cookie.
+	MaxAge   int
+	HTTPOnly bool
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// LoginConfig returns the config of the short-lived login cookie name.
+func (t Options) LoginConfig(name string) Config {
+	sameSite := http.SameSiteLaxMode
+	if t.SameSite == http.SameSiteNoneMode {
+		sameSite = http.SameSiteNoneMode
+	}
+
+	return Config{
+		Name:     name,
+		Domain:   t.Domain,
+		Path:     t.path(),
+		MaxAge:   int(loginMaxAge / time.Second),
+		HTTPOnly: t.HTTPOnly,
+		Secure:   t.Secure,
+		SameSite: sameSite,
+	}
+}
+
+// SessionConfig returns the config of session cookie name living for
+// lifetime, capped by MaxAge.
+func (t Options) SessionConfig(name string, lifetime time.Duration) Config {
+	maxAge := int((lifetime + time.Second - 1) / time.Second)
+	if t.MaxAge < 0 {
+		maxAge = 0
+	} else if t.MaxAge > 0 && t.MaxAge < lifetime {
+		maxAge = int(t.MaxAge / time.Second)
+	}
+
+	return Config{
+		Name:     name,
+		Domain:   t.Domain,
+		Path:     t.path(),
+		MaxAge:   maxAge,
+		HTTPOnly: t.HTTPOnly,
+		Secure:   t.Secure,
+		SameSite: t.SameSite,
+	}
+}
+
+func (t Options) path() string {
+	if t.Path == "" {
+		return "/"
+	}
+	return t.Path
+}
+
+// New returns a cookie with the attributes of config.
+func New(config Config, value string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     config.Name,
+		Value:    value,
+		Domain:   config.Domain,
+		Path:     config.Path,
+		MaxAge:   config.MaxAge,
+		HttpOnly: config.HTTPOnly,
+		Secure:   config.Secure,
+		SameSite: config.SameSite,
+	}
+	if config.MaxAge > 0 {
+		cookie.Expires = time.Now().Add(time.Duration(config.MaxAge) * time.Second)
+	} else if config.MaxAge < 0 {
+		cookie.Expires = time.Unix(1, 0)
+	}
+	return cookie
+}
+
+// Expire returns a cookie deleting the one described by config.
+func Expire(config Config) *http.Cookie {
+	config.MaxAge = -1
+	return New(config, "")
+}
@@ -0,0 +1,90 @@
+package cookie
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		valid   bool
+	}{
+		{"default", Default, true},
+		{"dev", Dev, true},
+		{"insecure", Options{}, false},
+		{"insecure with SameSite=Lax", Options{SameSite: http.SameSiteLaxMode}, false},
+		{"SameSite=None", Options{Secure: true, SameSite: http.SameSiteNoneMode}, true},
+		{"SameSite=None without Secure", Options{SameSite: http.SameSiteNoneMode}, false},
+		{"SameSite=None without Secure in dev mode", Options{SameSite: http.SameSiteNoneMode, DevMode: true}, false},
+		{"relative path", Options{Secure: true, Path: "app"}, false},
+		{"path", Options{Secure: true, Path: "/app"}, true},
+	}
+	for _, test := range tests {
+		if err := test.options.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: err = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestDev(t *testing.T) {
+	if Dev.Secure || !Dev.DevMode {
+		t.Errorf("Dev = %+v, want dev mode without Secure", Dev)
+	}
+	// otherwise Dev matches Default
+	dev := Dev
+	dev.Secure, dev.DevMode = true, false
+	if dev != Default {
+		t.Errorf("Dev = %+v, want Default %+v", Dev, Default)
+	}
+}
+
+func TestLoginConfig(t *testing.T) {
+	tests := []struct {
+		sameSite http.SameSite
+		want     http.SameSite
+	}{
+		{http.SameSiteLaxMode, http.SameSiteLaxMode},
+		{http.SameSiteStrictMode, http.SameSiteLaxMode},
+		{http.SameSiteDefaultMode, http.SameSiteLaxMode},
+		{http.SameSiteNoneMode, http.SameSiteNoneMode},
+	}
+	for _, test := range tests {
+		options := Options{Domain: "example.com", HTTPOnly: true, Secure: true, SameSite: test.sameSite, MaxAge: time.Hour}
+		want := Config{Name: "login", Domain: "example.com", Path: "/", MaxAge: 60, HTTPOnly: true, Secure: true, SameSite: test.want}
+		if config := options.LoginConfig("login"); config != want {
+			t.Errorf("SameSite %v: config = %+v, want %+v", test.sameSite, config, want)
+		}
+	}
+}
+
+func TestSessionConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		lifetime time.Duration
+		want     int
+	}{
+		{"session lifetime", 0, time.Hour, 3600},
+		{"rounded up", 0, time.Minute + time.Millisecond, 61},
+		{"capped", time.Minute, time.Hour, 60},
+		{"cap above the lifetime", 2 * time.Hour, time.Hour, 3600},
+		{"browser session", -1, time.Hour, 0},
+	}
+	for _, test := range tests {
+		options := Default
+		options.Path = "/app"
+		options.MaxAge = test.maxAge
+		want := Config{Name: "session", Path: "/app", MaxAge: test.want, HTTPOnly: true, Secure: true, SameSite: http.SameSiteLaxMode}
+		if config := options.SessionConfig("session", test.lifetime); config != want {
+			t.Errorf("%s: config = %+v, want %+v", test.name, config, want)
+		}
+	}
+
+	// the path defaults to the root
+	if config := (Options{}).SessionConfig("session", time.Hour); config.Path != "/" {
+		t.Errorf("path = %q, want /", config.Path)
+	}
+}
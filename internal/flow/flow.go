@@ -0,0 +1,305 @@
+// Package flow implements the authorization code flow shared by all
+// providers: CSRF state, PKCE (RFC 7636, S256), the OpenID Connect nonce and
+// the URL to return to after login.
+//
+// All of them are kept in a single short-lived cookie from login to
+// callback, so the callback needs no server-side storage. The callback adds the
+// token to the ctx with gologin's oauth2.WithToken, which keeps it compatible
+// with handlers reading oauth2.TokenFromContext.
+package flow
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/dghubble/gologin/v2"
+	oauth2Login "github.com/dghubble/gologin/v2/oauth2"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"golang.org/x/oauth2"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Errors which may occur on callback.
+var (
+	ErrMissingCookie = errors.New("flow: missing login cookie")
+	ErrInvalidState  = errors.New("flow: invalid state parameter")
+	ErrMissingCode   = errors.New("flow: missing code parameter")
+)
+
+// AuthorizationError is the error parameter an authorization server
+// redirected back with, e.g. access_denied when the user cancelled.
+type AuthorizationError struct {
+	Code        string
+	Description string
+}
+
+func (t *AuthorizationError) Error() string {
+	return fmt.Sprintf("flow: authorization failed: %s %s", t.Code, t.Description)
+}
+
+// Options tune the authorization request.
+type Options struct {
+	// DisablePKCE omits the code challenge, for servers rejecting it.
+	DisablePKCE bool
+	// Nonce adds an OpenID Connect nonce to the request. The callback adds it
+	// to the ctx for the ID token check, see NonceFromContext.
+	Nonce bool
+	// AuthParams are added to the authorization request as is, such as
+	// Google's hd.
+	AuthParams map[string]string
+}
+
+// Validator checks the URL a user asks to return to after login, passed to
+// the login endpoint as rd or return_to.
+type Validator interface {
+	Validate(raw string) (string, error)
+}
+
+type nonceKey struct{}
+
+type validatorKey struct{}
+
+type returnToKey struct{}
+
+type failureKey struct{}
+
+// WithFailureHandler returns a copy of ctx that stores the handler of failed
+// callbacks, used when CallbackHandler is given none. The error is available
+// with gologin.ErrorFromContext, and the return URL, once the login cookie is
+// read, with ReturnToFromContext.
+func WithFailureHandler(ctx context.Context, failure http.Handler) context.Context {
+	return context.WithValue(ctx, failureKey{}, failure)
+}
+
+// WithValidator returns a copy of ctx that stores the return URL Validator.
+// Return URLs are ignored without one.
+func WithValidator(ctx context.Context, validator Validator) context.Context {
+	return context.WithValue(ctx, validatorKey{}, validator)
+}
+
+// WithReturnTo returns a copy of ctx that stores the validated return URL.
+func WithReturnTo(ctx context.Context, returnTo string) context.Context {
+	return context.WithValue(ctx, returnToKey{}, returnTo)
+}
+
+// ReturnToFromContext returns the validated return URL the login was started
+// with, if any.
+func ReturnToFromContext(ctx context.Context) (string, bool) {
+	returnTo, ok := ctx.Value(returnToKey{}).(string)
+	return returnTo, ok && returnTo != ""
+}
+
+// WithNonce returns a copy of ctx that stores the nonce value.
+func WithNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, nonceKey{}, nonce)
+}
+
+// NonceFromContext returns the nonce sent with the authorization request.
+func NonceFromContext(ctx context.Context) (string, error) {
+	nonce, ok := ctx.Value(nonceKey{}).(string)
+	if !ok || nonce == "" {
+		return "", errors.New("flow: context missing nonce")
+	}
+	return nonce, nil
+}
+
+// LoginCookieName returns the login cookie name of the provider instance
+// name, so logins started with different providers at once do not overwrite
+// each other's state. Unnamed providers use gologin's default name.
+func LoginCookieName(provider string) string {
+	if provider == "" {
+		return gologin.DefaultCookieConfig.Name
+	}
+	return gologin.DefaultCookieConfig.Name + "-" + provider
+}
+
+// LoginHandler issues the login cookie and redirects to the AuthURL with the
+// state, code challenge and nonce. A valid rd or return_to parameter is kept
+// in the cookie for the callback.
+func LoginHandler(cookieConfig cookie.Config, config *oauth2.Config, options Options) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		var params loginParams
+		var opts []oauth2.AuthCodeOption
+
+		params.state = randomString()
+		if !options.DisablePKCE {
+			params.verifier = randomString()
+			opts = append(opts,
+				oauth2.SetAuthURLParam("code_challenge", codeChallenge(params.verifier)),
+				oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+			)
+		}
+		if options.Nonce {
+			params.nonce = randomString()
+			opts = append(opts, oauth2.SetAuthURLParam("nonce", params.nonce))
+		}
+		for key, value := range options.AuthParams {
+			opts = append(opts, oauth2.SetAuthURLParam(key, value))
+		}
+		params.returnTo = validReturnTo(r.Context(), returnToParam(r))
+
+		http.SetCookie(w, cookie.New(cookieConfig, params.encode()))
+		http.Redirect(w, r, config.AuthCodeURL(params.state, opts...), http.StatusFound)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// CallbackHandler checks the state against the login cookie, exchanges the
+// code with the PKCE verifier and adds the token, and the nonce if one was
+// sent, to the ctx. Without a failure handler, the one stored in the ctx by
+// WithFailureHandler is used, or else gologin's default.
+func CallbackHandler(cookieConfig cookie.Config, config *oauth2.Config, success, failure http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		failure := failure
+		if failure == nil {
+			failure = failureHandler(ctx)
+		}
+
+		params, err := readCookie(r, cookieConfig.Name)
+		if err != nil {
+			failure.ServeHTTP(w, r.WithContext(gologin.WithError(ctx, err)))
+			return
+		}
+
+		// the cookie is single use, whatever the outcome
+		http.SetCookie(w, cookie.Expire(cookieConfig))
+
+		// the cookie is not signed, so its return URL is checked again
+		if returnTo := validReturnTo(ctx, params.returnTo); returnTo != "" {
+			ctx = WithReturnTo(ctx, returnTo)
+		}
+
+		query := r.URL.Query()
+		if errCode := query.Get("error"); errCode != "" {
+			err := &AuthorizationError{Code: errCode, Description: query.Get("error_description")}
+			failure.ServeHTTP(w, r.WithContext(gologin.WithError(ctx, err)))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(params.state)) != 1 {
+			failure.ServeHTTP(w, r.WithContext(gologin.WithError(ctx, ErrInvalidState)))
+			return
+		}
+		code := query.Get("code")
+		if code == "" {
+			failure.ServeHTTP(w, r.WithContext(gologin.WithError(ctx, ErrMissingCode)))
+			return
+		}
+
+		var opts []oauth2.AuthCodeOption
+		if params.verifier != "" {
+			opts = append(opts, oauth2.SetAuthURLParam("code_verifier", params.verifier))
+		}
+		token, err := config.Exchange(ctx, code, opts...)
+		if err != nil {
+			failure.ServeHTTP(w, r.WithContext(gologin.WithError(ctx, err)))
+			return
+		}
+
+		ctx = oauth2Login.WithState(ctx, params.state)
+		ctx = oauth2Login.WithToken(ctx, token)
+		if params.nonce != "" {
+			ctx = WithNonce(ctx, params.nonce)
+		}
+		success.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// Fail serves the failure handler stored in the ctx, see
+// WithFailureHandler, with err. Handlers run after a successful callback
+// use it to fail the login like the callback itself.
+func Fail(w http.ResponseWriter, r *http.Request, err error) {
+	ctx := r.Context()
+	failureHandler(ctx).ServeHTTP(w, r.WithContext(gologin.WithError(ctx, err)))
+}
+
+func failureHandler(ctx context.Context) http.Handler {
+	if failure, ok := ctx.Value(failureKey{}).(http.Handler); ok {
+		return failure
+	}
+	return gologin.DefaultFailureHandler
+}
+
+// loginParams is the content of the login cookie, encoded as
+// state.verifier.nonce.returnTo with empty parts for disabled features and
+// the return URL base64url encoded.
+type loginParams struct {
+	state    string
+	verifier string
+	nonce    string
+	returnTo string
+}
+
+func (t loginParams) encode() string {
+	return t.state + "." + t.verifier + "." + t.nonce + "." + base64.RawURLEncoding.EncodeToString([]byte(t.returnTo))
+}
+
+func readCookie(r *http.Request, name string) (loginParams, error) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return loginParams{}, ErrMissingCookie
+	}
+
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 4 || parts[0] == "" {
+		return loginParams{}, ErrMissingCookie
+	}
+	returnTo, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return loginParams{}, ErrMissingCookie
+	}
+	return loginParams{state: parts[0], verifier: parts[1], nonce: parts[2], returnTo: string(returnTo)}, nil
+}
+
+// returnToParam returns the rd or return_to query parameter.
+func returnToParam(r *http.Request) string {
+	query := r.URL.Query()
+	if rd := query.Get("rd"); rd != "" {
+		return rd
+	}
+	return query.Get("return_to")
+}
+
+// validReturnTo returns the validated returnTo, or "" if it is empty, or
+// invalid or unchecked for lack of a Validator in ctx.
+func validReturnTo(ctx context.Context, returnTo string) string {
+	if returnTo == "" {
+		return ""
+	}
+	validator, ok := ctx.Value(validatorKey{}).(Validator)
+	if !ok {
+		return ""
+	}
+	returnTo, err := validator.Validate(returnTo)
+	if err != nil {
+		log.Printf("flow: ignoring return URL: %v", err)
+		return ""
+	}
+	return returnTo
+}
+
+// codeChallenge derives the S256 challenge for verifier.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// randomString returns 32 random bytes base64url encoded, which also makes a
+// valid PKCE verifier of 43 characters. It panics if the system's random
+// source fails, rather than issue guessable state.
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("flow: reading random bytes: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,250 @@
+package flow
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/dghubble/gologin/v2"
+	oauth2Login "github.com/dghubble/gologin/v2/oauth2"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/redirect"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// fakeServer is an authorization server whose token endpoint checks the PKCE
+// verifier against the challenge of the last authorization request.
+type fakeServer struct {
+	*httptest.Server
+	challenge string
+	verifier  string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	server := &fakeServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.verifier = r.FormValue("code_verifier")
+		if r.FormValue("code") != "code" || server.challenge != "" && codeChallenge(server.verifier) != server.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "access", "token_type": "Bearer"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (t *fakeServer) config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/authorize", TokenURL: t.URL + "/token", AuthStyle: oauth2.AuthStyleInParams},
+	}
+}
+
+var cookieConfig = cookie.Dev.LoginConfig(LoginCookieName("idp"))
+
+// result is what the callback passed on to its success or failure handler.
+type result struct {
+	token    *oauth2.Token
+	nonce    string
+	returnTo string
+	err      error
+}
+
+// login runs LoginHandler for target and returns the authorization request
+// and the login cookie.
+func login(t *testing.T, server *fakeServer, options Options, ctx context.Context, target string) (url.Values, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	LoginHandler(cookieConfig, server.config(), options).ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx))
+	location, err := url.Parse(w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusFound || err != nil || len(cookies) != 1 || cookies[0].Name != cookieConfig.Name {
+		t.Fatalf("login = %d to %q with cookies %v", w.Code, w.Header().Get("Location"), cookies)
+	}
+	server.challenge = location.Query().Get("code_challenge")
+	return location.Query(), cookies[0]
+}
+
+// callback runs CallbackHandler for query with the login cookie c.
+func callback(server *fakeServer, ctx context.Context, query string, c *http.Cookie) (result, *httptest.ResponseRecorder) {
+	var got result
+	success := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.token, _ = oauth2Login.TokenFromContext(r.Context())
+		got.nonce, _ = NonceFromContext(r.Context())
+		got.returnTo, _ = ReturnToFromContext(r.Context())
+	})
+	failure := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.err = gologin.ErrorFromContext(r.Context())
+		got.returnTo, _ = ReturnToFromContext(r.Context())
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/auth/idp/callback?"+query, nil)
+	if c != nil {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	CallbackHandler(cookieConfig, server.config(), success, failure).ServeHTTP(w, r.WithContext(ctx))
+	return got, w
+}
+
+// TestCodeChallenge checks the example of RFC 7636 appendix B.
+func TestCodeChallenge(t *testing.T) {
+	if challenge := codeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("challenge = %s", challenge)
+	}
+	if verifier := randomString(); len(verifier) != 43 || verifier == randomString() {
+		t.Errorf("verifier = %q, want 43 fresh characters", verifier)
+	}
+}
+
+func TestLoginCallback(t *testing.T) {
+	server := newFakeServer(t)
+	query, c := login(t, server, Options{Nonce: true, AuthParams: map[string]string{"hd": "example.com"}}, context.Background(), "/auth/idp/login")
+
+	if query.Get("code_challenge_method") != "S256" || query.Get("state") == "" || query.Get("nonce") == "" || query.Get("hd") != "example.com" {
+		t.Fatalf("authorization request = %v", query)
+	}
+	if c.MaxAge != 60 || !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("login cookie = %+v", c)
+	}
+
+	got, w := callback(server, context.Background(), "code=code&state="+url.QueryEscape(query.Get("state")), c)
+	if got.err != nil || got.token == nil || got.token.AccessToken != "access" {
+		t.Fatalf("callback = %+v", got)
+	}
+	if codeChallenge(server.verifier) != query.Get("code_challenge") {
+		t.Errorf("verifier %q does not match the challenge", server.verifier)
+	}
+	// the nonce sent is the one the ID token is checked against
+	if got.nonce != query.Get("nonce") {
+		t.Errorf("nonce = %q, want %q", got.nonce, query.Get("nonce"))
+	}
+	// the cookie is single use
+	if expired := w.Result().Cookies(); len(expired) != 1 || expired[0].Name != c.Name || expired[0].MaxAge >= 0 {
+		t.Errorf("cookies after callback = %v", expired)
+	}
+}
+
+func TestLoginWithoutPKCE(t *testing.T) {
+	server := newFakeServer(t)
+	query, c := login(t, server, Options{DisablePKCE: true}, context.Background(), "/auth/idp/login")
+	if query.Get("code_challenge") != "" || query.Get("nonce") != "" {
+		t.Fatalf("authorization request = %v", query)
+	}
+	got, _ := callback(server, context.Background(), "code=code&state="+url.QueryEscape(query.Get("state")), c)
+	if got.err != nil || server.verifier != "" || got.nonce != "" {
+		t.Errorf("callback = %+v with verifier %q", got, server.verifier)
+	}
+}
+
+func TestCallbackErrors(t *testing.T) {
+	server := newFakeServer(t)
+	query, c := login(t, server, Options{Nonce: true}, context.Background(), "/auth/idp/login")
+	state := url.QueryEscape(query.Get("state"))
+
+	withValue := func(value string) *http.Cookie {
+		return &http.Cookie{Name: c.Name, Value: value}
+	}
+	tests := []struct {
+		name   string
+		query  string
+		cookie *http.Cookie
+		want   error
+	}{
+		{"state mismatch", "code=code&state=other", c, ErrInvalidState},
+		{"no state", "code=code", c, ErrInvalidState},
+		{"no code", "state=" + state, c, ErrMissingCode},
+		{"no cookie", "code=code&state=" + state, nil, ErrMissingCookie},
+		{"legacy cookie", "code=code&state=" + state, withValue(query.Get("state") + ".verifier.nonce"), ErrMissingCookie},
+		{"empty state", "code=code&state=", withValue("..."), ErrMissingCookie},
+		{"bad return URL", "code=code&state=" + state, withValue(query.Get("state") + "...!"), ErrMissingCookie},
+		{"empty cookie", "code=code&state=" + state, withValue(""), ErrMissingCookie},
+	}
+	for _, test := range tests {
+		got, w := callback(server, context.Background(), test.query, test.cookie)
+		if got.err != test.want || got.token != nil || w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: err = %v, want %v", test.name, got.err, test.want)
+		}
+	}
+
+	// the authorization server's error is passed on
+	got, _ := callback(server, context.Background(), "error=access_denied&error_description=cancelled&state="+state, c)
+	var authorizationErr *AuthorizationError
+	if !errors.As(got.err, &authorizationErr) || authorizationErr.Code != "access_denied" || authorizationErr.Description != "cancelled" {
+		t.Errorf("authorization error = %v", got.err)
+	}
+
+	// a verifier not matching the challenge fails the exchange
+	forged := withValue(query.Get("state") + "." + randomString() + ".nonce.")
+	if got, _ := callback(server, context.Background(), "code=code&state="+state, forged); got.err == nil || got.token != nil {
+		t.Errorf("exchange with another verifier = %+v", got)
+	}
+}
+
+func TestFailureHandlerFromContext(t *testing.T) {
+	var failed error
+	ctx := WithFailureHandler(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed = gologin.ErrorFromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/auth/idp/callback", nil).WithContext(ctx)
+	CallbackHandler(cookieConfig, &oauth2.Config{}, http.NotFoundHandler(), nil).ServeHTTP(httptest.NewRecorder(), r)
+	if failed != ErrMissingCookie {
+		t.Errorf("callback failure = %v", failed)
+	}
+
+	err := errors.New("userinfo failed")
+	Fail(httptest.NewRecorder(), r, err)
+	if failed != err {
+		t.Errorf("Fail = %v", failed)
+	}
+}
+
+func TestReturnTo(t *testing.T) {
+	server := newFakeServer(t)
+	allowlist := &redirect.Allowlist{Hosts: []string{"app.example.com"}}
+	validated := WithValidator(context.Background(), allowlist)
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		target string
+		want   string
+	}{
+		{"rd", validated, "/auth/idp/login?rd=" + url.QueryEscape("https://app.example.com/docs?page=2"), "https://app.example.com/docs?page=2"},
+		{"return_to", validated, "/auth/idp/login?return_to=%2Fdocs", "/docs"},
+		{"off the allowlist", validated, "/auth/idp/login?rd=" + url.QueryEscape("https://evil.com/"), ""},
+		{"protocol relative", validated, "/auth/idp/login?rd=" + url.QueryEscape("//evil.com/"), ""},
+		{"javascript", validated, "/auth/idp/login?rd=" + url.QueryEscape("javascript:alert(1)"), ""},
+		{"without a validator", context.Background(), "/auth/idp/login?rd=%2Fdocs", ""},
+	}
+	for _, test := range tests {
+		query, c := login(t, server, Options{}, test.ctx, test.target)
+		got, _ := callback(server, test.ctx, "code=code&state="+url.QueryEscape(query.Get("state")), c)
+		if got.err != nil || got.returnTo != test.want {
+			t.Errorf("%s: return URL = %q, %v, want %q", test.name, got.returnTo, got.err, test.want)
+		}
+	}
+
+	// the unsigned cookie's return URL is validated again
+	query, _ := login(t, server, Options{}, validated, "/auth/idp/login")
+	forged := &http.Cookie{Name: cookieConfig.Name, Value: query.Get("state") + "..." + base64.RawURLEncoding.EncodeToString([]byte("https://evil.com/"))}
+	if got, _ := callback(server, validated, "code=code&state="+url.QueryEscape(query.Get("state")), forged); got.returnTo != "" {
+		t.Errorf("forged cookie returned to %q", got.returnTo)
+	}
+
+	// failures keep the return URL for the sign-in page
+	query, c := login(t, server, Options{}, validated, "/auth/idp/login?rd=%2Fdocs")
+	if got, _ := callback(server, validated, "error=access_denied&state="+url.QueryEscape(query.Get("state")), c); got.err == nil || got.returnTo != "/docs" {
+		t.Errorf("failed callback = %+v", got)
+	}
+}
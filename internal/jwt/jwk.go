@@ -0,0 +1,119 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var ErrKeyNotFound = errors.New("jwt: no matching key found")
+
+// JSONWebKey is a public key as described by RFC 7517.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// KeySet is a JWK set as served from a jwks_uri.
+type KeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// Find returns the signing keys matching kid. An empty kid matches every key.
+func (t KeySet) Find(kid string) []JSONWebKey {
+	var keys []JSONWebKey
+	for _, key := range t.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if kid == "" || key.Kid == kid {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// PublicKey decodes the key material into an *rsa.PublicKey, *ecdsa.PublicKey
+// or ed25519.PublicKey.
+func (t JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch t.Kty {
+	case "RSA":
+		n, err := decodeBigInt(t.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(t.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, err := curveByName(t.Crv)
+		if err != nil {
+			return nil, err
+		}
+		x, err := decodeBigInt(t.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(t.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("jwt: EC point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if t.Crv != "Ed25519" {
+			return nil, fmt.Errorf("jwt: unsupported OKP curve %q", t.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(t.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("jwt: invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("jwt: unsupported key type %q", t.Kty)
+}
+
+func curveByName(name string) (elliptic.Curve, error) {
+	switch name {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	}
+
+	return nil, fmt.Errorf("jwt: unsupported EC curve %q", name)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("jwt: empty key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
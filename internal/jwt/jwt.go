@@ -0,0 +1,228 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed        = errors.New("jwt: malformed token")
+	ErrInvalidSignature = errors.New("jwt: invalid signature")
+	ErrExpired          = errors.New("jwt: token is expired")
+	ErrNotYetValid      = errors.New("jwt: token is not valid yet")
+)
+
+type Header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Claims holds the decoded payload of a token.
+type Claims map[string]interface{}
+
+// Token is a parsed, not yet verified, compact JWS.
+type Token struct {
+	Header       Header
+	Claims       Claims
+	signingInput string
+	signature    []byte
+}
+
+// Parse decodes a compact serialized token without verifying it.
+func Parse(raw string) (*Token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	token := &Token{signingInput: parts[0] + "." + parts[1]}
+	if err := decodeSegment(parts[0], &token.Header); err != nil {
+		return nil, err
+	}
+	if err := decodeSegment(parts[1], &token.Claims); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	token.signature = signature
+
+	return token, nil
+}
+
+// Verify checks the token signature against key using the algorithm named in
+// the token header. The key type must match the algorithm family.
+func (t *Token) Verify(key crypto.PublicKey) error {
+	switch t.Header.Alg {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("jwt: %s requires an RSA key", t.Header.Alg)
+		}
+		hash := hashFor(t.Header.Alg)
+		digest := digest(hash, t.signingInput)
+		var err error
+		if strings.HasPrefix(t.Header.Alg, "PS") {
+			err = rsa.VerifyPSS(rsaKey, hash, digest, t.signature, nil)
+		} else {
+			err = rsa.VerifyPKCS1v15(rsaKey, hash, digest, t.signature)
+		}
+		if err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case "ES256", "ES384", "ES512":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("jwt: %s requires an EC key", t.Header.Alg)
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(ecKey, digest(hashFor(t.Header.Alg), t.signingInput), r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case "EdDSA":
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("jwt: EdDSA requires an Ed25519 key")
+		}
+		if !ed25519.Verify(edKey, []byte(t.signingInput), t.signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+
+	return fmt.Errorf("jwt: unsupported algorithm %q", t.Header.Alg)
+}
+
+// VerifyKeySet tries every key in set matching the token's kid.
+func (t *Token) VerifyKeySet(set KeySet) error {
+	keys := set.Find(t.Header.Kid)
+	if len(keys) == 0 {
+		return ErrKeyNotFound
+	}
+
+	err := ErrKeyNotFound
+	for _, jwk := range keys {
+		if jwk.Alg != "" && jwk.Alg != t.Header.Alg {
+			continue
+		}
+		key, keyErr := jwk.PublicKey()
+		if keyErr != nil {
+			err = keyErr
+			continue
+		}
+		if err = t.Verify(key); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// ValidateTime checks exp and nbf against now, allowing leeway for clock skew.
+func (t Claims) ValidateTime(now time.Time, leeway time.Duration) error {
+	if exp, ok := t.Time("exp"); !ok {
+		return errors.New("jwt: missing exp claim")
+	} else if now.Add(-leeway).After(exp) {
+		return ErrExpired
+	}
+	if nbf, ok := t.Time("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return ErrNotYetValid
+	}
+	return nil
+}
+
+// String returns the claim as a string, or "" if absent or of another type.
+func (t Claims) String(name string) string {
+	s, _ := t[name].(string)
+	return s
+}
+
+// Bool returns the claim as a bool. Some issuers encode booleans as strings.
+func (t Claims) Bool(name string) bool {
+	switch v := t[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// Time returns a NumericDate claim.
+func (t Claims) Time(name string) (time.Time, bool) {
+	switch v := t[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(n, 0), true
+	}
+	return time.Time{}, false
+}
+
+// Audience returns the aud claim, which may be a single string or an array.
+func (t Claims) Audience() []string {
+	switch v := t["aud"].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var aud []string
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				aud = append(aud, s)
+			}
+		}
+		return aud
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+func hashFor(alg string) crypto.Hash {
+	switch alg[2:] {
+	case "384":
+		return crypto.SHA384
+	case "512":
+		return crypto.SHA512
+	}
+	return crypto.SHA256
+}
+
+func digest(hash crypto.Hash, input string) []byte {
+	h := hash.New()
+	h.Write([]byte(input))
+	return h.Sum(nil)
+}
@@ -0,0 +1,236 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+)
+
+// Signer signs tokens with a private key. Alg is derived from the key type:
+// RS256 for RSA, ES256/ES384/ES512 for P-256/P-384/P-521 and EdDSA for Ed25519.
+type Signer struct {
+	Key crypto.Signer
+	Alg string
+	Kid string
+}
+
+func NewSigner(key crypto.Signer) (*Signer, error) {
+	signer := &Signer{Key: key}
+
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("jwt: RSA keys must be at least 2048 bits")
+		}
+		signer.Alg = "RS256"
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			signer.Alg = "ES256"
+		case elliptic.P384():
+			signer.Alg = "ES384"
+		case elliptic.P521():
+			signer.Alg = "ES512"
+		default:
+			return nil, errors.New("jwt: unsupported EC curve")
+		}
+	case ed25519.PublicKey:
+		signer.Alg = "EdDSA"
+	default:
+		return nil, fmt.Errorf("jwt: unsupported key type %T", k)
+	}
+
+	kid, err := signer.JSONWebKey().Thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	signer.Kid = kid
+
+	return signer, nil
+}
+
+// GenerateSigner creates a signer with a fresh key for alg. Tokens signed with
+// it can only be verified while the process lives, so it suits development.
+func GenerateSigner(alg string) (*Signer, error) {
+	var key crypto.Signer
+	var err error
+
+	switch alg {
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ES512":
+		key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("jwt: unsupported algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSigner(key)
+}
+
+// LoadSigner reads a PEM encoded PKCS#8, PKCS#1 or SEC 1 private key.
+func LoadSigner(path string) (*Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("jwt: no PEM data in %s", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jwt: parsing %s: %v", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("jwt: %s does not hold a signing key", path)
+	}
+	return NewSigner(signer)
+}
+
+// Sign serializes claims into a compact JWS.
+func (t *Signer) Sign(claims Claims) (string, error) {
+	header, err := json.Marshal(Header{Alg: t.Alg, Kid: t.Kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch t.Alg {
+	case "EdDSA":
+		signature, err = t.Key.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	case "ES256", "ES384", "ES512":
+		signature, err = t.signECDSA(signingInput)
+	default:
+		hash := hashFor(t.Alg)
+		signature, err = t.Key.Sign(rand.Reader, digest(hash, signingInput), hash)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// signECDSA produces the fixed size r||s signature JWS expects rather than the
+// ASN.1 encoding crypto.Signer returns.
+func (t *Signer) signECDSA(signingInput string) ([]byte, error) {
+	key, ok := t.Key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("jwt: ECDSA signing requires *ecdsa.PrivateKey")
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest(hashFor(t.Alg), signingInput))
+	if err != nil {
+		return nil, err
+	}
+
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return append(paddedBytes(r, size), paddedBytes(s, size)...), nil
+}
+
+// JSONWebKey returns the public half of the signing key.
+func (t *Signer) JSONWebKey() JSONWebKey {
+	jwk := JSONWebKey{Kid: t.Kid, Use: "sig", Alg: t.Alg}
+
+	switch k := t.Key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = k.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(paddedBytes(k.X, size))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(paddedBytes(k.Y, size))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(k)
+	}
+
+	return jwk
+}
+
+// Thumbprint computes the RFC 7638 SHA-256 thumbprint of the key.
+func (t JSONWebKey) Thumbprint() (string, error) {
+	var members interface{}
+	switch t.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{t.E, t.Kty, t.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{t.Crv, t.Kty, t.X, t.Y}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{t.Crv, t.Kty, t.X}
+	default:
+		return "", fmt.Errorf("jwt: unsupported key type %q", t.Kty)
+	}
+
+	b, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// paddedBytes returns n big-endian encoded and left padded to size bytes.
+func paddedBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
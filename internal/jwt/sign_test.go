@@ -0,0 +1,160 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var algs = []string{"RS256", "ES256", "ES384", "ES512", "EdDSA"}
+
+func TestSignVerify(t *testing.T) {
+	for _, alg := range algs {
+		signer, err := GenerateSigner(alg)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if signer.Alg != alg {
+			t.Errorf("%s: signer alg = %s", alg, signer.Alg)
+		}
+
+		raw, err := signer.Sign(Claims{"sub": "1"})
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		token, err := Parse(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if token.Header.Alg != alg || token.Header.Kid != signer.Kid || token.Header.Typ != "JWT" || token.Claims.String("sub") != "1" {
+			t.Errorf("%s: token = %+v", alg, token)
+		}
+
+		set := KeySet{Keys: []JSONWebKey{signer.JSONWebKey()}}
+		if err := token.VerifyKeySet(set); err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+
+		// another key of the same algorithm does not verify
+		other, err := GenerateSigner(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forged := other.JSONWebKey()
+		forged.Kid = signer.Kid
+		if err := token.VerifyKeySet(KeySet{Keys: []JSONWebKey{forged}}); err != ErrInvalidSignature {
+			t.Errorf("%s: other key err = %v, want ErrInvalidSignature", alg, err)
+		}
+
+		// neither does a modified payload
+		parts := strings.Split(raw, ".")
+		tampered, err := Parse(parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"2"}`)) + "." + parts[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tampered.VerifyKeySet(set); err != ErrInvalidSignature {
+			t.Errorf("%s: tampered token err = %v, want ErrInvalidSignature", alg, err)
+		}
+	}
+}
+
+// TestThumbprint checks the example of RFC 7638 section 3.1.
+func TestThumbprint(t *testing.T) {
+	key := JSONWebKey{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+		// members outside the thumbprint do not change it
+		Kid: "2011-04-29",
+		Alg: "RS256",
+		Use: "sig",
+	}
+	thumbprint, err := key.Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumbprint != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("thumbprint = %s", thumbprint)
+	}
+
+	if _, err := (JSONWebKey{Kty: "oct"}).Thumbprint(); err == nil {
+		t.Error("thumbprint of an unsupported key type")
+	}
+}
+
+func TestNewSignerErrors(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSigner(small); err == nil {
+		t.Error("accepted a 1024 bit RSA key")
+	}
+	p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSigner(p224); err == nil {
+		t.Error("accepted a P-224 key")
+	}
+	if _, err := GenerateSigner("HS256"); err == nil {
+		t.Error("generated an HS256 signer")
+	}
+}
+
+func TestLoadSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "one-oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]*pem.Block{
+		"sec1.pem":  {Type: "EC PRIVATE KEY", Bytes: sec1},
+		"pkcs8.pem": {Type: "PRIVATE KEY", Bytes: pkcs8},
+	}
+	for name, block := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		signer, err := LoadSigner(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// the kid is the thumbprint, stable for the key
+		if thumbprint, _ := signer.JSONWebKey().Thumbprint(); signer.Alg != "ES256" || signer.Kid != thumbprint {
+			t.Errorf("%s: signer %s with kid %s", name, signer.Alg, signer.Kid)
+		}
+	}
+
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("no key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSigner(empty); err == nil {
+		t.Error("loaded a file without PEM data")
+	}
+}
@@ -0,0 +1,147 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ozankasikci/one-oauth/internal/jwt"
+	"golang.org/x/oauth2"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minimum time between two jwks_uri fetches triggered by unknown key ids
+const keySetRefreshInterval = time.Minute
+
+// Metadata is the subset of the OpenID Provider Metadata we rely on.
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Remote lazily discovers an issuer and caches its metadata and key set, so
+// an unreachable issuer at startup does not prevent the proxy from booting.
+type Remote struct {
+	IssuerURL  string
+	HTTPClient *http.Client
+
+	mu           sync.Mutex
+	metadata     *Metadata
+	keySet       jwt.KeySet
+	keySetSynced time.Time
+}
+
+// NewRemote returns a Remote for issuerURL using http.DefaultClient if
+// httpClient is nil.
+func NewRemote(issuerURL string, httpClient *http.Client) *Remote {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Remote{
+		IssuerURL:  issuerURL,
+		HTTPClient: httpClient,
+	}
+}
+
+// Discover fetches and caches the issuer's discovery document.
+func (t *Remote) Discover(ctx context.Context) (*Metadata, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.metadata != nil {
+		return t.metadata, nil
+	}
+
+	wellKnown := strings.TrimSuffix(t.IssuerURL, "/") + "/.well-known/openid-configuration"
+	var m Metadata
+	if err := GetJSON(ctx, t.HTTPClient, wellKnown, &m); err != nil {
+		return nil, err
+	}
+
+	if m.Issuer != t.IssuerURL {
+		return nil, fmt.Errorf("oidc: issuer mismatch, expected %q got %q", t.IssuerURL, m.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing required endpoints")
+	}
+
+	t.metadata = &m
+	return t.metadata, nil
+}
+
+// Endpoint returns the discovered OAuth2 endpoints.
+func (t *Remote) Endpoint(ctx context.Context) (oauth2.Endpoint, error) {
+	m, err := t.Discover(ctx)
+	if err != nil {
+		return oauth2.Endpoint{}, err
+	}
+
+	return oauth2.Endpoint{
+		AuthURL:  m.AuthorizationEndpoint,
+		TokenURL: m.TokenEndpoint,
+	}, nil
+}
+
+// VerifySignature checks the token against the cached key set, refreshing it
+// once when the key id is unknown to pick up issuer key rotation.
+func (t *Remote) VerifySignature(ctx context.Context, token *jwt.Token) error {
+	m, err := t.Discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.keySet.Keys) > 0 {
+		err = token.VerifyKeySet(t.keySet)
+		if err != jwt.ErrKeyNotFound {
+			return err
+		}
+		if time.Since(t.keySetSynced) < keySetRefreshInterval {
+			return err
+		}
+	}
+
+	var keySet jwt.KeySet
+	if err := GetJSON(ctx, t.HTTPClient, m.JWKSURI, &keySet); err != nil {
+		return err
+	}
+	t.keySet = keySet
+	t.keySetSynced = time.Now()
+
+	return token.VerifyKeySet(t.keySet)
+}
+
+// GetJSON fetches url with httpClient and decodes the JSON response into v.
+func GetJSON(ctx context.Context, httpClient *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s returned %s", url, resp.Status)
+	}
+
+	return json.Unmarshal(body, v)
+}
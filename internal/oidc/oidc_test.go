@@ -0,0 +1,232 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ozankasikci/one-oauth/internal/jwt"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeIssuer serves a discovery document and the key set of its signer.
+type fakeIssuer struct {
+	*httptest.Server
+	signer     *jwt.Signer
+	issuer     string
+	keySetGets int32
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+	issuer := &fakeIssuer{signer: newSigner(t)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Metadata{
+			Issuer:                issuer.issuer,
+			AuthorizationEndpoint: issuer.URL + "/authorize",
+			TokenEndpoint:         issuer.URL + "/token",
+			JWKSURI:               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&issuer.keySetGets, 1)
+		json.NewEncoder(w).Encode(jwt.KeySet{Keys: []jwt.JSONWebKey{issuer.signer.JSONWebKey()}})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	issuer.issuer = issuer.URL
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func newSigner(t *testing.T) *jwt.Signer {
+	t.Helper()
+	signer, err := jwt.GenerateSigner("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// claims returns valid ID token claims for client.
+func (t *fakeIssuer) claims() jwt.Claims {
+	now := time.Now()
+	return jwt.Claims{
+		"iss":   t.URL,
+		"sub":   "1",
+		"aud":   "client",
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"nonce": "nonce",
+	}
+}
+
+func sign(t *testing.T, signer *jwt.Signer, claims jwt.Claims) string {
+	t.Helper()
+	raw, err := signer.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestVerify(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	verifier := &Verifier{Remote: NewRemote(issuer.URL, nil), ClientID: "client"}
+
+	claims, err := verifier.Verify(context.Background(), sign(t, issuer.signer, issuer.claims()), "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.String("sub") != "1" {
+		t.Errorf("sub = %q", claims.String("sub"))
+	}
+
+	// the key set is cached
+	if _, err := verifier.Verify(context.Background(), sign(t, issuer.signer, issuer.claims()), ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&issuer.keySetGets); n != 1 {
+		t.Errorf("%d key set fetches, want 1", n)
+	}
+
+	// several audiences need the client as authorized party
+	multiple := issuer.claims()
+	multiple["aud"] = []string{"client", "other"}
+	multiple["azp"] = "client"
+	if _, err := verifier.Verify(context.Background(), sign(t, issuer.signer, multiple), "nonce"); err != nil {
+		t.Errorf("azp client: %v", err)
+	}
+
+	// alternative issuers
+	alternative := issuer.claims()
+	alternative["iss"] = "accounts.example.com"
+	verifier.Issuers = []string{"accounts.example.com"}
+	if _, err := verifier.Verify(context.Background(), sign(t, issuer.signer, alternative), "nonce"); err != nil {
+		t.Errorf("alternative issuer: %v", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		modify func(jwt.Claims)
+		want   string
+	}{
+		{"issuer", func(c jwt.Claims) { c["iss"] = "https://evil.example.com" }, "unexpected issuer"},
+		{"no issuer", func(c jwt.Claims) { delete(c, "iss") }, "unexpected issuer"},
+		{"audience", func(c jwt.Claims) { c["aud"] = "other" }, "audience"},
+		{"no audience", func(c jwt.Claims) { delete(c, "aud") }, "audience"},
+		{"no azp", func(c jwt.Claims) { c["aud"] = []string{"client", "other"} }, "authorized party"},
+		{"azp", func(c jwt.Claims) { c["aud"] = []string{"client", "other"}; c["azp"] = "other" }, "authorized party"},
+		{"expired", func(c jwt.Claims) { c["exp"] = now.Add(-2 * leeway).Unix() }, "expired"},
+		{"no expiry", func(c jwt.Claims) { delete(c, "exp") }, ""},
+		{"issued in the future", func(c jwt.Claims) { c["iat"] = now.Add(2 * leeway).Unix() }, "future"},
+		{"nonce", func(c jwt.Claims) { c["nonce"] = "other" }, "nonce"},
+		{"no nonce", func(c jwt.Claims) { delete(c, "nonce") }, "nonce"},
+		{"no subject", func(c jwt.Claims) { delete(c, "sub") }, "subject"},
+	}
+
+	for _, test := range tests {
+		verifier := &Verifier{Remote: NewRemote(issuer.URL, nil), ClientID: "client"}
+		claims := issuer.claims()
+		test.modify(claims)
+		if _, err := verifier.Verify(context.Background(), sign(t, issuer.signer, claims), "nonce"); err == nil {
+			t.Errorf("%s: verified", test.name)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: err = %v, want it to mention %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestVerifyRejectsSignature(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	verifier := &Verifier{Remote: NewRemote(issuer.URL, nil), ClientID: "client"}
+
+	// a key unknown to the issuer
+	if _, err := verifier.Verify(context.Background(), sign(t, newSigner(t), issuer.claims()), "nonce"); err == nil {
+		t.Error("verified a token signed with another key")
+	}
+
+	// the same key id with another key
+	forged := newSigner(t)
+	forged.Kid = issuer.signer.Kid
+	if _, err := verifier.Verify(context.Background(), sign(t, forged, issuer.claims()), "nonce"); err == nil {
+		t.Error("verified a token signed with a forged key")
+	}
+
+	// a tampered payload
+	raw := sign(t, issuer.signer, issuer.claims())
+	parts := strings.Split(raw, ".")
+	claims := issuer.claims()
+	claims["sub"] = "2"
+	parts[1] = strings.Split(sign(t, issuer.signer, claims), ".")[1]
+	if _, err := verifier.Verify(context.Background(), strings.Join(parts, "."), "nonce"); err == nil {
+		t.Error("verified a tampered token")
+	}
+
+	if _, err := verifier.Verify(context.Background(), "not a token", "nonce"); err == nil {
+		t.Error("verified garbage")
+	}
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	verifier := &Verifier{Remote: NewRemote(issuer.URL, nil), ClientID: "client"}
+	if _, err := verifier.Verify(context.Background(), sign(t, issuer.signer, issuer.claims()), "nonce"); err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown key ids refetch the key set at most once a refresh interval
+	issuer.signer = newSigner(t)
+	if _, err := verifier.Verify(context.Background(), sign(t, issuer.signer, issuer.claims()), "nonce"); err != jwt.ErrKeyNotFound {
+		t.Errorf("err = %v, want ErrKeyNotFound before the refresh interval", err)
+	}
+	verifier.Remote.keySetSynced = time.Now().Add(-keySetRefreshInterval)
+	if _, err := verifier.Verify(context.Background(), sign(t, issuer.signer, issuer.claims()), "nonce"); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+	if n := atomic.LoadInt32(&issuer.keySetGets); n != 2 {
+		t.Errorf("%d key set fetches, want 2", n)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	issuer := newFakeIssuer(t)
+
+	if _, err := NewRemote(issuer.URL+"/", nil).Discover(context.Background()); err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Errorf("err = %v, want an issuer mismatch", err)
+	}
+
+	issuer.issuer = "https://evil.example.com"
+	if _, err := NewRemote(issuer.URL, nil).Endpoint(context.Background()); err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Errorf("err = %v, want an issuer mismatch", err)
+	}
+
+	issuer.issuer = issuer.URL
+	endpoint, err := NewRemote(issuer.URL, nil).Endpoint(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.AuthURL != issuer.URL+"/authorize" || endpoint.TokenURL != issuer.URL+"/token" {
+		t.Errorf("endpoint = %+v", endpoint)
+	}
+
+	if _, err := NewRemote(issuer.URL+"/missing", nil).Discover(context.Background()); err == nil {
+		t.Error("discovered a missing document")
+	}
+}
+
+func TestVerifyTokenMissingIDToken(t *testing.T) {
+	verifier := &Verifier{ClientID: "client"}
+	if _, err := verifier.VerifyToken(context.Background(), &oauth2.Token{AccessToken: "a"}, "nonce"); err != ErrMissingIDToken {
+		t.Errorf("err = %v, want ErrMissingIDToken", err)
+	}
+}
@@ -0,0 +1,87 @@
+package oidc
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/ozankasikci/one-oauth/internal/jwt"
+	"golang.org/x/oauth2"
+	"time"
+)
+
+// clock skew tolerated when validating exp/iat/nbf
+const leeway = time.Minute
+
+// Verifier validates ID tokens issued to ClientID by Remote's issuer.
+type Verifier struct {
+	Remote   *Remote
+	ClientID string
+	// Issuers lists additional accepted iss values, for issuers like Google
+	// that also use a scheme-less form.
+	Issuers []string
+}
+
+// ErrMissingIDToken is returned when a token response carries no ID token.
+var ErrMissingIDToken = errors.New("oidc: token response has no id_token")
+
+// VerifyToken verifies the id_token of a token response, see Verify.
+func (t *Verifier) VerifyToken(ctx context.Context, token *oauth2.Token, nonce string) (jwt.Claims, error) {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, ErrMissingIDToken
+	}
+	return t.Verify(ctx, rawIDToken, nonce)
+}
+
+// Verify checks signature, iss, aud, azp, exp, iat and, if nonce is not
+// empty, the nonce claim, and returns the token's claims.
+func (t *Verifier) Verify(ctx context.Context, rawIDToken, nonce string) (jwt.Claims, error) {
+	idToken, err := jwt.Parse(rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Remote.VerifySignature(ctx, idToken); err != nil {
+		return nil, err
+	}
+
+	claims := idToken.Claims
+	issuer := claims.String("iss")
+	if issuer != t.Remote.IssuerURL && !contains(t.Issuers, issuer) {
+		return nil, fmt.Errorf("oidc: unexpected issuer %q", issuer)
+	}
+
+	audience := claims.Audience()
+	if !contains(audience, t.ClientID) {
+		return nil, errors.New("oidc: ID token audience does not include client id")
+	}
+	if len(audience) > 1 && claims.String("azp") != t.ClientID {
+		return nil, errors.New("oidc: ID token authorized party is not client id")
+	}
+
+	now := time.Now()
+	if err := claims.ValidateTime(now, leeway); err != nil {
+		return nil, err
+	}
+	if iat, ok := claims.Time("iat"); ok && iat.After(now.Add(leeway)) {
+		return nil, errors.New("oidc: ID token issued in the future")
+	}
+
+	if nonce != "" && subtle.ConstantTimeCompare([]byte(claims.String("nonce")), []byte(nonce)) != 1 {
+		return nil, errors.New("oidc: ID token nonce mismatch")
+	}
+	if claims.String("sub") == "" {
+		return nil, errors.New("oidc: ID token has no subject")
+	}
+
+	return claims, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,766 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Input is what expressions are evaluated against.
+type Input struct {
+	Request Request
+	// User is null in expressions when nil.
+	User *User
+	// Session is null in expressions when nil, e.g. for client
+	// certificates.
+	Session *Session
+}
+
+// Session is the metadata of the user's session. At sign in, it describes
+// the session about to be issued.
+type Session struct {
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+// variables are the declared variables and their fields.
+var variables = map[string]map[string]bool{
+	"user": {
+		"subject": true, "email": true, "email_verified": true, "name": true, "provider": true,
+		"hosted_domain": true, "groups": true, "claims": true,
+	},
+	"request": {"host": true, "path": true, "method": true},
+	"session": {"created_at": true, "last_seen_at": true, "expires_at": true, "age": true},
+}
+
+// variables returns the values of the declared variables; times are Unix
+// seconds, 0 when unset, and session.age is in seconds.
+func (t *Input) variables() map[string]interface{} {
+	request := normalize(t.Request)
+	vars := map[string]interface{}{
+		"request": map[string]interface{}{
+			"host":   request.Host,
+			"path":   request.Path,
+			"method": request.Method,
+		},
+		"user":    nil,
+		"session": nil,
+	}
+
+	if user := t.User; user != nil {
+		groups := make([]interface{}, len(user.Groups))
+		for i, group := range user.Groups {
+			groups[i] = group
+		}
+		claims := map[string]interface{}{}
+		for k, v := range user.Claims {
+			claims[k] = v
+		}
+		vars["user"] = map[string]interface{}{
+			"subject":        user.Subject,
+			"email":          user.Email,
+			"email_verified": user.EmailVerified,
+			"name":           user.Name,
+			"provider":       user.Provider,
+			"hosted_domain":  user.HostedDomain,
+			"groups":         groups,
+			"claims":         claims,
+		}
+	}
+
+	if session := t.Session; session != nil {
+		vars["session"] = map[string]interface{}{
+			"created_at":   unix(session.CreatedAt),
+			"last_seen_at": unix(session.LastSeenAt),
+			"expires_at":   unix(session.ExpiresAt),
+			"age":          int64(time.Since(session.CreatedAt) / time.Second),
+		}
+	}
+	return vars
+}
+
+func unix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// scope holds variables, with macro variables chained to the outer scope.
+type scope struct {
+	vars   map[string]interface{}
+	parent *scope
+}
+
+func (t *scope) lookup(name string) interface{} {
+	for s := t; s != nil; s = s.parent {
+		if value, ok := s.vars[name]; ok {
+			return value
+		}
+	}
+	return nil
+}
+
+// node is a parsed expression. Values are nil, bool, int64, float64, string,
+// []interface{} and map[string]interface{}.
+type node interface {
+	eval(env *scope) (interface{}, error)
+	// span returns the source offsets of the node
+	span() (int, int)
+}
+
+type literalNode struct {
+	value      interface{}
+	start, end int
+}
+
+func (t *literalNode) eval(env *scope) (interface{}, error) { return t.value, nil }
+func (t *literalNode) span() (int, int)                     { return t.start, t.end }
+
+type identNode struct {
+	name       string
+	start, end int
+}
+
+func (t *identNode) eval(env *scope) (interface{}, error) { return env.lookup(t.name), nil }
+func (t *identNode) span() (int, int)                     { return t.start, t.end }
+
+type parenNode struct {
+	operand    node
+	start, end int
+}
+
+func (t *parenNode) eval(env *scope) (interface{}, error) { return t.operand.eval(env) }
+func (t *parenNode) span() (int, int)                     { return t.start, t.end }
+
+type listNode struct {
+	elements   []node
+	start, end int
+}
+
+func (t *listNode) eval(env *scope) (interface{}, error) {
+	list := make([]interface{}, len(t.elements))
+	for i, element := range t.elements {
+		value, err := element.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = value
+	}
+	return list, nil
+}
+
+func (t *listNode) span() (int, int) { return t.start, t.end }
+
+type selectNode struct {
+	operand node
+	field   string
+	end     int
+}
+
+func (t *selectNode) eval(env *scope) (interface{}, error) {
+	value, err := t.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot select %q from %s", t.field, typeName(value))
+	}
+	field, ok := m[t.field]
+	if !ok {
+		return nil, fmt.Errorf("no such key %q", t.field)
+	}
+	return normalizeValue(field), nil
+}
+
+func (t *selectNode) span() (int, int) {
+	start, _ := t.operand.span()
+	return start, t.end
+}
+
+type hasNode struct {
+	selection  *selectNode
+	start, end int
+}
+
+func (t *hasNode) eval(env *scope) (interface{}, error) {
+	value, err := t.selection.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+	_, ok = m[t.selection.field]
+	return ok, nil
+}
+
+func (t *hasNode) span() (int, int) { return t.start, t.end }
+
+type indexNode struct {
+	operand, index node
+	end            int
+}
+
+func (t *indexNode) eval(env *scope) (interface{}, error) {
+	value, err := t.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := t.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := value.(type) {
+	case []interface{}:
+		i, ok := index.(int64)
+		if !ok {
+			return nil, fmt.Errorf("list index is %s, not int", typeName(index))
+		}
+		if i < 0 || i >= int64(len(v)) {
+			return nil, fmt.Errorf("index %d out of range", i)
+		}
+		return normalizeValue(v[i]), nil
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key is %s, not string", typeName(index))
+		}
+		field, ok := v[key]
+		if !ok {
+			return nil, fmt.Errorf("no such key %q", key)
+		}
+		return normalizeValue(field), nil
+	}
+	return nil, fmt.Errorf("cannot index %s", typeName(value))
+}
+
+func (t *indexNode) span() (int, int) {
+	start, _ := t.operand.span()
+	return start, t.end
+}
+
+type unaryNode struct {
+	op      string
+	start   int
+	operand node
+}
+
+func (t *unaryNode) eval(env *scope) (interface{}, error) {
+	value, err := t.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case bool:
+		if t.op == "!" {
+			return !v, nil
+		}
+	case int64:
+		if t.op == "-" {
+			if v == math.MinInt64 {
+				return nil, errOverflow
+			}
+			return -v, nil
+		}
+	case float64:
+		if t.op == "-" {
+			return -v, nil
+		}
+	}
+	return nil, fmt.Errorf("no such operator %s%s", t.op, typeName(value))
+}
+
+func (t *unaryNode) span() (int, int) {
+	_, end := t.operand.span()
+	return t.start, end
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (t *andNode) eval(env *scope) (interface{}, error) {
+	return logical(env, t.left, t.right, false)
+}
+
+func (t *andNode) span() (int, int) { return spanOf(t.left, t.right) }
+
+// flatten returns the operands of a chain of &&.
+func (t *andNode) flatten() []node {
+	var nodes []node
+	for _, n := range []node{t.left, t.right} {
+		if and, ok := n.(*andNode); ok {
+			nodes = append(nodes, and.flatten()...)
+		} else {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (t *orNode) eval(env *scope) (interface{}, error) {
+	return logical(env, t.left, t.right, true)
+}
+
+func (t *orNode) span() (int, int) { return spanOf(t.left, t.right) }
+
+// logical evaluates && (decisive false) and || (decisive true): a decisive
+// operand wins over an error on the other side.
+func logical(env *scope, left, right node, decisive bool) (interface{}, error) {
+	l, lerr := boolValue(left.eval(env))
+	if lerr == nil && l == decisive {
+		return decisive, nil
+	}
+	r, rerr := boolValue(right.eval(env))
+	if rerr == nil && r == decisive {
+		return decisive, nil
+	}
+	if lerr != nil {
+		return nil, lerr
+	}
+	if rerr != nil {
+		return nil, rerr
+	}
+	return !decisive, nil
+}
+
+func boolValue(value interface{}, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected bool, found %s", typeName(value))
+	}
+	return b, nil
+}
+
+type condNode struct {
+	cond, then, otherwise node
+}
+
+func (t *condNode) eval(env *scope) (interface{}, error) {
+	cond, err := boolValue(t.cond.eval(env))
+	if err != nil {
+		return nil, err
+	}
+	if cond {
+		return t.then.eval(env)
+	}
+	return t.otherwise.eval(env)
+}
+
+func (t *condNode) span() (int, int) { return spanOf(t.cond, t.otherwise) }
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (t *binaryNode) span() (int, int) { return spanOf(t.left, t.right) }
+
+func (t *binaryNode) eval(env *scope) (interface{}, error) {
+	left, err := t.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := t.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch t.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		switch container := right.(type) {
+		case []interface{}:
+			for _, element := range container {
+				if equal(left, normalizeValue(element)) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			key, ok := left.(string)
+			if !ok {
+				return false, nil
+			}
+			_, ok = container[key]
+			return ok, nil
+		}
+	case "<", "<=", ">", ">=":
+		c, ok := compare(left, right)
+		if !ok {
+			break
+		}
+		switch t.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "+":
+		switch l := left.(type) {
+		case string:
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		case []interface{}:
+			if r, ok := right.([]interface{}); ok {
+				return append(append([]interface{}{}, l...), r...), nil
+			}
+		}
+		return arithmetic(t.op, left, right)
+	case "-", "*", "/", "%":
+		return arithmetic(t.op, left, right)
+	}
+	return nil, fmt.Errorf("no such operator %s %s %s", typeName(left), t.op, typeName(right))
+}
+
+// errOverflow fails integer arithmetic that does not fit in 64 bits, rather
+// than letting it wrap around and flip a decision.
+var errOverflow = errors.New("integer overflow")
+
+func arithmetic(op string, left, right interface{}) (interface{}, error) {
+	if l, ok := left.(int64); ok {
+		if r, ok := right.(int64); ok {
+			switch op {
+			case "+":
+				if r > 0 && l > math.MaxInt64-r || r < 0 && l < math.MinInt64-r {
+					return nil, errOverflow
+				}
+				return l + r, nil
+			case "-":
+				if r < 0 && l > math.MaxInt64+r || r > 0 && l < math.MinInt64+r {
+					return nil, errOverflow
+				}
+				return l - r, nil
+			case "*":
+				product := l * r
+				if l != 0 && (product/l != r || l == -1 && r == math.MinInt64) {
+					return nil, errOverflow
+				}
+				return product, nil
+			case "/", "%":
+				if r == 0 {
+					return nil, errors.New("division by zero")
+				}
+				if op == "/" {
+					if l == math.MinInt64 && r == -1 {
+						return nil, errOverflow
+					}
+					return l / r, nil
+				}
+				return l % r, nil
+			}
+		}
+	}
+	l, lok := number(left)
+	r, rok := number(right)
+	if lok && rok {
+		switch op {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		case "/":
+			return l / r, nil
+		}
+	}
+	return nil, fmt.Errorf("no such operator %s %s %s", typeName(left), op, typeName(right))
+}
+
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func equal(left, right interface{}) bool {
+	if l, ok := number(left); ok {
+		r, ok := number(right)
+		return ok && l == r
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+// compare orders two numbers or two strings.
+func compare(left, right interface{}) (int, bool) {
+	if l, ok := number(left); ok {
+		r, ok := number(right)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case l < r:
+			return -1, true
+		case l > r:
+			return 1, true
+		}
+		return 0, true
+	}
+	l, lok := left.(string)
+	r, rok := right.(string)
+	if !lok || !rok {
+		return 0, false
+	}
+	return strings.Compare(l, r), true
+}
+
+type callNode struct {
+	name       string
+	args       []node
+	start, end int
+}
+
+func (t *callNode) span() (int, int) { return t.start, t.end }
+
+func (t *callNode) eval(env *scope) (interface{}, error) {
+	arg, err := t.args[0].eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch t.name {
+	case "size":
+		return size(arg)
+	case "string":
+		switch v := arg.(type) {
+		case string:
+			return v, nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case float64:
+			return strconv.FormatFloat(v, 'g', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+	case "int":
+		switch v := arg.(type) {
+		case int64:
+			return v, nil
+		case float64:
+			if math.IsNaN(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+				return nil, errors.New("int() out of range")
+			}
+			return int64(v), nil
+		case string:
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("int(%q): invalid number", v)
+			}
+			return i, nil
+		}
+	case "double":
+		switch v := arg.(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("double(%q): invalid number", v)
+			}
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload %s(%s)", t.name, typeName(arg))
+}
+
+func size(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return int64(len([]rune(v))), nil
+	case []interface{}:
+		return int64(len(v)), nil
+	case map[string]interface{}:
+		return int64(len(v)), nil
+	}
+	return nil, fmt.Errorf("no such overload size(%s)", typeName(value))
+}
+
+type methodNode struct {
+	name     string
+	receiver node
+	args     []node
+	end      int
+	// re is the precompiled pattern of matches with a literal argument
+	re *regexp.Regexp
+}
+
+func (t *methodNode) span() (int, int) {
+	start, _ := t.receiver.span()
+	return start, t.end
+}
+
+func (t *methodNode) eval(env *scope) (interface{}, error) {
+	receiver, err := t.receiver.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if t.name == "size" {
+		return size(receiver)
+	}
+
+	s, ok := receiver.(string)
+	if !ok {
+		return nil, fmt.Errorf("no such method %s.%s", typeName(receiver), t.name)
+	}
+	switch t.name {
+	case "lowerAscii":
+		return strings.ToLower(s), nil
+	case "upperAscii":
+		return strings.ToUpper(s), nil
+	}
+
+	arg, err := t.args[0].eval(env)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := arg.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s takes a string, found %s", t.name, typeName(arg))
+	}
+	switch t.name {
+	case "startsWith":
+		return strings.HasPrefix(s, a), nil
+	case "endsWith":
+		return strings.HasSuffix(s, a), nil
+	case "contains":
+		return strings.Contains(s, a), nil
+	}
+
+	re := t.re
+	if re == nil {
+		if re, err = regexp.Compile(a); err != nil {
+			return nil, err
+		}
+	}
+	return re.MatchString(s), nil
+}
+
+type macroNode struct {
+	name      string
+	receiver  node
+	variable  string
+	predicate node
+	end       int
+}
+
+func (t *macroNode) span() (int, int) {
+	start, _ := t.receiver.span()
+	return start, t.end
+}
+
+// eval applies the predicate to each element; exists is true once any is
+// true, all false once any is false.
+func (t *macroNode) eval(env *scope) (interface{}, error) {
+	receiver, err := t.receiver.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := receiver.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s takes a list, found %s", t.name, typeName(receiver))
+	}
+
+	decisive := t.name == "exists"
+	var firstErr error
+	for _, element := range list {
+		inner := &scope{vars: map[string]interface{}{t.variable: normalizeValue(element)}, parent: env}
+		b, err := boolValue(t.predicate.eval(inner))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if b == decisive {
+			return decisive, nil
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return !decisive, nil
+}
+
+func spanOf(first, last node) (int, int) {
+	start, _ := first.span()
+	_, end := last.span()
+	return start, end
+}
+
+// normalizeValue converts claim values decoded from JSON to expression
+// values.
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case []string:
+		list := make([]interface{}, len(v))
+		for i, s := range v {
+			list[i] = s
+		}
+		return list
+	}
+	return value
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", value)
+}
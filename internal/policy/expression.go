@@ -0,0 +1,609 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expression is a compiled boolean expression in a subset of CEL, e.g.
+//
+//	user.email.endsWith("@corp.com") && "admin" in user.groups && request.method != "DELETE"
+//
+// It supports literals (strings, numbers, booleans, null and lists), the
+// operators ! - * / % + - < <= > >= == != in && || and ?:, field and index
+// selection, the functions size, has, int, double and string, the string
+// methods startsWith, endsWith, contains, matches, lowerAscii, upperAscii
+// and size, and the list macros exists and all, e.g.
+// user.groups.exists(g, g.startsWith("eng-")).
+//
+// The variables are user, request and session, see Input. Like CEL, && and
+// || ignore an error on one side when the other decides the result.
+type Expression struct {
+	source string
+	root   node
+}
+
+// CompileError reports a syntax or name error at a byte offset of the
+// source.
+type CompileError struct {
+	Offset  int
+	Message string
+}
+
+func (t *CompileError) Error() string {
+	return fmt.Sprintf("policy: column %d: %s", t.Offset+1, t.Message)
+}
+
+// Compile parses and checks source.
+func Compile(source string) (*Expression, error) {
+	tokens, err := scan(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{source: source, tokens: tokens, scope: map[string]int{}}
+	root, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.errorf(tok, "unexpected %s", tok)
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// String returns the source of the expression.
+func (t *Expression) String() string {
+	return t.source
+}
+
+// Evaluate reports whether the expression holds for input. When it does not,
+// reason names the failing part: the first false operand of a top level &&
+// chain, or else the whole expression. Evaluation errors, such as a missing
+// claim, are returned as err and should deny.
+func (t *Expression) Evaluate(input *Input) (ok bool, reason string, err error) {
+	env := &scope{vars: input.variables()}
+
+	conjuncts := []node{t.root}
+	if and, isAnd := t.root.(*andNode); isAnd {
+		conjuncts = and.flatten()
+	}
+	for _, n := range conjuncts {
+		value, err := n.eval(env)
+		if err != nil {
+			return false, "", fmt.Errorf("policy: %s: %v", t.text(n), err)
+		}
+		b, isBool := value.(bool)
+		if !isBool {
+			return false, "", fmt.Errorf("policy: %s: result is %s, not bool", t.text(n), typeName(value))
+		}
+		if !b {
+			return false, t.text(n) + " is false", nil
+		}
+	}
+	return true, "", nil
+}
+
+func (t *Expression) text(n node) string {
+	start, end := n.span()
+	return strings.TrimSpace(t.source[start:end])
+}
+
+// tokens
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenInt
+	tokenDouble
+	tokenPunct
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+	start int
+	end   int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// punctuation, longest first
+var punctuation = []string{"&&", "||", "==", "!=", "<=", ">=", "(", ")", "[", "]", ".", ",", "?", ":", "!", "-", "+", "*", "/", "%", "<", ">"}
+
+func scan(source string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(source) {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '_' || c < 0x80 && unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(source) && (source[i] == '_' || source[i] < 0x80 && (unicode.IsLetter(rune(source[i])) || unicode.IsDigit(rune(source[i])))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: source[start:i], start: start, end: i})
+
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(source) && source[i] >= '0' && source[i] <= '9' {
+				i++
+			}
+			double := false
+			if i+1 < len(source) && source[i] == '.' && source[i+1] >= '0' && source[i+1] <= '9' {
+				double = true
+				for i++; i < len(source) && source[i] >= '0' && source[i] <= '9'; i++ {
+				}
+			}
+			text := source[start:i]
+			if double {
+				value, err := strconv.ParseFloat(text, 64)
+				if err != nil {
+					return nil, &CompileError{Offset: start, Message: fmt.Sprintf("invalid number %q", text)}
+				}
+				tokens = append(tokens, token{kind: tokenDouble, text: text, value: value, start: start, end: i})
+			} else {
+				value, err := strconv.ParseInt(text, 10, 64)
+				if err != nil {
+					return nil, &CompileError{Offset: start, Message: fmt.Sprintf("invalid number %q", text)}
+				}
+				tokens = append(tokens, token{kind: tokenInt, text: text, value: value, start: start, end: i})
+			}
+
+		case c == '"' || c == '\'':
+			start := i
+			value, end, err := scanString(source, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, token{kind: tokenString, text: source[start:i], value: value, start: start, end: i})
+
+		default:
+			matched := false
+			for _, p := range punctuation {
+				if strings.HasPrefix(source[i:], p) {
+					tokens = append(tokens, token{kind: tokenPunct, text: p, start: i, end: i + len(p)})
+					i += len(p)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, &CompileError{Offset: i, Message: fmt.Sprintf("unexpected character %q", source[i])}
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, start: len(source), end: len(source)}), nil
+}
+
+// scanString reads the quoted string starting at source[start], returning
+// its value and the offset after the closing quote.
+func scanString(source string, start int) (string, int, error) {
+	quote := source[start]
+	var b strings.Builder
+	for i := start + 1; i < len(source); i++ {
+		c := source[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\n':
+			return "", 0, &CompileError{Offset: i, Message: "newline in string"}
+		case c == '\\':
+			i++
+			if i == len(source) {
+				break
+			}
+			switch source[i] {
+			case '\\', '"', '\'':
+				b.WriteByte(source[i])
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				return "", 0, &CompileError{Offset: i - 1, Message: fmt.Sprintf("invalid escape \\%c", source[i])}
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, &CompileError{Offset: start, Message: "unterminated string"}
+}
+
+// parser
+
+type parser struct {
+	source string
+	tokens []token
+	pos    int
+	// scope counts the macro variables in scope by name
+	scope map[string]int
+}
+
+func (t *parser) peek() token {
+	return t.tokens[t.pos]
+}
+
+func (t *parser) next() token {
+	tok := t.tokens[t.pos]
+	if tok.kind != tokenEOF {
+		t.pos++
+	}
+	return tok
+}
+
+func (t *parser) is(text string) bool {
+	tok := t.peek()
+	return (tok.kind == tokenPunct || tok.kind == tokenIdent) && tok.text == text
+}
+
+func (t *parser) expect(text string) (token, error) {
+	if !t.is(text) {
+		tok := t.peek()
+		return tok, t.errorf(tok, "expected %q, found %s", text, tok)
+	}
+	return t.next(), nil
+}
+
+func (t *parser) errorf(tok token, format string, args ...interface{}) error {
+	return &CompileError{Offset: tok.start, Message: fmt.Sprintf(format, args...)}
+}
+
+func (t *parser) parseExpression() (node, error) {
+	cond, err := t.parseOr()
+	if err != nil || !t.is("?") {
+		return cond, err
+	}
+	t.next()
+	then, err := t.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := t.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return &condNode{cond: cond, then: then, otherwise: otherwise}, nil
+}
+
+func (t *parser) parseOr() (node, error) {
+	left, err := t.parseAnd()
+	for err == nil && t.is("||") {
+		t.next()
+		var right node
+		if right, err = t.parseAnd(); err == nil {
+			left = &orNode{left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (t *parser) parseAnd() (node, error) {
+	left, err := t.parseRelation()
+	for err == nil && t.is("&&") {
+		t.next()
+		var right node
+		if right, err = t.parseRelation(); err == nil {
+			left = &andNode{left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (t *parser) parseRelation() (node, error) {
+	left, err := t.parseAdditive()
+	for err == nil {
+		op := ""
+		for _, candidate := range []string{"<", "<=", ">", ">=", "==", "!=", "in"} {
+			if t.is(candidate) {
+				op = candidate
+			}
+		}
+		if op == "" {
+			break
+		}
+		t.next()
+		var right node
+		if right, err = t.parseAdditive(); err == nil {
+			left = &binaryNode{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (t *parser) parseAdditive() (node, error) {
+	return t.parseBinary(t.parseMultiplicative, "+", "-")
+}
+
+func (t *parser) parseMultiplicative() (node, error) {
+	return t.parseBinary(t.parseUnary, "*", "/", "%")
+}
+
+// parseBinary parses left-associative operations of ops over operands.
+func (t *parser) parseBinary(operand func() (node, error), ops ...string) (node, error) {
+	left, err := operand()
+	for err == nil {
+		op := ""
+		for _, candidate := range ops {
+			if t.is(candidate) {
+				op = candidate
+			}
+		}
+		if op == "" {
+			break
+		}
+		t.next()
+		var right node
+		if right, err = operand(); err == nil {
+			left = &binaryNode{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (t *parser) parseUnary() (node, error) {
+	if t.is("!") || t.is("-") {
+		op := t.next()
+		operand, err := t.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op.text, start: op.start, operand: operand}, nil
+	}
+	return t.parseMember()
+}
+
+func (t *parser) parseMember() (node, error) {
+	n, err := t.parsePrimary()
+	for err == nil {
+		switch {
+		case t.is("."):
+			t.next()
+			name := t.next()
+			if name.kind != tokenIdent {
+				return nil, t.errorf(name, "expected a field or method name, found %s", name)
+			}
+			if t.is("(") {
+				n, err = t.parseMethod(n, name)
+			} else {
+				n, err = newSelect(n, name)
+			}
+		case t.is("["):
+			t.next()
+			var index node
+			if index, err = t.parseExpression(); err != nil {
+				return nil, err
+			}
+			var end token
+			if end, err = t.expect("]"); err == nil {
+				n = &indexNode{operand: n, index: index, end: end.end}
+			}
+		default:
+			return n, nil
+		}
+	}
+	return nil, err
+}
+
+func (t *parser) parsePrimary() (node, error) {
+	tok := t.next()
+	switch tok.kind {
+	case tokenString, tokenInt, tokenDouble:
+		return &literalNode{value: tok.value, start: tok.start, end: tok.end}, nil
+	case tokenIdent:
+		switch tok.text {
+		case "true", "false":
+			return &literalNode{value: tok.text == "true", start: tok.start, end: tok.end}, nil
+		case "null":
+			return &literalNode{start: tok.start, end: tok.end}, nil
+		}
+		if t.is("(") {
+			return t.parseFunction(tok)
+		}
+		if _, ok := variables[tok.text]; !ok && t.scope[tok.text] == 0 {
+			return nil, t.errorf(tok, "undeclared reference to %q", tok.text)
+		}
+		return &identNode{name: tok.text, start: tok.start, end: tok.end}, nil
+	case tokenPunct:
+		switch tok.text {
+		case "(":
+			n, err := t.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			end, err := t.expect(")")
+			if err != nil {
+				return nil, err
+			}
+			return &parenNode{operand: n, start: tok.start, end: end.end}, nil
+		case "[":
+			list := &listNode{start: tok.start}
+			for !t.is("]") {
+				element, err := t.parseExpression()
+				if err != nil {
+					return nil, err
+				}
+				list.elements = append(list.elements, element)
+				if !t.is(",") {
+					break
+				}
+				t.next()
+			}
+			end, err := t.expect("]")
+			if err != nil {
+				return nil, err
+			}
+			list.end = end.end
+			return list, nil
+		}
+	}
+	return nil, t.errorf(tok, "unexpected %s", tok)
+}
+
+// arguments parses a parenthesized argument list.
+func (t *parser) arguments() ([]node, token, error) {
+	if _, err := t.expect("("); err != nil {
+		return nil, token{}, err
+	}
+	var args []node
+	for !t.is(")") {
+		arg, err := t.parseExpression()
+		if err != nil {
+			return nil, token{}, err
+		}
+		args = append(args, arg)
+		if !t.is(",") {
+			break
+		}
+		t.next()
+	}
+	end, err := t.expect(")")
+	return args, end, err
+}
+
+// functions maps global function names to their number of arguments.
+var functions = map[string]int{"size": 1, "int": 1, "double": 1, "string": 1}
+
+func (t *parser) parseFunction(name token) (node, error) {
+	if name.text == "has" {
+		return t.parseHas(name)
+	}
+	arity, ok := functions[name.text]
+	if !ok {
+		return nil, t.errorf(name, "undeclared function %q", name.text)
+	}
+	args, end, err := t.arguments()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != arity {
+		return nil, t.errorf(name, "%s takes %d argument(s), found %d", name.text, arity, len(args))
+	}
+	return &callNode{name: name.text, args: args, start: name.start, end: end.end}, nil
+}
+
+// parseHas parses has(x.field), which tests for a field instead of failing
+// when it is missing.
+func (t *parser) parseHas(name token) (node, error) {
+	args, end, err := t.arguments()
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := singleSelect(args)
+	if !ok {
+		return nil, t.errorf(name, "has takes a single field selection like has(user.claims.role)")
+	}
+	return &hasNode{selection: sel, start: name.start, end: end.end}, nil
+}
+
+func singleSelect(args []node) (*selectNode, bool) {
+	if len(args) != 1 {
+		return nil, false
+	}
+	sel, ok := args[0].(*selectNode)
+	return sel, ok
+}
+
+// methods maps receiver method names to their number of arguments.
+var methods = map[string]int{
+	"startsWith": 1,
+	"endsWith":   1,
+	"contains":   1,
+	"matches":    1,
+	"lowerAscii": 0,
+	"upperAscii": 0,
+	"size":       0,
+}
+
+func (t *parser) parseMethod(receiver node, name token) (node, error) {
+	if name.text == "exists" || name.text == "all" {
+		return t.parseMacro(receiver, name)
+	}
+	arity, ok := methods[name.text]
+	if !ok {
+		return nil, t.errorf(name, "undeclared method %q", name.text)
+	}
+	args, end, err := t.arguments()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != arity {
+		return nil, t.errorf(name, "%s takes %d argument(s), found %d", name.text, arity, len(args))
+	}
+
+	call := &methodNode{name: name.text, receiver: receiver, args: args, end: end.end}
+	if name.text == "matches" {
+		if pattern, ok := args[0].(*literalNode); ok {
+			s, isString := pattern.value.(string)
+			if !isString {
+				return nil, t.errorf(name, "matches takes a string pattern")
+			}
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, &CompileError{Offset: pattern.start, Message: err.Error()}
+			}
+			call.re = re
+		}
+	}
+	return call, nil
+}
+
+// parseMacro parses list.exists(x, predicate) and list.all(x, predicate).
+func (t *parser) parseMacro(receiver node, name token) (node, error) {
+	if _, err := t.expect("("); err != nil {
+		return nil, err
+	}
+	variable := t.next()
+	if variable.kind != tokenIdent {
+		return nil, t.errorf(variable, "%s expects a variable name, found %s", name.text, variable)
+	}
+	if _, ok := variables[variable.text]; ok {
+		return nil, t.errorf(variable, "%q shadows a variable", variable.text)
+	}
+	if _, err := t.expect(","); err != nil {
+		return nil, err
+	}
+
+	t.scope[variable.text]++
+	predicate, err := t.parseExpression()
+	t.scope[variable.text]--
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := t.expect(")")
+	if err != nil {
+		return nil, err
+	}
+	return &macroNode{name: name.text, receiver: receiver, variable: variable.text, predicate: predicate, end: end.end}, nil
+}
+
+// newSelect checks selections of the declared variables' fields.
+func newSelect(operand node, name token) (node, error) {
+	if ident, ok := operand.(*identNode); ok {
+		if fields, ok := variables[ident.name]; ok && !fields[name.text] {
+			return nil, &CompileError{Offset: name.start, Message: fmt.Sprintf("%s has no field %q", ident.name, name.text)}
+		}
+	}
+	return &selectNode{operand: operand, field: name.text, end: name.end}, nil
+}
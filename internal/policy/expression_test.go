@@ -0,0 +1,320 @@
+package policy
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testInput() *Input {
+	return &Input{
+		Request: Request{Host: "App.example.com:443", Path: "/admin/../reports/q1", Method: "get"},
+		User: &User{
+			Subject:       "1",
+			Email:         "alice@example.com",
+			EmailVerified: true,
+			Provider:      "google",
+			HostedDomain:  "example.com",
+			Groups:        []string{"eng-backend", "admins"},
+			Claims: map[string]interface{}{
+				"level": json.Number("3"),
+				"ratio": json.Number("0.5"),
+				"org":   map[string]interface{}{"role": "owner"},
+				"tags":  []interface{}{"a", "b"},
+			},
+		},
+		Session: &Session{CreatedAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().Add(time.Hour)},
+	}
+}
+
+func evaluateSource(t *testing.T, source string, input *Input) (bool, string, error) {
+	t.Helper()
+	expression, err := Compile(source)
+	if err != nil {
+		t.Fatalf("Compile(%q): %v", source, err)
+	}
+	return expression.Evaluate(input)
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		// precedence
+		{`1 + 2 * 3 == 7`, true},
+		{`(1 + 2) * 3 == 9`, true},
+		{`10 - 4 - 3 == 3`, true},
+		{`7 / 2 == 3 && 7 % 2 == 1`, true},
+		{`-2 * 3 == -6`, true},
+		{`!false && true`, true},
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`false ? 1 : 2 == 2`, true},
+		{`true ? false : true ? true : true`, false},
+		{`1 < 2 == true`, true},
+		{`1.5 + 1 == 2.5`, true},
+		{`"a" + "b" == "ab"`, true},
+		{`[1, 2] + [3] == [1, 2, 3]`, true},
+		// in
+		{`"admins" in user.groups`, true},
+		{`"root" in user.groups`, false},
+		{`"role" in user.claims.org`, true},
+		{`request.method in ["GET", "HEAD"]`, true},
+		{`2 in [1, 2.0]`, true},
+		// macros
+		{`user.groups.exists(g, g.startsWith("eng-"))`, true},
+		{`user.groups.all(g, g.size() > 3)`, true},
+		{`user.groups.all(g, g.startsWith("eng-"))`, false},
+		{`[].exists(x, x)`, false},
+		{`[].all(x, x)`, true},
+		{`user.groups.exists(g, user.groups.exists(h, h != g && h.startsWith("adm")))`, true},
+		// variables
+		{`request.host == "app.example.com" && request.path == "/reports/q1" && request.method == "GET"`, true},
+		{`user.email.endsWith("@example.com") && user.email_verified`, true},
+		{`user.hosted_domain == "example.com" && user.provider == "google"`, true},
+		{`user.claims.level >= 3 && user.claims.ratio < 1`, true},
+		{`user.claims.org.role == "owner" && user.claims["org"]["role"] == "owner"`, true},
+		{`user.claims.tags[1] == "b" && size(user.claims.tags) == 2`, true},
+		{`has(user.claims.org) && !has(user.claims.missing)`, true},
+		{`session.age >= 3599 && session.expires_at > session.created_at`, true},
+		{`session.last_seen_at == 0`, true},
+		// functions and methods
+		{`size("héllo") == 5 && "héllo".size() == 5`, true},
+		{`int("42") == 42 && int(2.9) == 2 && double(1) == 1.0`, true},
+		{`string(1) + string(true) == "1true"`, true},
+		{`"Admin".lowerAscii() == "admin" && "a".upperAscii() == "A"`, true},
+		{`user.email.contains("@") && user.email.matches("^[a-z]+@example\\.com$")`, true},
+		// comparisons
+		{`"a" < "b" && 2 > 1.5 && 1 <= 1 && 2 >= 3`, false},
+		{`null == null && user != null`, true},
+		{`1 == "1"`, false},
+	}
+
+	for _, test := range tests {
+		ok, reason, err := evaluateSource(t, test.source, testInput())
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if ok != test.want {
+			t.Errorf("%s = %v, want %v", test.source, ok, test.want)
+		}
+		if !ok && reason == "" {
+			t.Errorf("%s: false without a reason", test.source)
+		}
+	}
+}
+
+func TestEvaluateReason(t *testing.T) {
+	ok, reason, err := evaluateSource(t, `user.email_verified && "root" in user.groups && request.method == "GET"`, testInput())
+	if err != nil || ok || reason != `"root" in user.groups is false` {
+		t.Errorf("Evaluate = %v, %q, %v, want the failing conjunct as reason", ok, reason, err)
+	}
+}
+
+func TestEvaluateNullSession(t *testing.T) {
+	input := testInput()
+	input.Session = nil
+
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{`session == null`, true},
+		{`session == null || session.age < 60`, true},
+		{`session != null && session.age < 60`, false},
+	}
+	for _, test := range tests {
+		ok, _, err := evaluateSource(t, test.source, input)
+		if err != nil || ok != test.want {
+			t.Errorf("%s = %v, %v, want %v", test.source, ok, err, test.want)
+		}
+	}
+
+	if ok, _, err := evaluateSource(t, `session.age < 60`, input); ok || err == nil {
+		t.Errorf("session.age on null = %v, %v, want an error", ok, err)
+	}
+
+	input.User = nil
+	if ok, _, err := evaluateSource(t, `user.email == "a"`, input); ok || err == nil {
+		t.Errorf("user.email on null = %v, %v, want an error", ok, err)
+	}
+}
+
+// TestEvaluateErrors checks that failing expressions deny with an error.
+func TestEvaluateErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{`user.claims.missing == "x"`, "no such key"},
+		{`user.groups[5] == "x"`, "out of range"},
+		{`user.groups["a"] == "x"`, ""},
+		{`1 + "a" == 1`, "no such operator"},
+		{`-"a" == 1`, "no such operator"},
+		{`!1`, "no such operator"},
+		{`1 / 0 == 1`, "division by zero"},
+		{`1 % 0 == 1`, "division by zero"},
+		{`"a" < 1`, ""},
+		{`1 in "abc"`, ""},
+		{`user.email`, "not bool"},
+		{`1 ? true : false`, ""},
+		{`[1, 2].all(x, x)`, ""},
+		{`int("x") == 1`, "invalid number"},
+		{`int(100000000000000000000.0) == 1`, "out of range"},
+		{`size(1) == 1`, "no such overload"},
+		{`user.claims.level.startsWith("3")`, ""},
+		{`9223372036854775807 + 1 > 0`, "overflow"},
+		{`-9223372036854775807 - 2 < 0`, "overflow"},
+		{`4611686018427387904 * 2 > 0`, "overflow"},
+		{`-(-9223372036854775807 - 1) > 0`, "overflow"},
+		{`(-9223372036854775807 - 1) / -1 > 0`, "overflow"},
+		{`user.email_verified && 9223372036854775807 * -2 < 0`, "overflow"},
+	}
+
+	for _, test := range tests {
+		ok, _, err := evaluateSource(t, test.source, testInput())
+		if ok || err == nil {
+			t.Errorf("%s = %v, %v, want an error denying", test.source, ok, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: err = %v, want it to mention %q", test.source, err, test.want)
+		}
+	}
+}
+
+// TestEvaluateAbsorbsErrors checks that && and || ignore errors on the side
+// that does not decide the result, as in CEL.
+func TestEvaluateAbsorbsErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{`user.claims.missing == "x" || true`, true},
+		{`true || user.claims.missing == "x"`, true},
+		{`!(user.claims.missing == "x" && false)`, true},
+		{`false && 1 / 0 == 1`, false},
+	}
+	for _, test := range tests {
+		ok, _, err := evaluateSource(t, test.source, testInput())
+		if err != nil || ok != test.want {
+			t.Errorf("%s = %v, %v, want %v", test.source, ok, err, test.want)
+		}
+	}
+
+	for _, source := range []string{`user.claims.missing == "x" || false`, `true && user.claims.missing == "x"`} {
+		if ok, _, err := evaluateSource(t, source, testInput()); ok || err == nil {
+			t.Errorf("%s = %v, %v, want an error", source, ok, err)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{``, "column 1"},
+		{`user.email ==`, "column 14"},
+		{`(true`, ""},
+		{`"unterminated`, ""},
+		{`1 +* 2`, ""},
+		{`true false`, "unexpected"},
+		{`users.email == "a"`, "users"},
+		{`user.mail == "a"`, "mail"},
+		{`request.query == "a"`, "query"},
+		{`session.id == "a"`, "id"},
+		{`user.email.reverse()`, "reverse"},
+		{`lower(user.email)`, "lower"},
+		{`user.email.matches("(")`, ""},
+		{`user.groups.exists(1, true)`, ""},
+		{`user.groups.exists(g, h)`, "h"},
+		{`size(1, 2)`, ""},
+		{`9223372036854775808 > 0`, ""},
+		{`user.email @ 1`, ""},
+	}
+
+	for _, test := range tests {
+		_, err := Compile(test.source)
+		if err == nil {
+			t.Errorf("Compile(%q) succeeded, want an error", test.source)
+			continue
+		}
+		if _, ok := err.(*CompileError); !ok {
+			t.Errorf("Compile(%q) = %T, want a CompileError", test.source, err)
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Compile(%q) = %v, want it to mention %q", test.source, err, test.want)
+		}
+	}
+}
+
+func TestRuleExpressionErrorDenies(t *testing.T) {
+	rules := []*Rule{{Name: "claims", Expression: `user.claims.missing == "x"`}}
+	decision := evaluate(t, rules, Request{Host: "app.example.com", Path: "/", Method: "GET"}, alice)
+	if decision.Allowed || decision.Rule != "claims" {
+		t.Errorf("decision = %+v, want the erroring rule to deny", decision)
+	}
+}
+
+func FuzzExpression(f *testing.F) {
+	seeds := []string{
+		`user.email.endsWith("@corp.com") && "admin" in user.groups && request.method != "DELETE"`,
+		`user.groups.exists(g, g.startsWith("eng-")) || user.claims.org.role == "owner"`,
+		`size(user.claims.tags) == 2 ? user.claims.tags[1] : "none"`,
+		`int("42") + 7 / 2 % 3 - -1.5 >= double(session.age)`,
+		`user.email.matches("^[a-z]+@example\\.com$") && has(user.claims.missing)`,
+		`[1, "a", null, [true]] + [] == [1, "a", null, [true]]`,
+		`string(user.claims["org"]["role"]).lowerAscii().size() > 1`,
+		`!(session == null) && user.groups.all(g, g != "")`,
+		`user.claims.level / 0 == 1`,
+		`"é\x41\n\"" in ["a"]`,
+	}
+	for _, source := range seeds {
+		f.Add(source)
+	}
+
+	f.Fuzz(func(t *testing.T, source string) {
+		expression, err := Compile(source)
+		if err != nil {
+			if _, isCompileError := err.(*CompileError); !isCompileError {
+				t.Fatalf("Compile(%q) = %T %v, want a *CompileError", source, err, err)
+			}
+			return
+		}
+		if expression.String() != source {
+			t.Fatalf("String() = %q, want %q", expression.String(), source)
+		}
+
+		input := testInput()
+		ok, reason, err := expression.Evaluate(input)
+		switch {
+		case err != nil && (ok || reason != ""):
+			t.Fatalf("%q = %v, %q with error %v", source, ok, reason, err)
+		case ok && reason != "":
+			t.Fatalf("%q allowed with reason %q", source, reason)
+		case !ok && err == nil && reason == "":
+			t.Fatalf("%q denied without a reason", source)
+		}
+		if again, _, _ := expression.Evaluate(testInput()); again != ok {
+			t.Fatalf("%q = %v, then %v", source, ok, again)
+		}
+
+		// evaluation does not modify the input
+		if want := testInput(); input.Request != want.Request || strings.Join(input.User.Groups, ",") != strings.Join(want.User.Groups, ",") {
+			t.Fatalf("%q modified the input to %+v", source, input)
+		}
+
+		// negation flips every decision reached without an error
+		negated, err2 := Compile("!(" + source + ")")
+		if err2 != nil {
+			t.Fatalf("Compile of the negation of %q: %v", source, err2)
+		}
+		if notOK, _, notErr := negated.Evaluate(testInput()); err == nil && (notErr != nil || notOK == ok) {
+			t.Fatalf("!(%q) = %v, %v, want %v", source, notOK, notErr, !ok)
+		}
+	})
+}
@@ -0,0 +1,337 @@
+// Package policy decides which authenticated users may make which requests,
+// from ordered rules matching the request's host, path and method. It works
+// on plain values, independent of net/http.
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Request is the part of a request rules match on.
+type Request struct {
+	Host   string
+	Path   string
+	Method string
+}
+
+// User is the identity rules place requirements on.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Provider      string
+	HostedDomain  string
+	Groups        []string
+	// Claims are the provider's raw user attributes; nested values are
+	// addressed with dotted paths such as "org.role".
+	Claims map[string]interface{}
+}
+
+// Requirement lists conditions on the user. Groups, emails and providers
+// compare case-insensitively.
+type Requirement struct {
+	Groups []string
+	// Emails are addresses or "@example.com" domains, and only match
+	// verified addresses.
+	Emails    []string
+	Providers []string
+	// Claims maps claim paths to accepted values, compared as strings. A
+	// list claim matches if any of its elements does.
+	Claims map[string][]string
+}
+
+// Rule applies to requests matching each of its non-empty Hosts, Paths and
+// Methods lists. A rule without requirements allows any authenticated user.
+type Rule struct {
+	// Name identifies the rule in decisions; defaults to "rules[i]".
+	Name string
+	// Hosts are host names or "*.example.com" wildcards for subdomains.
+	Hosts []string
+	// Paths are prefixes matching whole segments: "/admin" matches
+	// "/admin" and "/admin/users", not "/administrator".
+	Paths   []string
+	Methods []string
+	// AnyOf is met when the user meets any one of its conditions.
+	AnyOf Requirement
+	// AllOf is met when the user meets every one of its conditions: is in
+	// all Groups, has every Claims entry, and has an email and a provider
+	// from those lists.
+	AllOf Requirement
+	// Expression must also hold when set, see Expression.
+	Expression string
+
+	expression *Expression
+}
+
+// Decision is the outcome of Evaluate.
+type Decision struct {
+	Allowed bool
+	// Rule is the name of the matching rule, empty when none matched.
+	Rule   string
+	Reason string
+}
+
+// Policy evaluates rules in order; the first rule matching the request
+// decides. Requests no rule matches are allowed.
+type Policy struct {
+	rules []*Rule
+}
+
+// New validates and normalizes a copy of rules.
+func New(rules []*Rule) (*Policy, error) {
+	policy := &Policy{}
+	for i, rule := range rules {
+		if rule == nil {
+			return nil, fmt.Errorf("policy: rules[%d] is empty", i)
+		}
+		r := *rule
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rules[%d]", i)
+		}
+
+		r.Hosts = nil
+		for _, host := range rule.Hosts {
+			host = strings.ToLower(strings.TrimSpace(host))
+			if host == "" || strings.ContainsAny(host, "/:@ ") || strings.Contains(host[1:], "*") ||
+				strings.HasPrefix(host, "*") && !strings.HasPrefix(host, "*.") {
+				return nil, fmt.Errorf("policy: %s: invalid host %q", r.Name, host)
+			}
+			r.Hosts = append(r.Hosts, host)
+		}
+
+		r.Paths = nil
+		for _, p := range rule.Paths {
+			if !strings.HasPrefix(p, "/") {
+				return nil, fmt.Errorf("policy: %s: path %q must start with /", r.Name, p)
+			}
+			r.Paths = append(r.Paths, path.Clean(p))
+		}
+
+		r.Methods = nil
+		for _, method := range rule.Methods {
+			if method == "" {
+				return nil, fmt.Errorf("policy: %s: empty method", r.Name)
+			}
+			r.Methods = append(r.Methods, strings.ToUpper(method))
+		}
+
+		for _, requirement := range []Requirement{r.AnyOf, r.AllOf} {
+			for _, email := range requirement.Emails {
+				if !strings.Contains(email, "@") {
+					return nil, fmt.Errorf("policy: %s: %q is not an email address or @domain", r.Name, email)
+				}
+			}
+			for claim := range requirement.Claims {
+				if claim == "" {
+					return nil, fmt.Errorf("policy: %s: empty claim name", r.Name)
+				}
+			}
+		}
+
+		if r.Expression != "" {
+			expression, err := Compile(r.Expression)
+			if err != nil {
+				return nil, fmt.Errorf("policy: %s: expression %s", r.Name, strings.TrimPrefix(err.Error(), "policy: "))
+			}
+			r.expression = expression
+		}
+
+		policy.rules = append(policy.rules, &r)
+	}
+	return policy, nil
+}
+
+// Evaluate decides whether the input's user may make its request.
+func (t *Policy) Evaluate(input *Input) Decision {
+	request := normalize(input.Request)
+	user := input.User
+	for _, rule := range t.rules {
+		if !rule.matches(request) {
+			continue
+		}
+		if user == nil {
+			return Decision{Rule: rule.Name, Reason: "not authenticated"}
+		}
+		if !rule.AnyOf.empty() && !rule.AnyOf.any(user) {
+			return Decision{Rule: rule.Name, Reason: "none of the required groups, emails, providers or claims"}
+		}
+		if reason := rule.AllOf.all(user); reason != "" {
+			return Decision{Rule: rule.Name, Reason: reason}
+		}
+		if rule.expression != nil {
+			ok, reason, err := rule.expression.Evaluate(input)
+			if err != nil {
+				return Decision{Rule: rule.Name, Reason: err.Error()}
+			}
+			if !ok {
+				return Decision{Rule: rule.Name, Reason: reason}
+			}
+		}
+		return Decision{Allowed: true, Rule: rule.Name}
+	}
+	return Decision{Allowed: user != nil, Reason: "no rule matched"}
+}
+
+func normalize(request Request) Request {
+	host := strings.ToLower(request.Host)
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	request.Host = strings.TrimSuffix(host, ".")
+
+	if request.Path == "" || request.Path[0] != '/' {
+		request.Path = "/" + request.Path
+	}
+	request.Path = path.Clean(request.Path)
+
+	request.Method = strings.ToUpper(request.Method)
+	return request
+}
+
+func (t *Rule) matches(request Request) bool {
+	if len(t.Hosts) > 0 && !matchAny(t.Hosts, request.Host, hostMatches) {
+		return false
+	}
+	if len(t.Paths) > 0 && !matchAny(t.Paths, request.Path, pathMatches) {
+		return false
+	}
+	if len(t.Methods) > 0 && !matchAny(t.Methods, request.Method, strings.EqualFold) {
+		return false
+	}
+	return true
+}
+
+func hostMatches(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+func pathMatches(prefix, p string) bool {
+	if prefix == "/" || p == prefix {
+		return true
+	}
+	return strings.HasPrefix(p, prefix+"/")
+}
+
+func matchAny(patterns []string, value string, match func(pattern, value string) bool) bool {
+	for _, pattern := range patterns {
+		if match(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t Requirement) empty() bool {
+	return len(t.Groups) == 0 && len(t.Emails) == 0 && len(t.Providers) == 0 && len(t.Claims) == 0
+}
+
+// any reports whether user meets at least one condition.
+func (t Requirement) any(user *User) bool {
+	for _, group := range t.Groups {
+		if hasGroup(user, group) {
+			return true
+		}
+	}
+	if len(t.Emails) > 0 && emailMatches(t.Emails, user) {
+		return true
+	}
+	if matchAny(t.Providers, user.Provider, strings.EqualFold) {
+		return true
+	}
+	for claim, values := range t.Claims {
+		if claimMatches(user.Claims, claim, values) {
+			return true
+		}
+	}
+	return false
+}
+
+// all returns why user fails a condition, or "" if it meets all of them.
+func (t Requirement) all(user *User) string {
+	for _, group := range t.Groups {
+		if !hasGroup(user, group) {
+			return fmt.Sprintf("not in group %q", group)
+		}
+	}
+	if len(t.Emails) > 0 && !emailMatches(t.Emails, user) {
+		return "email is not allowed"
+	}
+	if len(t.Providers) > 0 && !matchAny(t.Providers, user.Provider, strings.EqualFold) {
+		return fmt.Sprintf("provider %q is not allowed", user.Provider)
+	}
+	for claim, values := range t.Claims {
+		if !claimMatches(user.Claims, claim, values) {
+			return fmt.Sprintf("claim %q does not match", claim)
+		}
+	}
+	return ""
+}
+
+func hasGroup(user *User, group string) bool {
+	return matchAny(user.Groups, group, strings.EqualFold)
+}
+
+func emailMatches(patterns []string, user *User) bool {
+	if user.Email == "" || !user.EmailVerified {
+		return false
+	}
+	email := strings.ToLower(user.Email)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == email || strings.HasPrefix(pattern, "@") && strings.HasSuffix(email, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func claimMatches(claims map[string]interface{}, claim string, values []string) bool {
+	value, ok := lookup(claims, claim)
+	if !ok {
+		return false
+	}
+	if list, ok := value.([]interface{}); ok {
+		for _, element := range list {
+			if matchAny(values, fmt.Sprint(element), stringEqual) {
+				return true
+			}
+		}
+		return false
+	}
+	if list, ok := value.([]string); ok {
+		for _, element := range list {
+			if matchAny(values, element, stringEqual) {
+				return true
+			}
+		}
+		return false
+	}
+	return matchAny(values, fmt.Sprint(value), stringEqual)
+}
+
+// lookup resolves a dotted path through nested objects; an exact key wins
+// over a nested path.
+func lookup(claims map[string]interface{}, claim string) (interface{}, bool) {
+	if value, ok := claims[claim]; ok {
+		return value, true
+	}
+	parts := strings.SplitN(claim, ".", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	nested, ok := claims[parts[0]].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return lookup(nested, parts[1])
+}
+
+func stringEqual(a, b string) bool {
+	return a == b
+}
@@ -0,0 +1,198 @@
+package policy
+
+import (
+	"testing"
+)
+
+var (
+	alice = &User{
+		Subject:       "1",
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		Provider:      "google",
+		Groups:        []string{"ops", "Example-Org/Admins"},
+		Claims: map[string]interface{}{
+			"role":  "admin",
+			"org":   map[string]interface{}{"tier": "gold"},
+			"teams": []interface{}{"red", "blue"},
+		},
+	}
+	bob = &User{
+		Subject:       "2",
+		Email:         "bob@example.com",
+		EmailVerified: false,
+		Provider:      "github",
+		Groups:        []string{"dev"},
+	}
+)
+
+func evaluate(t *testing.T, rules []*Rule, request Request, user *User) Decision {
+	t.Helper()
+	policy, err := New(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy.Evaluate(&Input{Request: request, User: user})
+}
+
+func TestMatching(t *testing.T) {
+	rules := []*Rule{{
+		Name:    "admin",
+		Hosts:   []string{"app.example.com", "*.internal.example.com"},
+		Paths:   []string{"/admin/"},
+		Methods: []string{"post", "DELETE"},
+		AnyOf:   Requirement{Groups: []string{"nobody"}},
+	}}
+
+	tests := []struct {
+		name    string
+		request Request
+		matched bool
+	}{
+		{"exact host", Request{"app.example.com", "/admin", "POST"}, true},
+		{"host case and port", Request{"APP.example.com:8443", "/admin", "POST"}, true},
+		{"host trailing dot", Request{"app.example.com.", "/admin", "POST"}, true},
+		{"wildcard subdomain", Request{"a.b.internal.example.com", "/admin", "POST"}, true},
+		{"wildcard excludes apex", Request{"internal.example.com", "/admin", "POST"}, false},
+		{"wildcard is a suffix match on labels", Request{"evilinternal.example.com", "/admin", "POST"}, false},
+		{"other host", Request{"example.com", "/admin", "POST"}, false},
+		{"sub path", Request{"app.example.com", "/admin/users", "POST"}, true},
+		{"segment boundary", Request{"app.example.com", "/administrator", "POST"}, false},
+		{"dot segments", Request{"app.example.com", "/public/../admin/x", "POST"}, true},
+		{"relative path", Request{"app.example.com", "admin", "POST"}, true},
+		{"method case", Request{"app.example.com", "/admin", "delete"}, true},
+		{"other method", Request{"app.example.com", "/admin", "GET"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := evaluate(t, rules, test.request, alice)
+			if matched := decision.Rule == "admin"; matched != test.matched {
+				t.Errorf("matched = %v, want %v (%+v)", matched, test.matched, decision)
+			}
+			if decision.Allowed == test.matched {
+				t.Errorf("allowed = %v, want the matching rule to deny", decision.Allowed)
+			}
+		})
+	}
+}
+
+func TestRequirements(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		user    *User
+		allowed bool
+	}{
+		{"no requirements", Rule{}, bob, true},
+		{"any_of group", Rule{AnyOf: Requirement{Groups: []string{"dev", "ops"}}}, bob, true},
+		{"any_of group case", Rule{AnyOf: Requirement{Groups: []string{"example-org/admins"}}}, alice, true},
+		{"any_of none", Rule{AnyOf: Requirement{Groups: []string{"ops"}, Providers: []string{"google"}}}, bob, false},
+		{"any_of provider", Rule{AnyOf: Requirement{Groups: []string{"ops"}, Providers: []string{"GitHub"}}}, bob, true},
+		{"any_of email", Rule{AnyOf: Requirement{Emails: []string{"Alice@example.com"}}}, alice, true},
+		{"any_of email domain", Rule{AnyOf: Requirement{Emails: []string{"@example.com"}}}, alice, true},
+		{"unverified email", Rule{AnyOf: Requirement{Emails: []string{"@example.com"}}}, bob, false},
+		{"domain is a suffix after @", Rule{AnyOf: Requirement{Emails: []string{"@ample.com"}}}, alice, false},
+		{"any_of claim", Rule{AnyOf: Requirement{Claims: map[string][]string{"role": {"admin"}}}}, alice, true},
+		{"nested claim", Rule{AnyOf: Requirement{Claims: map[string][]string{"org.tier": {"gold"}}}}, alice, true},
+		{"list claim", Rule{AnyOf: Requirement{Claims: map[string][]string{"teams": {"blue"}}}}, alice, true},
+		{"missing claim", Rule{AnyOf: Requirement{Claims: map[string][]string{"role": {"admin"}}}}, bob, false},
+		{"all_of groups", Rule{AllOf: Requirement{Groups: []string{"ops", "example-org/admins"}}}, alice, true},
+		{"all_of missing group", Rule{AllOf: Requirement{Groups: []string{"ops", "dev"}}}, alice, false},
+		{"all_of email and provider", Rule{AllOf: Requirement{Emails: []string{"@example.com"}, Providers: []string{"google"}}}, alice, true},
+		{"all_of wrong provider", Rule{AllOf: Requirement{Emails: []string{"@example.com"}, Providers: []string{"github"}}}, alice, false},
+		{"all_of claims", Rule{AllOf: Requirement{Claims: map[string][]string{"role": {"admin"}, "org.tier": {"silver"}}}}, alice, false},
+		{"any_of and all_of", Rule{AnyOf: Requirement{Groups: []string{"ops"}}, AllOf: Requirement{Providers: []string{"google"}}}, alice, true},
+		{"any_of met, all_of not", Rule{AnyOf: Requirement{Groups: []string{"ops"}}, AllOf: Requirement{Providers: []string{"github"}}}, alice, false},
+		{"expression", Rule{AnyOf: Requirement{Groups: []string{"ops"}}, Expression: `user.email.endsWith("@example.com")`}, alice, true},
+		{"expression denies", Rule{Expression: `"ops" in user.groups`}, bob, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := test.rule
+			decision := evaluate(t, []*Rule{&rule}, Request{Host: "app.example.com", Path: "/", Method: "GET"}, test.user)
+			if decision.Allowed != test.allowed {
+				t.Errorf("allowed = %v, want %v (%+v)", decision.Allowed, test.allowed, decision)
+			}
+			if !decision.Allowed && decision.Reason == "" {
+				t.Error("denied without a reason")
+			}
+		})
+	}
+}
+
+func TestFirstMatchWins(t *testing.T) {
+	rules := []*Rule{
+		{Name: "public", Paths: []string{"/admin/health"}},
+		{Name: "admin", Paths: []string{"/admin"}, AnyOf: Requirement{Groups: []string{"ops"}}},
+		{Name: "fallback", AnyOf: Requirement{Groups: []string{"dev"}}},
+	}
+
+	tests := []struct {
+		path    string
+		user    *User
+		rule    string
+		allowed bool
+	}{
+		{"/admin/health", bob, "public", true},
+		{"/admin/users", bob, "admin", false},
+		{"/admin/users", alice, "admin", true},
+		{"/docs", bob, "fallback", true},
+		{"/docs", alice, "fallback", false},
+	}
+
+	for _, test := range tests {
+		decision := evaluate(t, rules, Request{Host: "app.example.com", Path: test.path, Method: "GET"}, test.user)
+		if decision.Rule != test.rule || decision.Allowed != test.allowed {
+			t.Errorf("%s as %s = %+v, want rule %s allowed %v", test.path, test.user.Subject, decision, test.rule, test.allowed)
+		}
+	}
+}
+
+func TestOpenByDefault(t *testing.T) {
+	rules := []*Rule{{Name: "admin", Paths: []string{"/admin"}, AnyOf: Requirement{Groups: []string{"ops"}}}}
+
+	decision := evaluate(t, rules, Request{Host: "app.example.com", Path: "/docs", Method: "GET"}, bob)
+	if !decision.Allowed || decision.Rule != "" {
+		t.Errorf("unmatched request = %+v, want allowed by no rule", decision)
+	}
+	decision = evaluate(t, nil, Request{Path: "/"}, bob)
+	if !decision.Allowed {
+		t.Errorf("empty policy = %+v, want allowed", decision)
+	}
+
+	decision = evaluate(t, rules, Request{Path: "/docs"}, nil)
+	if decision.Allowed {
+		t.Errorf("anonymous = %+v, want denied", decision)
+	}
+	decision = evaluate(t, []*Rule{{}}, Request{Path: "/docs"}, nil)
+	if decision.Allowed || decision.Reason != "not authenticated" {
+		t.Errorf("anonymous = %+v, want denied as not authenticated", decision)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule *Rule
+	}{
+		{"empty rule", nil},
+		{"host with port", &Rule{Hosts: []string{"example.com:443"}}},
+		{"inner wildcard", &Rule{Hosts: []string{"a.*.example.com"}}},
+		{"bare wildcard", &Rule{Hosts: []string{"*example.com"}}},
+		{"relative path", &Rule{Paths: []string{"admin"}}},
+		{"empty method", &Rule{Methods: []string{""}}},
+		{"email", &Rule{AnyOf: Requirement{Emails: []string{"example.com"}}}},
+		{"claim", &Rule{AllOf: Requirement{Claims: map[string][]string{"": {"x"}}}}},
+		{"expression", &Rule{Expression: `user.unknown == 1`}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := New([]*Rule{test.rule}); err == nil {
+				t.Error("New succeeded, want an error")
+			}
+		})
+	}
+}
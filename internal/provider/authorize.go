@@ -0,0 +1,69 @@
+package provider
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// Authorizer decides whether an authenticated user may be issued a session.
+type Authorizer interface {
+	Authorize(r *http.Request, user *User) error
+}
+
+// AuthorizerFunc adapts a function to the Authorizer interface.
+type AuthorizerFunc func(r *http.Request, user *User) error
+
+func (t AuthorizerFunc) Authorize(r *http.Request, user *User) error {
+	return t(r, user)
+}
+
+// unexported key type prevents collisions
+type authorizerKey struct{}
+
+// WithAuthorizer returns a copy of ctx that stores the Authorizer.
+func WithAuthorizer(ctx context.Context, authorizer Authorizer) context.Context {
+	return context.WithValue(ctx, authorizerKey{}, authorizer)
+}
+
+// Authorize consults the Authorizer stored in the request ctx; users are
+// allowed when none is configured. Providers call it before issuing a
+// session.
+func Authorize(r *http.Request, user *User) error {
+	if authorizer, ok := r.Context().Value(authorizerKey{}).(Authorizer); ok {
+		return authorizer.Authorize(r, user)
+	}
+	return nil
+}
+
+var accessDeniedTemplate = template.Must(template.New("denied").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Access denied</title>
+<style>
+body { font-family: sans-serif; max-width: 32em; margin: 4em auto; padding: 0 1em; color: #222; }
+h1 { font-size: 1.5em; }
+</style>
+</head>
+<body>
+<h1>Access denied</h1>
+{{if .Email}}<p>You signed in as <strong>{{.Email}}</strong>, which is not allowed to access this application.</p>
+{{else}}<p>Your account is not allowed to access this application.</p>
+{{end}}<p>Ask an administrator for access, or sign in with a different account.</p>
+</body>
+</html>
+`))
+
+// AccessDenied logs why user was denied and renders a 403 page that does not
+// reveal the policy.
+func AccessDenied(w http.ResponseWriter, r *http.Request, user *User, err error) {
+	log.Printf("access denied for %s user %q: %v", user.Provider, user.Subject, err)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	accessDeniedTemplate.Execute(w, user)
+}
@@ -1,48 +1,64 @@
 package facebookprovider
 
 import (
-	"github.com/dghubble/gologin/v2"
+	"encoding/json"
+	"fmt"
 	"github.com/dghubble/gologin/v2/facebook"
-	"github.com/dghubble/sessions"
+	oauth2Login "github.com/dghubble/gologin/v2/oauth2"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/flow"
 	"github.com/ozankasikci/one-oauth/internal/provider"
+	"github.com/ozankasikci/one-oauth/internal/session"
 	"golang.org/x/oauth2"
 	facebookOAuth2 "golang.org/x/oauth2/facebook"
 	"net/http"
-	"net/url"
 )
 
+// same Graph API version gologin's facebook package uses
+const meURL = "https://graph.facebook.com/v2.9/me?fields=name,email"
+
 type Config struct {
+	// Name is the provider instance name reported as User.Provider.
+	Name                       string
 	CookieSessionName          string
 	CookieSessionSecret        string
-	CookieSessionUserKey       string
 	ClientID                   string
 	ClientSecret               string
 	FacebookRedirectURL        string
 	UpstreamSuccessRedirectURL string
 	Scopes                     []string
+	// CookieSessionKeys encrypt session cookies, newest first; older keys
+	// only open cookies issued before a rotation. Defaults to a single key
+	// made of CookieSessionSecret.
+	CookieSessionKeys []session.Key
+	// SessionStore holds server-side sessions; defaults to an in-memory store.
+	SessionStore    session.Store
+	SessionLifetime session.Lifetime
+	// Cookie sets the login and session cookie attributes; defaults to
+	// cookie.Default, which requires HTTPS.
+	Cookie *cookie.Options
+	// DisablePKCE omits the PKCE code challenge.
+	DisablePKCE bool
 }
 
 type FacebookProvider struct {
+	session.Provider
 	Config       *Config
-	StateConfig  gologin.CookieConfig
+	StateConfig  cookie.Config
 	Oauth2Config *oauth2.Config
-	CookieStore  *sessions.CookieStore
 }
 
 func (t FacebookProvider) LoginHandler() http.Handler {
-	return facebook.StateHandler(t.StateConfig, facebook.LoginHandler(t.Oauth2Config, nil))
-}
-
-func (t FacebookProvider) LogoutHandler() http.Handler {
-	return t.logoutHandler()
+	options := flow.Options{DisablePKCE: t.Config.DisablePKCE}
+	return flow.LoginHandler(t.StateConfig, t.Oauth2Config, options)
 }
 
 func (t FacebookProvider) CallbackHandler() http.Handler {
-	return facebook.StateHandler(t.StateConfig, facebook.CallbackHandler(t.Oauth2Config, t.issueSession(), nil))
+	return flow.CallbackHandler(t.StateConfig, t.Oauth2Config, t.userHandler(t.issueSession()), nil)
 }
 
-func (t FacebookProvider) IsAuthenticatedHandler() http.Handler {
-	return t.IsAuthenticatedHandler()
+func (t FacebookProvider) RedirectURL() string {
+	return t.Oauth2Config.RedirectURL
 }
 
 func New(config *Config) provider.ProviderInterface {
@@ -54,82 +70,111 @@ func New(config *Config) provider.ProviderInterface {
 		Scopes:       config.Scopes,
 	}
 
-	cookieStore := sessions.NewCookieStore([]byte(config.CookieSessionSecret), nil)
+	cookieOptions := cookie.Default
+	if config.Cookie != nil {
+		cookieOptions = *config.Cookie
+	}
+
+	sessionConfig := session.ProviderConfig{
+		CookieName: config.CookieSessionName,
+		Keys:       config.CookieSessionKeys,
+		Secret:     config.CookieSessionSecret,
+		Store:      config.SessionStore,
+		Lifetime:   config.SessionLifetime,
+		Cookie:     cookieOptions,
+	}
 
-	// state param cookies require HTTPS by default; disable for localhost development
-	stateConfig := gologin.DebugOnlyCookieConfig
+	stateConfig := cookieOptions.LoginConfig(flow.LoginCookieName(config.Name))
 
 	return FacebookProvider{
 		Config:       config,
 		StateConfig:  stateConfig,
 		Oauth2Config: oauth2Config,
-		CookieStore:  cookieStore,
+		Provider:     session.NewProvider(sessionConfig, session.StaticConfig(oauth2Config)),
 	}
 }
 
-// issueSession issues a cookie session after successful facebook login
-func (t *FacebookProvider) issueSession() http.Handler {
+// userHandler fetches the Facebook user with the token from the ctx and adds
+// it to the ctx, like gologin's facebook.CallbackHandler.
+func (t *FacebookProvider) userHandler(success http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		facebookUser, err := facebook.UserFromContext(ctx)
+		token, err := oauth2Login.TokenFromContext(ctx)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			flow.Fail(w, r, err)
 			return
 		}
 
-		cookie := t.CookieStore.New(t.Config.CookieSessionName)
-		cookie.Values[t.Config.CookieSessionUserKey] = facebookUser.ID
-		err = cookie.Save(w)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, meURL, nil)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			flow.Fail(w, r, err)
 			return
 		}
+		// Facebook answers with Content-Type text/javascript unless asked for JSON
+		req.Header.Set("Accept", "application/json")
 
-		successRedirectUrl, err := url.Parse(t.Config.UpstreamSuccessRedirectURL)
+		resp, err := t.Oauth2Config.Client(ctx, token).Do(req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			flow.Fail(w, r, fmt.Errorf("facebook: unable to get Facebook user: %v", err))
 			return
 		}
+		defer resp.Body.Close()
 
-		q := successRedirectUrl.Query()
-		q.Set("email", facebookUser.Email)
-		q.Set("name", facebookUser.Name)
-		q.Set("id", facebookUser.ID)
-		successRedirectUrl.RawQuery = q.Encode()
+		if resp.StatusCode != http.StatusOK {
+			flow.Fail(w, r, fmt.Errorf("facebook: unable to get Facebook user: %s", resp.Status))
+			return
+		}
 
-		http.Redirect(w, r, successRedirectUrl.String(), http.StatusFound)
+		facebookUser := new(facebook.User)
+		if err := json.NewDecoder(resp.Body).Decode(facebookUser); err != nil || facebookUser.ID == "" {
+			flow.Fail(w, r, facebook.ErrUnableToGetFacebookUser)
+			return
+		}
+
+		ctx = facebook.WithUser(ctx, facebookUser)
+		success.ServeHTTP(w, r.WithContext(ctx))
 	}
 
 	return http.HandlerFunc(fn)
 }
 
-// logoutHandler destroys the session on POSTs and redirects to home.
-func (t *FacebookProvider) logoutHandler() http.Handler {
+// issueSession issues a cookie session after successful facebook login
+func (t *FacebookProvider) issueSession() http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			t.CookieStore.Destroy(w, t.Config.CookieSessionName)
+		ctx := r.Context()
+		facebookUser, err := facebook.UserFromContext(ctx)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
 		}
-	}
 
-	return http.HandlerFunc(fn)
-}
+		user := &provider.User{
+			Subject:  facebookUser.ID,
+			Provider: t.Config.Name,
+			Email:    facebookUser.Email,
+			Name:     facebookUser.Name,
+			Raw:      provider.RawClaims(facebookUser),
+		}
 
-func (t *FacebookProvider) isAuthenticatedHandler() http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		if t.isAuthenticated(r) == true {
-			w.WriteHeader(http.StatusOK)
-		} else {
-			w.WriteHeader(http.StatusProxyAuthRequired)
+		if err := provider.Authorize(r, user); err != nil {
+			provider.AccessDenied(w, r, user, err)
+			return
 		}
-	}
 
-	return http.HandlerFunc(fn)
-}
+		token, err := oauth2Login.TokenFromContext(ctx)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
 
-// isAuthenticated returns true if the user has a signed session cookie.
-func (t *FacebookProvider) isAuthenticated(r *http.Request) bool {
-	if _, err := t.CookieStore.Get(r, t.Config.CookieSessionName); err == nil {
-		return true
+		_, err = t.Sessions.Issue(w, r, user, token)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		provider.Deliver(w, r, t.Config.UpstreamSuccessRedirectURL, user)
 	}
-	return false
+
+	return http.HandlerFunc(fn)
 }
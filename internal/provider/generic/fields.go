@@ -0,0 +1,128 @@
+package genericprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FieldMapping holds JSONPath-style expressions locating profile fields in
+// the userinfo response, e.g. "id", "$.data.user.email" or "emails[0].value".
+// Empty fields fall back to the conventional top level names.
+type FieldMapping struct {
+	ID      string
+	Email   string
+	Name    string
+	Picture string
+	// EmailVerified locates a boolean; the email counts as unverified if
+	// it is missing.
+	EmailVerified string
+}
+
+func (t FieldMapping) withDefaults() FieldMapping {
+	if t.ID == "" {
+		t.ID = "id"
+	}
+	if t.Email == "" {
+		t.Email = "email"
+	}
+	if t.Name == "" {
+		t.Name = "name"
+	}
+	if t.Picture == "" {
+		t.Picture = "picture"
+	}
+	if t.EmailVerified == "" {
+		t.EmailVerified = "email_verified"
+	}
+	return t
+}
+
+// pathSegment is either an object key or an array index.
+type pathSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parsePath parses a subset of JSONPath: an optional leading "$", dotted
+// keys, bracketed indexes ([0]) and bracketed quoted keys (['some.key']).
+func parsePath(path string) ([]pathSegment, error) {
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+	var segments []pathSegment
+
+	for i := 0; i < len(path); {
+		switch path[i] {
+		case '.':
+			i++
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("generic: unterminated bracket in path %q", path)
+			}
+			inner := path[i+1 : i+end]
+			i += end + 1
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				segments = append(segments, pathSegment{key: inner[1 : len(inner)-1]})
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("generic: invalid index %q in path %q", inner, path)
+			}
+			segments = append(segments, pathSegment{index: index, isIndex: true})
+		default:
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			segments = append(segments, pathSegment{key: path[i : i+end]})
+			i += end
+		}
+	}
+
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("generic: empty path %q", path)
+	}
+	return segments, nil
+}
+
+// lookup resolves path in a document decoded with json.Decoder.UseNumber and
+// returns the value as a string. Missing values and null yield "".
+func lookup(document interface{}, path string) (string, error) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return "", err
+	}
+
+	value := document
+	for _, segment := range segments {
+		if segment.isIndex {
+			array, ok := value.([]interface{})
+			if !ok || segment.index >= len(array) {
+				return "", nil
+			}
+			value = array[segment.index]
+			continue
+		}
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", nil
+		}
+		value = object[segment.key]
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+
+	return "", fmt.Errorf("generic: path %q does not point to a scalar value", path)
+}
@@ -0,0 +1,221 @@
+package genericprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	oauth2Login "github.com/dghubble/gologin/v2/oauth2"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"github.com/ozankasikci/one-oauth/internal/session"
+	"golang.org/x/oauth2"
+	"io/ioutil"
+	"net/http"
+)
+
+var errMissingUser = errors.New("generic: context missing user")
+
+type Config struct {
+	// Name is the provider instance name reported as User.Provider.
+	Name                       string
+	CookieSessionName          string
+	CookieSessionSecret        string
+	ClientID                   string
+	ClientSecret               string
+	AuthURL                    string
+	TokenURL                   string
+	UserInfoURL                string
+	RedirectURL                string
+	UpstreamSuccessRedirectURL string
+	Scopes                     []string
+	// CookieSessionKeys encrypt session cookies, newest first; older keys
+	// only open cookies issued before a rotation. Defaults to a single key
+	// made of CookieSessionSecret.
+	CookieSessionKeys []session.Key
+	// SessionStore holds server-side sessions; defaults to an in-memory store.
+	SessionStore    session.Store
+	SessionLifetime session.Lifetime
+	Fields          FieldMapping
+	// Cookie sets the login and session cookie attributes; defaults to
+	// cookie.Default, which requires HTTPS.
+	Cookie *cookie.Options
+	// DisablePKCE omits the PKCE code challenge, for servers rejecting it.
+	DisablePKCE bool
+}
+
+type GenericProvider struct {
+	session.Provider
+	Config       *Config
+	StateConfig  cookie.Config
+	Oauth2Config *oauth2.Config
+}
+
+type userKey struct{}
+
+func (t GenericProvider) LoginHandler() http.Handler {
+	options := flow.Options{DisablePKCE: t.Config.DisablePKCE}
+	return flow.LoginHandler(t.StateConfig, t.Oauth2Config, options)
+}
+
+func (t GenericProvider) CallbackHandler() http.Handler {
+	return flow.CallbackHandler(t.StateConfig, t.Oauth2Config, t.userHandler(t.issueSession()), nil)
+}
+
+func (t GenericProvider) RedirectURL() string {
+	return t.Oauth2Config.RedirectURL
+}
+
+func New(config *Config) provider.ProviderInterface {
+	oauth2Config := &oauth2.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		RedirectURL:  config.RedirectURL,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  config.AuthURL,
+			TokenURL: config.TokenURL,
+		},
+		Scopes: config.Scopes,
+	}
+
+	cookieOptions := cookie.Default
+	if config.Cookie != nil {
+		cookieOptions = *config.Cookie
+	}
+
+	sessionConfig := session.ProviderConfig{
+		CookieName: config.CookieSessionName,
+		Keys:       config.CookieSessionKeys,
+		Secret:     config.CookieSessionSecret,
+		Store:      config.SessionStore,
+		Lifetime:   config.SessionLifetime,
+		Cookie:     cookieOptions,
+	}
+
+	stateConfig := cookieOptions.LoginConfig(flow.LoginCookieName(config.Name))
+
+	return GenericProvider{
+		Config:       config,
+		StateConfig:  stateConfig,
+		Oauth2Config: oauth2Config,
+		Provider:     session.NewProvider(sessionConfig, session.StaticConfig(oauth2Config)),
+	}
+}
+
+// userHandler fetches the userinfo endpoint with the token from the ctx and
+// adds the mapped user to the ctx.
+func (t *GenericProvider) userHandler(success http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		token, err := oauth2Login.TokenFromContext(ctx)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		user, err := t.fetchUser(ctx, token)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		ctx = context.WithValue(ctx, userKey{}, user)
+		success.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func (t *GenericProvider) fetchUser(ctx context.Context, token *oauth2.Token) (*provider.User, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.Config.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := t.Oauth2Config.Client(ctx, token).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("generic: userinfo request returned %s", resp.Status)
+	}
+
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	fields := t.Config.Fields.withDefaults()
+	user := &provider.User{Provider: t.Config.Name}
+	if raw, ok := document.(map[string]interface{}); ok {
+		user.Raw = raw
+	}
+	// fields may share a path, e.g. an email used as ID
+	for _, field := range []struct {
+		path string
+		dst  *string
+	}{
+		{fields.ID, &user.Subject},
+		{fields.Email, &user.Email},
+		{fields.Name, &user.Name},
+		{fields.Picture, &user.Picture},
+	} {
+		if *field.dst, err = lookup(document, field.path); err != nil {
+			return nil, err
+		}
+	}
+
+	emailVerified, err := lookup(document, fields.EmailVerified)
+	if err != nil {
+		return nil, err
+	}
+	user.EmailVerified = emailVerified == "true"
+
+	if user.Subject == "" {
+		return nil, fmt.Errorf("generic: userinfo response has no value at %q", fields.ID)
+	}
+	return user, nil
+}
+
+// issueSession issues a cookie session after successful login
+func (t *GenericProvider) issueSession() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(userKey{}).(*provider.User)
+		if !ok {
+			flow.Fail(w, r, errMissingUser)
+			return
+		}
+
+		if err := provider.Authorize(r, user); err != nil {
+			provider.AccessDenied(w, r, user, err)
+			return
+		}
+
+		token, err := oauth2Login.TokenFromContext(r.Context())
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		_, err = t.Sessions.Issue(w, r, user, token)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		provider.Deliver(w, r, t.Config.UpstreamSuccessRedirectURL, user)
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,157 @@
+package genericprovider
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/dghubble/gologin/v2"
+	oauth2Login "github.com/dghubble/gologin/v2/oauth2"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func userInfoServer(t *testing.T, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetchUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		fields FieldMapping
+		want   [5]string
+	}{
+		{
+			name: "defaults",
+			body: `{"id": 42, "email": "a@example.com", "name": "A", "picture": "https://example.com/a.png", "email_verified": true}`,
+			want: [5]string{"42", "a@example.com", "A", "https://example.com/a.png", "true"},
+		},
+		{
+			name:   "shared path",
+			body:   `{"email": "a@example.com"}`,
+			fields: FieldMapping{ID: "email", Name: "email"},
+			want:   [5]string{"a@example.com", "a@example.com", "a@example.com", "", "false"},
+		},
+		{
+			name:   "nested paths",
+			body:   `{"data": {"user": {"uid": "u1", "emails": [{"value": "a@example.com", "verified": "yes"}], "profile.name": "A"}}}`,
+			fields: FieldMapping{ID: "$.data.user.uid", Email: "data.user.emails[0].value", Name: "data.user['profile.name']", EmailVerified: "data.user.emails[0].verified"},
+			want:   [5]string{"u1", "a@example.com", "A", "", "false"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := userInfoServer(t, test.body)
+			p := &GenericProvider{
+				Config:       &Config{Name: "example", UserInfoURL: server.URL, Fields: test.fields},
+				Oauth2Config: &oauth2.Config{},
+			}
+
+			user, err := p.fetchUser(context.Background(), &oauth2.Token{AccessToken: "token"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			verified := "false"
+			if user.EmailVerified {
+				verified = "true"
+			}
+			got := [5]string{user.Subject, user.Email, user.Name, user.Picture, verified}
+			if got != test.want {
+				t.Errorf("user = %q, want %q", got, test.want)
+			}
+			if user.Provider != "example" {
+				t.Errorf("provider = %q, want example", user.Provider)
+			}
+		})
+	}
+}
+
+func TestFetchUserErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		fields FieldMapping
+		want   string
+	}{
+		{"missing id", `{"email": "a@example.com"}`, FieldMapping{}, `no value at "id"`},
+		{"object id", `{"id": {"value": 1}}`, FieldMapping{}, "scalar"},
+		{"bad path", `{"id": 1}`, FieldMapping{Email: "emails[x]"}, "invalid index"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := userInfoServer(t, test.body)
+			p := &GenericProvider{
+				Config:       &Config{UserInfoURL: server.URL, Fields: test.fields},
+				Oauth2Config: &oauth2.Config{},
+			}
+
+			_, err := p.fetchUser(context.Background(), &oauth2.Token{AccessToken: "token"})
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("err = %v, want it to mention %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	decoder := json.NewDecoder(strings.NewReader(`{"a": {"b": [1, {"c": null}]}, "d.e": 2.5}`))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"a.b[0]":     "1",
+		"$.a.b[1].c": "",
+		"a.b[5]":     "",
+		"a.x.y":      "",
+		"['d.e']":    "2.5",
+	}
+	for path, want := range tests {
+		got, err := lookup(document, path)
+		if err != nil || got != want {
+			t.Errorf("lookup(%q) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+}
+
+// TestUserHandlerFailure checks that a failed userinfo request reaches the
+// failure handler without writing the error to the response.
+func TestUserHandlerFailure(t *testing.T) {
+	server := userInfoServer(t, `not json`)
+	p := &GenericProvider{
+		Config:       &Config{Name: "example", UserInfoURL: server.URL},
+		Oauth2Config: &oauth2.Config{},
+	}
+
+	var failed error
+	failure := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed = gologin.ErrorFromContext(r.Context())
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("reached the next handler")
+	})
+
+	ctx := oauth2Login.WithToken(context.Background(), &oauth2.Token{AccessToken: "token"})
+	ctx = flow.WithFailureHandler(ctx, failure)
+	w := httptest.NewRecorder()
+	p.userHandler(next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/example/callback", nil).WithContext(ctx))
+	if w.Code != http.StatusUnauthorized || failed == nil || w.Body.Len() != 0 {
+		t.Errorf("userHandler = %d %q with %v, want the failure handler", w.Code, w.Body.String(), failed)
+	}
+}
@@ -1,49 +1,77 @@
 package githubprovider
 
 import (
-	"github.com/dghubble/gologin/v2"
+	"context"
 	"github.com/dghubble/gologin/v2/github"
-	"github.com/dghubble/sessions"
+	oauth2Login "github.com/dghubble/gologin/v2/oauth2"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/flow"
 	"github.com/ozankasikci/one-oauth/internal/provider"
+	"github.com/ozankasikci/one-oauth/internal/session"
 	"golang.org/x/oauth2"
-	githubOAuth2 "golang.org/x/oauth2/github"
 	"net/http"
-	"net/url"
 	"strconv"
 )
 
 type Config struct {
+	// Name is the provider instance name reported as User.Provider.
+	Name                       string
 	CookieSessionName          string
 	CookieSessionSecret        string
-	CookieSessionUserKey       string
 	ClientID                   string
 	ClientSecret               string
 	GithubRedirectURL          string
 	UpstreamSuccessRedirectURL string
 	Scopes                     []string
+	// CookieSessionKeys encrypt session cookies, newest first; older keys
+	// only open cookies issued before a rotation. Defaults to a single key
+	// made of CookieSessionSecret.
+	CookieSessionKeys []session.Key
+	// SessionStore holds server-side sessions; defaults to an in-memory store.
+	SessionStore    session.Store
+	SessionLifetime session.Lifetime
+	// Cookie sets the login and session cookie attributes; defaults to
+	// cookie.Default, which requires HTTPS.
+	Cookie *cookie.Options
+	// DisablePKCE omits the PKCE code challenge.
+	DisablePKCE bool
+	// Organizations, Teams ("org/team-slug") and Repositories
+	// ("owner/repo") restrict sign in to users belonging to any of them,
+	// checked with the user's token; organizations and teams need the
+	// read:org scope. Matched organizations and teams become the user's
+	// groups.
+	Organizations []string
+	Teams         []string
+	Repositories  []string
+	// EnterpriseURL is the base URL of a GitHub Enterprise Server, e.g.
+	// "https://github.example.com/".
+	EnterpriseURL string
+	// APIURL overrides the REST API base URL, which defaults to
+	// https://api.github.com/ or EnterpriseURL's /api/v3/.
+	APIURL string
 }
 
+// verifiedEmailKey stores the primary verified email from /user/emails
+type verifiedEmailKey struct{}
+
 type GithubProvider struct {
+	session.Provider
 	Config       *Config
-	StateConfig  gologin.CookieConfig
+	StateConfig  cookie.Config
 	Oauth2Config *oauth2.Config
-	CookieStore  *sessions.CookieStore
 }
 
 func (t GithubProvider) LoginHandler() http.Handler {
-	return github.StateHandler(t.StateConfig, github.LoginHandler(t.Oauth2Config, nil))
-}
-
-func (t GithubProvider) LogoutHandler() http.Handler {
-	return t.logoutHandler()
+	options := flow.Options{DisablePKCE: t.Config.DisablePKCE}
+	return flow.LoginHandler(t.StateConfig, t.Oauth2Config, options)
 }
 
 func (t GithubProvider) CallbackHandler() http.Handler {
-	return github.StateHandler(t.StateConfig, github.CallbackHandler(t.Oauth2Config, t.issueSession(), nil))
+	return flow.CallbackHandler(t.StateConfig, t.Oauth2Config, t.userHandler(t.issueSession()), nil)
 }
 
-func (t GithubProvider) IsAuthenticatedHandler() http.Handler {
-	return t.IsAuthenticatedHandler()
+func (t GithubProvider) RedirectURL() string {
+	return t.Oauth2Config.RedirectURL
 }
 
 func New(config *Config) provider.ProviderInterface {
@@ -51,91 +79,130 @@ func New(config *Config) provider.ProviderInterface {
 		ClientID:     config.ClientID,
 		ClientSecret: config.ClientSecret,
 		RedirectURL:  config.GithubRedirectURL,
-		Endpoint:     githubOAuth2.Endpoint,
+		Endpoint:     endpoint(config.EnterpriseURL),
 		Scopes:       config.Scopes,
 	}
 
-	cookieStore := sessions.NewCookieStore([]byte(config.CookieSessionSecret), nil)
+	cookieOptions := cookie.Default
+	if config.Cookie != nil {
+		cookieOptions = *config.Cookie
+	}
+
+	sessionConfig := session.ProviderConfig{
+		CookieName: config.CookieSessionName,
+		Keys:       config.CookieSessionKeys,
+		Secret:     config.CookieSessionSecret,
+		Store:      config.SessionStore,
+		Lifetime:   config.SessionLifetime,
+		Cookie:     cookieOptions,
+	}
 
-	// state param cookies require HTTPS by default; disable for localhost development
-	stateConfig := gologin.DebugOnlyCookieConfig
+	stateConfig := cookieOptions.LoginConfig(flow.LoginCookieName(config.Name))
 
 	return GithubProvider{
 		Config:       config,
 		StateConfig:  stateConfig,
 		Oauth2Config: oauth2Config,
-		CookieStore:  cookieStore,
+		Provider:     session.NewProvider(sessionConfig, session.StaticConfig(oauth2Config)),
 	}
 }
 
-// issueSession issues a cookie session after successful github login
-func (t *GithubProvider) issueSession() http.Handler {
+// userHandler fetches the authenticated GitHub user with the token from the
+// ctx and adds it to the ctx, like gologin's github.CallbackHandler.
+func (t *GithubProvider) userHandler(success http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		githubUser, err := github.UserFromContext(ctx)
+		token, err := oauth2Login.TokenFromContext(ctx)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			flow.Fail(w, r, err)
 			return
 		}
 
-		cookie := t.CookieStore.New(t.Config.CookieSessionName)
-		cookie.Values[t.Config.CookieSessionUserKey] = githubUser.ID
-		err = cookie.Save(w)
+		client, err := t.client(ctx, token)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			flow.Fail(w, r, err)
 			return
 		}
 
-		successRedirectUrl, err := url.Parse(t.Config.UpstreamSuccessRedirectURL)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		githubUser, resp, err := client.Users.Get(ctx, "")
+		if err != nil || resp.StatusCode != http.StatusOK || githubUser.ID == nil {
+			flow.Fail(w, r, github.ErrUnableToGetGithubUser)
 			return
 		}
 
-		q := successRedirectUrl.Query()
-		q.Set("email", githubUser.GetEmail())
-		q.Set("name", githubUser.GetName())
-		q.Set("id", strconv.FormatInt(githubUser.GetID(), 10))
-		q.Set("picture", githubUser.GetAvatarURL())
-		q.Set("company", githubUser.GetCompany())
-		q.Set("location", githubUser.GetLocation())
-		q.Set("bio", githubUser.GetBio())
-		q.Set("bio", githubUser.GetURL())
-		successRedirectUrl.RawQuery = q.Encode()
-
-		http.Redirect(w, r, successRedirectUrl.String(), http.StatusFound)
+		// needs the user:email scope; without it the public email is kept
+		emails, _, err := client.Users.ListEmails(ctx, nil)
+		if err == nil {
+			for _, email := range emails {
+				if email.GetPrimary() && email.GetVerified() {
+					ctx = context.WithValue(ctx, verifiedEmailKey{}, email.GetEmail())
+				}
+			}
+		}
+
+		ctx = github.WithUser(ctx, githubUser)
+		success.ServeHTTP(w, r.WithContext(ctx))
 	}
 
 	return http.HandlerFunc(fn)
 }
 
-// logoutHandler destroys the session on POSTs and redirects to home.
-func (t *GithubProvider) logoutHandler() http.Handler {
+// issueSession issues a cookie session after successful github login
+func (t *GithubProvider) issueSession() http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			t.CookieStore.Destroy(w, t.Config.CookieSessionName)
+		ctx := r.Context()
+		githubUser, err := github.UserFromContext(ctx)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
 		}
-	}
 
-	return http.HandlerFunc(fn)
-}
+		// the public profile email carries no verification flag
+		user := &provider.User{
+			Subject:  strconv.FormatInt(githubUser.GetID(), 10),
+			Provider: t.Config.Name,
+			Email:    githubUser.GetEmail(),
+			Name:     githubUser.GetName(),
+			Picture:  githubUser.GetAvatarURL(),
+			Raw:      provider.RawClaims(githubUser),
+		}
+		if email, ok := ctx.Value(verifiedEmailKey{}).(string); ok {
+			user.Email = email
+			user.EmailVerified = true
+		}
 
-func (t *GithubProvider) isAuthenticatedHandler() http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		if t.isAuthenticated(r) == true {
-			w.WriteHeader(http.StatusOK)
-		} else {
-			w.WriteHeader(http.StatusProxyAuthRequired)
+		token, err := oauth2Login.TokenFromContext(ctx)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
 		}
-	}
 
-	return http.HandlerFunc(fn)
-}
+		if t.restricted() {
+			groups, member, err := t.membership(ctx, token)
+			if err != nil {
+				flow.Fail(w, r, err)
+				return
+			}
+			if !member {
+				provider.AccessDenied(w, r, user, errNotMember)
+				return
+			}
+			user.Groups = groups
+		}
 
-// isAuthenticated returns true if the user has a signed session cookie.
-func (t *GithubProvider) isAuthenticated(r *http.Request) bool {
-	if _, err := t.CookieStore.Get(r, t.Config.CookieSessionName); err == nil {
-		return true
+		if err := provider.Authorize(r, user); err != nil {
+			provider.AccessDenied(w, r, user, err)
+			return
+		}
+
+		_, err = t.Sessions.Issue(w, r, user, token)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		provider.Deliver(w, r, t.Config.UpstreamSuccessRedirectURL, user)
 	}
-	return false
+
+	return http.HandlerFunc(fn)
 }
@@ -0,0 +1,160 @@
+package githubprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	githubAPI "github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+	githubOAuth2 "golang.org/x/oauth2/github"
+	"net/http"
+	"strings"
+)
+
+var errNotMember = errors.New("github: not a member of an allowed organization, team or repository")
+
+// endpoint returns the OAuth2 endpoint of github.com or the Enterprise
+// Server at enterpriseURL.
+func endpoint(enterpriseURL string) oauth2.Endpoint {
+	if enterpriseURL == "" {
+		return githubOAuth2.Endpoint
+	}
+	base := strings.TrimSuffix(enterpriseURL, "/")
+	return oauth2.Endpoint{
+		AuthURL:  base + "/login/oauth/authorize",
+		TokenURL: base + "/login/oauth/access_token",
+	}
+}
+
+// client returns an API client authorized with token.
+func (t *GithubProvider) client(ctx context.Context, token *oauth2.Token) (*githubAPI.Client, error) {
+	httpClient := t.Oauth2Config.Client(ctx, token)
+
+	apiURL := t.Config.APIURL
+	if apiURL == "" && t.Config.EnterpriseURL != "" {
+		apiURL = strings.TrimSuffix(t.Config.EnterpriseURL, "/") + "/api/v3/"
+	}
+	if apiURL == "" {
+		return githubAPI.NewClient(httpClient), nil
+	}
+	return githubAPI.NewEnterpriseClient(apiURL, apiURL, httpClient)
+}
+
+// restricted reports whether sign in requires a membership.
+func (t *GithubProvider) restricted() bool {
+	return len(t.Config.Organizations) > 0 || len(t.Config.Teams) > 0 || len(t.Config.Repositories) > 0
+}
+
+// membership returns the configured organizations and teams the token's
+// user belongs to, and whether any configured organization, team or
+// repository matched.
+func (t *GithubProvider) membership(ctx context.Context, token *oauth2.Token) ([]string, bool, error) {
+	client, err := t.client(ctx, token)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var groups []string
+	member := false
+
+	if len(t.Config.Organizations) > 0 {
+		orgs, err := userOrganizations(ctx, client)
+		if err != nil {
+			return nil, false, fmt.Errorf("github: listing organizations: %v", err)
+		}
+		for _, org := range t.Config.Organizations {
+			if orgs[strings.ToLower(org)] {
+				groups = append(groups, org)
+				member = true
+			}
+		}
+	}
+
+	if len(t.Config.Teams) > 0 {
+		teams, err := userTeams(ctx, client)
+		if err != nil {
+			return nil, false, fmt.Errorf("github: listing teams: %v", err)
+		}
+		for _, team := range t.Config.Teams {
+			if teams[strings.ToLower(team)] {
+				groups = append(groups, team)
+				member = true
+			}
+		}
+	}
+
+	// repositories grant no groups, so they are only checked until one
+	// matches
+	for i := 0; i < len(t.Config.Repositories) && !member; i++ {
+		repository := t.Config.Repositories[i]
+		member, err = collaborator(ctx, client, repository)
+		if err != nil {
+			return nil, false, fmt.Errorf("github: checking %s: %v", repository, err)
+		}
+	}
+
+	return groups, member, nil
+}
+
+// userOrganizations returns the lowercased logins of the user's
+// organizations.
+func userOrganizations(ctx context.Context, client *githubAPI.Client) (map[string]bool, error) {
+	orgs := map[string]bool{}
+	opt := &githubAPI.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.Organizations.List(ctx, "", opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, org := range page {
+			orgs[strings.ToLower(org.GetLogin())] = true
+		}
+		if resp.NextPage == 0 {
+			return orgs, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// userTeams returns the user's teams as lowercased "org/team-slug".
+func userTeams(ctx context.Context, client *githubAPI.Client) (map[string]bool, error) {
+	teams := map[string]bool{}
+	opt := &githubAPI.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.Teams.ListUserTeams(ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, team := range page {
+			if team.Organization == nil {
+				continue
+			}
+			teams[strings.ToLower(team.Organization.GetLogin()+"/"+team.GetSlug())] = true
+		}
+		if resp.NextPage == 0 {
+			return teams, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// collaborator reports whether the user may push to the "owner/repo"
+// repository, or read it if it is private.
+func collaborator(ctx context.Context, client *githubAPI.Client, repository string) (bool, error) {
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) != 2 {
+		return false, fmt.Errorf("repository must be owner/name")
+	}
+
+	repo, resp, err := client.Repositories.Get(ctx, parts[0], parts[1])
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		// private repositories are hidden from users without access
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	permissions := repo.GetPermissions()
+	return permissions["push"] || repo.GetPrivate() && permissions["pull"], nil
+}
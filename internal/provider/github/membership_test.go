@@ -0,0 +1,261 @@
+package githubprovider
+
+import (
+	"context"
+	"fmt"
+	"github.com/dghubble/gologin/v2/github"
+	oauth2Login "github.com/dghubble/gologin/v2/oauth2"
+	githubAPI "github.com/google/go-github/github"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeGitHub serves the REST API endpoints used for membership checks under
+// prefix, two items per page, and counts requests by path.
+type fakeGitHub struct {
+	*httptest.Server
+	orgs     []string
+	teams    []string
+	repos    map[string]string
+	requests map[string]int
+}
+
+func newFakeGitHub(t *testing.T, prefix string) *fakeGitHub {
+	t.Helper()
+	api := &fakeGitHub{
+		orgs:  []string{"Acme", "Other", "Example-Org"},
+		teams: []string{"acme/backend", "acme/ops", "other/Admins"},
+		repos: map[string]string{
+			"acme/push":      `{"private": false, "permissions": {"pull": true, "push": true}}`,
+			"acme/public":    `{"private": false, "permissions": {"pull": true, "push": false}}`,
+			"acme/private":   `{"private": true, "permissions": {"pull": true, "push": false}}`,
+			"acme/forbidden": "error",
+		},
+		requests: map[string]int{},
+	}
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, `{"message": "Bad credentials"}`, http.StatusUnauthorized)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			http.NotFound(w, r)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, prefix)
+		api.requests[path]++
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case path == "user/orgs":
+			api.page(w, r, api.orgs, func(org string) string {
+				return fmt.Sprintf(`{"login": %q}`, org)
+			})
+		case path == "user/teams":
+			api.page(w, r, api.teams, func(team string) string {
+				parts := strings.SplitN(team, "/", 2)
+				return fmt.Sprintf(`{"slug": %q, "organization": {"login": %q}}`, parts[1], parts[0])
+			})
+		case strings.HasPrefix(path, "repos/"):
+			repo, ok := api.repos[strings.TrimPrefix(path, "repos/")]
+			switch {
+			case !ok:
+				http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+			case repo == "error":
+				http.Error(w, `{"message": "Server Error"}`, http.StatusInternalServerError)
+			default:
+				w.Write([]byte(repo))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}
+	api.Server = httptest.NewServer(http.HandlerFunc(fn))
+	t.Cleanup(api.Close)
+	return api
+}
+
+// page writes the requested page of items, linking the next one.
+func (t *fakeGitHub) page(w http.ResponseWriter, r *http.Request, items []string, encode func(string) string) {
+	const perPage = 2
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	start := (page - 1) * perPage
+	end := start + perPage
+	if end < len(items) {
+		next := *r.URL
+		query := next.Query()
+		query.Set("page", strconv.Itoa(page+1))
+		next.RawQuery = query.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s>; rel="next"`, t.URL, next.String()))
+	} else {
+		end = len(items)
+	}
+
+	var encoded []string
+	for _, item := range items[start:end] {
+		encoded = append(encoded, encode(item))
+	}
+	w.Write([]byte("[" + strings.Join(encoded, ",") + "]"))
+}
+
+func newTestProvider(config *Config) *GithubProvider {
+	config.CookieSessionSecret = "test cookie secret, at least 32 bytes"
+	config.Cookie = &cookie.Dev
+	config.UpstreamSuccessRedirectURL = "https://app.example.com/"
+	p := New(config).(GithubProvider)
+	return &p
+}
+
+var token = &oauth2.Token{AccessToken: "token"}
+
+func TestMembership(t *testing.T) {
+	api := newFakeGitHub(t, "/")
+
+	tests := []struct {
+		name   string
+		config Config
+		groups []string
+		member bool
+	}{
+		{"organization on a later page", Config{Organizations: []string{"example-org"}}, []string{"example-org"}, true},
+		{"organizations", Config{Organizations: []string{"nope", "ACME"}}, []string{"ACME"}, true},
+		{"no organization", Config{Organizations: []string{"nope"}}, nil, false},
+		{"team on a later page", Config{Teams: []string{"other/admins"}}, []string{"other/admins"}, true},
+		{"teams and organizations", Config{Organizations: []string{"acme"}, Teams: []string{"acme/backend", "acme/web"}}, []string{"acme", "acme/backend"}, true},
+		{"team of another organization", Config{Teams: []string{"other/backend"}}, nil, false},
+		{"pushable repository", Config{Repositories: []string{"acme/push"}}, nil, true},
+		{"readable private repository", Config{Repositories: []string{"acme/private"}}, nil, true},
+		{"readable public repository", Config{Repositories: []string{"acme/public"}}, nil, false},
+		{"hidden repository", Config{Repositories: []string{"acme/hidden"}}, nil, false},
+		{"any repository", Config{Repositories: []string{"acme/hidden", "acme/push"}}, nil, true},
+		{"repository after an organization", Config{Organizations: []string{"nope"}, Repositories: []string{"acme/private"}}, nil, true},
+	}
+
+	for _, test := range tests {
+		config := test.config
+		config.APIURL = api.URL + "/"
+		p := newTestProvider(&config)
+
+		groups, member, err := p.membership(context.Background(), token)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if member != test.member || fmt.Sprint(groups) != fmt.Sprint(test.groups) {
+			t.Errorf("%s: membership = %v, %v, want %v, %v", test.name, groups, member, test.groups, test.member)
+		}
+	}
+
+	if api.requests["user/orgs"] == 0 || api.requests["user/teams"] == 0 {
+		t.Errorf("requests = %v", api.requests)
+	}
+}
+
+func TestMembershipStopsAtMatchingRepository(t *testing.T) {
+	api := newFakeGitHub(t, "/")
+	p := newTestProvider(&Config{APIURL: api.URL + "/", Organizations: []string{"acme"}, Repositories: []string{"acme/push"}})
+
+	if _, member, err := p.membership(context.Background(), token); err != nil || !member {
+		t.Fatalf("membership = %v, %v", member, err)
+	}
+	if n := api.requests["repos/acme/push"]; n != 0 {
+		t.Errorf("checked the repository %d times after the organization matched", n)
+	}
+}
+
+func TestMembershipErrors(t *testing.T) {
+	api := newFakeGitHub(t, "/")
+
+	tests := []struct {
+		name   string
+		config Config
+		token  *oauth2.Token
+		want   string
+	}{
+		{"bad credentials", Config{Organizations: []string{"acme"}}, &oauth2.Token{AccessToken: "bad"}, "listing organizations"},
+		{"teams", Config{Teams: []string{"acme/ops"}}, &oauth2.Token{AccessToken: "bad"}, "listing teams"},
+		{"repository error", Config{Repositories: []string{"acme/forbidden"}}, token, "checking acme/forbidden"},
+		{"repository name", Config{Repositories: []string{"acme"}}, token, "owner/name"},
+	}
+	for _, test := range tests {
+		config := test.config
+		config.APIURL = api.URL + "/"
+		if _, member, err := newTestProvider(&config).membership(context.Background(), test.token); err == nil || member || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: membership = %v, %v, want an error mentioning %q", test.name, member, err, test.want)
+		}
+	}
+}
+
+func TestEnterpriseServer(t *testing.T) {
+	api := newFakeGitHub(t, "/api/v3/")
+	p := newTestProvider(&Config{EnterpriseURL: api.URL + "/", Organizations: []string{"acme"}})
+
+	if p.Oauth2Config.Endpoint.AuthURL != api.URL+"/login/oauth/authorize" || p.Oauth2Config.Endpoint.TokenURL != api.URL+"/login/oauth/access_token" {
+		t.Errorf("endpoint = %+v", p.Oauth2Config.Endpoint)
+	}
+	client, err := p.client(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.BaseURL.String() != api.URL+"/api/v3/" {
+		t.Errorf("API base = %s", client.BaseURL)
+	}
+	if _, member, err := p.membership(context.Background(), token); err != nil || !member {
+		t.Errorf("membership = %v, %v", member, err)
+	}
+
+	// an explicit API URL wins
+	p = newTestProvider(&Config{EnterpriseURL: "https://github.example.com", APIURL: api.URL + "/api/v3/"})
+	if client, err := p.client(context.Background(), token); err != nil || client.BaseURL.String() != api.URL+"/api/v3/" {
+		t.Errorf("API base = %v, %v", client.BaseURL, err)
+	}
+
+	if endpoint := endpoint(""); endpoint.AuthURL != "https://github.com/login/oauth/authorize" {
+		t.Errorf("github.com endpoint = %+v", endpoint)
+	}
+}
+
+// TestIssueSessionDenied checks that non-members get the access denied page
+// and no session, and members a session with their groups.
+func TestIssueSessionDenied(t *testing.T) {
+	api := newFakeGitHub(t, "/")
+
+	callback := func(p *GithubProvider) *httptest.ResponseRecorder {
+		ctx := oauth2Login.WithToken(context.Background(), token)
+		ctx = github.WithUser(ctx, &githubAPI.User{ID: githubAPI.Int64(1), Login: githubAPI.String("alice")})
+		w := httptest.NewRecorder()
+		p.issueSession().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/github/callback", nil).WithContext(ctx))
+		return w
+	}
+
+	denied := newTestProvider(&Config{Name: "github", APIURL: api.URL + "/", Teams: []string{"acme/web"}})
+	w := callback(denied)
+	if w.Code != http.StatusForbidden || len(w.Result().Cookies()) != 0 {
+		t.Errorf("non-member = %d with cookies %v, want 403 without a session", w.Code, w.Result().Cookies())
+	}
+	if sessions, _ := denied.Sessions.Store.List(context.Background()); len(sessions) != 0 {
+		t.Errorf("non-member got %d sessions", len(sessions))
+	}
+
+	allowed := newTestProvider(&Config{Name: "github", APIURL: api.URL + "/", Teams: []string{"acme/ops"}})
+	w = callback(allowed)
+	if w.Code != http.StatusFound {
+		t.Fatalf("member = %d %s", w.Code, w.Body.String())
+	}
+	sessions, err := allowed.Sessions.Store.List(context.Background())
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("sessions = %v, %v", sessions, err)
+	}
+	if user := sessions[0].User; user.Subject != "1" || fmt.Sprint(user.Groups) != "[acme/ops]" {
+		t.Errorf("user = %+v", user)
+	}
+}
@@ -0,0 +1,108 @@
+package googleprovider
+
+import (
+	"context"
+	"fmt"
+	googleOAuth2 "golang.org/x/oauth2/google"
+	admin "google.golang.org/api/admin/directory/v1"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultGroupsCacheTTL = 10 * time.Minute
+
+// Directory resolves a user's Google Groups through the Admin SDK Directory
+// API, as a service account with domain-wide delegation impersonating a
+// Workspace administrator. Results are cached per user.
+type Directory struct {
+	// BaseURL overrides the API endpoint, e.g. with a fake server in tests.
+	BaseURL string
+	// CacheTTL is how long groups are cached; defaults to 10 minutes.
+	CacheTTL time.Duration
+
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedGroups
+}
+
+type cachedGroups struct {
+	groups  []string
+	expires time.Time
+}
+
+// NewDirectory returns a Directory authorized with the JSON key of a service
+// account, acting as adminEmail. The key's token_uri is honored.
+func NewDirectory(serviceAccountJSON []byte, adminEmail string) (*Directory, error) {
+	config, err := googleOAuth2.JWTConfigFromJSON(serviceAccountJSON, admin.AdminDirectoryGroupReadonlyScope)
+	if err != nil {
+		return nil, fmt.Errorf("google: service account: %v", err)
+	}
+	config.Subject = adminEmail
+
+	return &Directory{
+		client: config.Client(context.Background()),
+		cache:  map[string]cachedGroups{},
+	}, nil
+}
+
+// Groups returns the email addresses of the groups email is a direct or
+// indirect member of.
+func (t *Directory) Groups(ctx context.Context, email string) ([]string, error) {
+	key := strings.ToLower(email)
+	now := time.Now()
+
+	t.mu.Lock()
+	entry, ok := t.cache[key]
+	t.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.groups, nil
+	}
+
+	groups, err := t.fetch(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := t.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultGroupsCacheTTL
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// drop expired entries now and then so the cache follows active users
+	if len(t.cache) >= 1024 {
+		for k, v := range t.cache {
+			if now.After(v.expires) {
+				delete(t.cache, k)
+			}
+		}
+	}
+	t.cache[key] = cachedGroups{groups: groups, expires: now.Add(ttl)}
+	return groups, nil
+}
+
+func (t *Directory) fetch(ctx context.Context, email string) ([]string, error) {
+	service, err := admin.New(t.client)
+	if err != nil {
+		return nil, err
+	}
+	if t.BaseURL != "" {
+		service.BasePath = strings.TrimSuffix(t.BaseURL, "/") + "/admin/directory/v1/"
+	}
+
+	groups := []string{}
+	err = service.Groups.List().UserKey(email).Pages(ctx, func(page *admin.Groups) error {
+		for _, group := range page.Groups {
+			groups = append(groups, group.Email)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("google: listing groups of %s: %v", email, err)
+	}
+	return groups, nil
+}
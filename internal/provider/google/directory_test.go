@@ -0,0 +1,297 @@
+package googleprovider
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/dghubble/gologin/v2"
+	"github.com/dghubble/gologin/v2/google"
+	oauth2Login "github.com/dghubble/gologin/v2/oauth2"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"github.com/ozankasikci/one-oauth/internal/jwt"
+	"golang.org/x/oauth2"
+	googleAPI "google.golang.org/api/oauth2/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDirectory serves a service account token endpoint and the Directory
+// API groups list, one group per page.
+type fakeDirectory struct {
+	*httptest.Server
+	groups map[string][]string
+	lists  int32
+}
+
+func newFakeDirectory(t *testing.T) *fakeDirectory {
+	t.Helper()
+	directory := &fakeDirectory{groups: map[string][]string{
+		"alice@example.com": {"eng@example.com", "admins@example.com"},
+	}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, `{"error": "unsupported_grant_type"}`, http.StatusBadRequest)
+			return
+		}
+		assertion, err := jwt.Parse(r.FormValue("assertion"))
+		if err != nil || assertion.Claims.String("sub") != "admin@example.com" {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "directory", "token_type": "Bearer", "expires_in": 3600}`))
+	})
+	mux.HandleFunc("/admin/directory/v1/groups", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer directory" {
+			http.Error(w, `{"error": {"code": 401}}`, http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt32(&directory.lists, 1)
+		groups, ok := directory.groups[r.URL.Query().Get("userKey")]
+		if !ok {
+			http.Error(w, `{"error": {"code": 404, "message": "Resource Not Found: userKey"}}`, http.StatusNotFound)
+			return
+		}
+
+		page := 0
+		fmt.Sscan(r.URL.Query().Get("pageToken"), &page)
+		response := map[string]interface{}{"groups": []map[string]string{}}
+		if page < len(groups) {
+			response["groups"] = []map[string]string{{"email": groups[page]}}
+		}
+		if page+1 < len(groups) {
+			response["nextPageToken"] = fmt.Sprint(page + 1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+	directory.Server = httptest.NewServer(mux)
+	t.Cleanup(directory.Close)
+	return directory
+}
+
+// serviceAccount returns the JSON key of a service account using the token
+// endpoint of t.
+func (t *fakeDirectory) serviceAccount(test *testing.T) []byte {
+	test.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		test.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	account, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "proxy@project.iam.gserviceaccount.com",
+		"private_key":  string(keyPEM),
+		"token_uri":    t.URL + "/token",
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	return account
+}
+
+func newTestDirectory(t *testing.T, fake *fakeDirectory) *Directory {
+	t.Helper()
+	directory, err := NewDirectory(fake.serviceAccount(t), "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory.BaseURL = fake.URL
+	return directory
+}
+
+func TestDirectoryGroups(t *testing.T) {
+	fake := newFakeDirectory(t)
+	directory := newTestDirectory(t, fake)
+
+	groups, err := directory.Groups(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(groups) != "[eng@example.com admins@example.com]" {
+		t.Errorf("groups = %v, want both pages", groups)
+	}
+
+	fake.groups["bob@example.com"] = nil
+	if groups, err := directory.Groups(context.Background(), "bob@example.com"); err != nil || groups == nil || len(groups) != 0 {
+		t.Errorf("groups without any = %#v, %v, want an empty list", groups, err)
+	}
+
+	if _, err := directory.Groups(context.Background(), "mallory@example.com"); err == nil || !strings.Contains(err.Error(), "mallory@example.com") {
+		t.Errorf("err = %v, want the failed lookup", err)
+	}
+
+	if _, err := NewDirectory([]byte(`{"type": "authorized_user"}`), "admin@example.com"); err == nil {
+		t.Error("accepted a key that is not a service account's")
+	}
+}
+
+func TestDirectoryCache(t *testing.T) {
+	fake := newFakeDirectory(t)
+	directory := newTestDirectory(t, fake)
+	ctx := context.Background()
+
+	if _, err := directory.Groups(ctx, "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	lists := atomic.LoadInt32(&fake.lists)
+
+	// cached per lowercased email until the TTL
+	fake.groups["alice@example.com"] = []string{"changed@example.com"}
+	groups, err := directory.Groups(ctx, "Alice@Example.com")
+	if err != nil || fmt.Sprint(groups) != "[eng@example.com admins@example.com]" {
+		t.Errorf("cached groups = %v, %v", groups, err)
+	}
+	if n := atomic.LoadInt32(&fake.lists); n != lists {
+		t.Errorf("%d list requests within the TTL, want %d", n, lists)
+	}
+
+	directory.CacheTTL = time.Nanosecond
+	directory.cache = map[string]cachedGroups{}
+	for i := 0; i < 2; i++ {
+		if groups, err := directory.Groups(ctx, "alice@example.com"); err != nil || fmt.Sprint(groups) != "[changed@example.com]" {
+			t.Errorf("groups after the TTL = %v, %v", groups, err)
+		}
+	}
+	if n := atomic.LoadInt32(&fake.lists); n != lists+2 {
+		t.Errorf("%d list requests after the TTL, want %d", n, lists+2)
+	}
+
+	// failures are not cached
+	directory.CacheTTL = time.Hour
+	if _, err := directory.Groups(ctx, "carol@example.com"); err == nil {
+		t.Fatal("want an error")
+	}
+	fake.groups["carol@example.com"] = []string{"carol-group@example.com"}
+	if groups, err := directory.Groups(ctx, "carol@example.com"); err != nil || len(groups) != 1 {
+		t.Errorf("groups after a failure = %v, %v", groups, err)
+	}
+}
+
+func newTestProvider(config *Config) *GoogleProvider {
+	config.Name = "google"
+	config.CookieSessionSecret = "test cookie secret, at least 32 bytes"
+	config.Cookie = &cookie.Dev
+	config.UpstreamSuccessRedirectURL = "https://app.example.com/"
+	p := New(config).(GoogleProvider)
+	return &p
+}
+
+// issueSession runs the issueSession handler of p as if the userinfo was
+// googleUser and the ID token carried hd.
+func issueSession(p *GoogleProvider, googleUser *googleAPI.Userinfoplus, hd string) *httptest.ResponseRecorder {
+	ctx := oauth2Login.WithToken(context.Background(), &oauth2.Token{AccessToken: "token"})
+	ctx = google.WithUser(ctx, googleUser)
+	ctx = context.WithValue(ctx, claimsKey{}, jwt.Claims{"hd": hd})
+	w := httptest.NewRecorder()
+	p.issueSession().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/google/callback", nil).WithContext(ctx))
+	return w
+}
+
+func TestIssueSessionHostedDomain(t *testing.T) {
+	alice := &googleAPI.Userinfoplus{Id: "1", Email: "alice@example.com", Hd: "example.com"}
+
+	tests := []struct {
+		name    string
+		domains []string
+		hd      string
+		allowed bool
+	}{
+		{"any domain", nil, "", true},
+		{"allowed domain", []string{"other.com", "example.com"}, "Example.com", true},
+		{"other domain", []string{"example.com"}, "evil.com", false},
+		// the userinfo hd is not signed, only the ID token's counts
+		{"no hd claim", []string{"example.com"}, "", false},
+	}
+
+	for _, test := range tests {
+		p := newTestProvider(&Config{HostedDomains: test.domains})
+		w := issueSession(p, alice, test.hd)
+		sessions, _ := p.Sessions.Store.List(context.Background())
+		if test.allowed && (w.Code != http.StatusFound || len(sessions) != 1) {
+			t.Errorf("%s: %d with %d sessions, want a session", test.name, w.Code, len(sessions))
+		}
+		if !test.allowed && (w.Code != http.StatusForbidden || len(sessions) != 0) {
+			t.Errorf("%s: %d with %d sessions, want 403 without a session", test.name, w.Code, len(sessions))
+		}
+	}
+}
+
+func TestIssueSessionGroups(t *testing.T) {
+	fake := newFakeDirectory(t)
+	p := newTestProvider(&Config{Directory: newTestDirectory(t, fake)})
+
+	w := issueSession(p, &googleAPI.Userinfoplus{Id: "1", Email: "alice@example.com"}, "")
+	sessions, err := p.Sessions.Store.List(context.Background())
+	if w.Code != http.StatusFound || err != nil || len(sessions) != 1 {
+		t.Fatalf("%d with sessions %v, %v", w.Code, sessions, err)
+	}
+	if groups := sessions[0].User.Groups; fmt.Sprint(groups) != "[eng@example.com admins@example.com]" {
+		t.Errorf("groups = %v", groups)
+	}
+
+	// a failed lookup issues no session
+	p = newTestProvider(&Config{Directory: newTestDirectory(t, fake)})
+	w = issueSession(p, &googleAPI.Userinfoplus{Id: "2", Email: "mallory@example.com"}, "")
+	if sessions, _ := p.Sessions.Store.List(context.Background()); w.Code == http.StatusFound || len(sessions) != 0 {
+		t.Errorf("failed lookup = %d with %d sessions", w.Code, len(sessions))
+	}
+}
+
+// TestCallbackFailure checks that failures after the callback reach the
+// failure handler with their error, without writing it to the response.
+func TestCallbackFailure(t *testing.T) {
+	var failed error
+	failure := func(w http.ResponseWriter, r *http.Request) {
+		failed = gologin.ErrorFromContext(r.Context())
+		http.Redirect(w, r, "/signin?error=failed", http.StatusFound)
+	}
+	serve := func(handler http.Handler, ctx context.Context) *httptest.ResponseRecorder {
+		failed = nil
+		ctx = flow.WithFailureHandler(ctx, http.HandlerFunc(failure))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/google/callback", nil).WithContext(ctx))
+		return w
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("reached the next handler")
+	})
+	p := newTestProvider(&Config{})
+	token := oauth2Login.WithToken(context.Background(), &oauth2.Token{AccessToken: "token"})
+
+	// no nonce for the ID token
+	w := serve(p.verifyHandler(next), token)
+	if w.Code != http.StatusFound || failed == nil || strings.Contains(w.Body.String(), failed.Error()) {
+		t.Errorf("verify = %d %q with %v, want the failure handler", w.Code, w.Body.String(), failed)
+	}
+
+	// no token for the userinfo
+	w = serve(p.userHandler(next), context.Background())
+	if w.Code != http.StatusFound || failed == nil {
+		t.Errorf("user = %d with %v, want the failure handler", w.Code, failed)
+	}
+
+	// a failed group lookup
+	fake := newFakeDirectory(t)
+	p = newTestProvider(&Config{Directory: newTestDirectory(t, fake)})
+	ctx := google.WithUser(token, &googleAPI.Userinfoplus{Id: "2", Email: "mallory@example.com"})
+	w = serve(p.issueSession(), ctx)
+	if w.Code != http.StatusFound || failed == nil || !strings.Contains(failed.Error(), "mallory@example.com") {
+		t.Errorf("issue = %d with %v, want the failed lookup", w.Code, failed)
+	}
+	if strings.Contains(w.Body.String(), "mallory@example.com") {
+		t.Errorf("response leaks the error: %q", w.Body.String())
+	}
+}
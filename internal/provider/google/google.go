@@ -1,148 +1,267 @@
 package googleprovider
 
 import (
-	"github.com/dghubble/gologin/v2"
+	"context"
+	"fmt"
 	"github.com/dghubble/gologin/v2/google"
-	"github.com/dghubble/sessions"
+	oauth2Login "github.com/dghubble/gologin/v2/oauth2"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"github.com/ozankasikci/one-oauth/internal/jwt"
+	"github.com/ozankasikci/one-oauth/internal/oidc"
 	"github.com/ozankasikci/one-oauth/internal/provider"
+	"github.com/ozankasikci/one-oauth/internal/session"
 	"golang.org/x/oauth2"
 	googleOAuth2 "golang.org/x/oauth2/google"
+	googleAPI "google.golang.org/api/oauth2/v2"
 	"net/http"
-	"net/url"
+	"strings"
 )
 
+// issuer of Google ID tokens, which also use the scheme-less form
+const issuerURL = "https://accounts.google.com"
+
 type Config struct {
+	// Name is the provider instance name reported as User.Provider.
+	Name                       string
 	CookieSessionName          string
 	CookieSessionSecret        string
-	CookieSessionUserKey       string
 	ClientID                   string
 	ClientSecret               string
 	GoogleRedirectURL          string
 	UpstreamSuccessRedirectURL string
 	Scopes                     []string
+	// CookieSessionKeys encrypt session cookies, newest first; older keys
+	// only open cookies issued before a rotation. Defaults to a single key
+	// made of CookieSessionSecret.
+	CookieSessionKeys []session.Key
+	// SessionStore holds server-side sessions; defaults to an in-memory store.
+	SessionStore    session.Store
+	SessionLifetime session.Lifetime
+	// Cookie sets the login and session cookie attributes; defaults to
+	// cookie.Default, which requires HTTPS.
+	Cookie *cookie.Options
+	// DisablePKCE omits the PKCE code challenge.
+	DisablePKCE bool
+	// HostedDomains restricts sign in to Workspace accounts of the domains,
+	// checked against the hd claim of the ID token.
+	HostedDomains []string
+	// Directory, if set, adds the user's Google Groups to User.Groups.
+	Directory *Directory
 }
 
+type claimsKey struct{}
+
 type GoogleProvider struct {
+	session.Provider
 	Config       *Config
-	StateConfig  gologin.CookieConfig
+	StateConfig  cookie.Config
 	Oauth2Config *oauth2.Config
-	CookieStore  *sessions.CookieStore
+	Verifier     *oidc.Verifier
 }
 
 func (t GoogleProvider) LoginHandler() http.Handler {
-	return google.StateHandler(t.StateConfig, google.LoginHandler(t.Oauth2Config, nil))
-}
-
-func (t GoogleProvider) LogoutHandler() http.Handler {
-	return t.logoutHandler()
+	options := flow.Options{DisablePKCE: t.Config.DisablePKCE, Nonce: true}
+	// hd only preselects accounts on the consent screen, "*" any Workspace
+	// account; the ID token is what is checked
+	switch len(t.Config.HostedDomains) {
+	case 0:
+	case 1:
+		options.AuthParams = map[string]string{"hd": t.Config.HostedDomains[0]}
+	default:
+		options.AuthParams = map[string]string{"hd": "*"}
+	}
+	return flow.LoginHandler(t.StateConfig, t.Oauth2Config, options)
 }
 
 func (t GoogleProvider) CallbackHandler() http.Handler {
-	return google.StateHandler(t.StateConfig, google.CallbackHandler(t.Oauth2Config, t.issueSession(), nil))
+	success := t.verifyHandler(t.userHandler(t.issueSession()))
+	return flow.CallbackHandler(t.StateConfig, t.Oauth2Config, success, nil)
 }
 
-func (t GoogleProvider) IsAuthenticatedHandler() http.Handler {
-	return t.IsAuthenticatedHandler()
+func (t GoogleProvider) RedirectURL() string {
+	return t.Oauth2Config.RedirectURL
 }
 
 func New(config *Config) provider.ProviderInterface {
+	// openid makes Google return an ID token carrying the nonce
+	scopes := []string{"openid"}
+	for _, scope := range config.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+
 	oauth2Config := &oauth2.Config{
 		ClientID:     config.ClientID,
 		ClientSecret: config.ClientSecret,
 		RedirectURL:  config.GoogleRedirectURL,
 		Endpoint:     googleOAuth2.Endpoint,
-		Scopes:       config.Scopes,
+		Scopes:       scopes,
+	}
+
+	cookieOptions := cookie.Default
+	if config.Cookie != nil {
+		cookieOptions = *config.Cookie
 	}
 
-	cookieStore := sessions.NewCookieStore([]byte(config.CookieSessionSecret), nil)
+	sessionConfig := session.ProviderConfig{
+		CookieName: config.CookieSessionName,
+		Keys:       config.CookieSessionKeys,
+		Secret:     config.CookieSessionSecret,
+		Store:      config.SessionStore,
+		Lifetime:   config.SessionLifetime,
+		Cookie:     cookieOptions,
+	}
 
-	// state param cookies require HTTPS by default; disable for localhost development
-	stateConfig := gologin.DebugOnlyCookieConfig
+	stateConfig := cookieOptions.LoginConfig(flow.LoginCookieName(config.Name))
 
 	return GoogleProvider{
 		Config:       config,
 		StateConfig:  stateConfig,
 		Oauth2Config: oauth2Config,
-		CookieStore:  cookieStore,
+		Provider:     session.NewProvider(sessionConfig, session.StaticConfig(oauth2Config)),
+		Verifier: &oidc.Verifier{
+			Remote:   oidc.NewRemote(issuerURL, nil),
+			ClientID: config.ClientID,
+			Issuers:  []string{"accounts.google.com"},
+		},
 	}
 }
 
-// issueSession issues a cookie session after successful Google login
-func (t *GoogleProvider) issueSession() http.Handler {
+// verifyHandler verifies the ID token and its nonce before the user is
+// fetched, adding its claims to the ctx.
+func (t *GoogleProvider) verifyHandler(success http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		googleUser, err := google.UserFromContext(ctx)
+		token, err := oauth2Login.TokenFromContext(ctx)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			flow.Fail(w, r, err)
 			return
 		}
 
-		cookie := t.CookieStore.New(t.Config.CookieSessionName)
-		cookie.Values[t.Config.CookieSessionUserKey] = googleUser.Id
-		err = cookie.Save(w)
+		nonce, err := flow.NonceFromContext(ctx)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			flow.Fail(w, r, err)
 			return
 		}
 
-		successRedirectUrl, err := url.Parse(t.Config.UpstreamSuccessRedirectURL)
+		claims, err := t.Verifier.VerifyToken(ctx, token, nonce)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			flow.Fail(w, r, err)
 			return
 		}
 
-		verifiedEmailString := "false"
-		if googleUser.VerifiedEmail != nil && *googleUser.VerifiedEmail == true {
-			verifiedEmailString = "true"
-		}
-
-		q := successRedirectUrl.Query()
-		q.Set("email", googleUser.Email)
-		q.Set("name", googleUser.Name)
-		q.Set("family_name", googleUser.FamilyName)
-		q.Set("gender", googleUser.Gender)
-		q.Set("given_name", googleUser.GivenName)
-		q.Set("hd", googleUser.Hd)
-		q.Set("id", googleUser.Id)
-		q.Set("link", googleUser.Link)
-		q.Set("locale", googleUser.Locale)
-		q.Set("picture", googleUser.Picture)
-		q.Set("verified_email", verifiedEmailString)
-		successRedirectUrl.RawQuery = q.Encode()
-
-		http.Redirect(w, r, successRedirectUrl.String(), http.StatusFound)
+		ctx = context.WithValue(ctx, claimsKey{}, claims)
+		success.ServeHTTP(w, r.WithContext(ctx))
 	}
 
 	return http.HandlerFunc(fn)
 }
 
-// logoutHandler destroys the session on POSTs and redirects to home.
-func (t *GoogleProvider) logoutHandler() http.Handler {
+// userHandler fetches the Google userinfo with the token from the ctx and
+// adds it to the ctx, like gologin's google.CallbackHandler.
+func (t *GoogleProvider) userHandler(success http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			t.CookieStore.Destroy(w, t.Config.CookieSessionName)
+		ctx := r.Context()
+		token, err := oauth2Login.TokenFromContext(ctx)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		service, err := googleAPI.New(t.Oauth2Config.Client(ctx, token))
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
 		}
+
+		googleUser, err := service.Userinfo.Get().Context(ctx).Do()
+		if err != nil || googleUser.Id == "" {
+			flow.Fail(w, r, google.ErrUnableToGetGoogleUser)
+			return
+		}
+
+		ctx = google.WithUser(ctx, googleUser)
+		success.ServeHTTP(w, r.WithContext(ctx))
 	}
 
 	return http.HandlerFunc(fn)
 }
 
-func (t *GoogleProvider) isAuthenticatedHandler() http.Handler {
+// issueSession issues a cookie session after successful Google login
+func (t *GoogleProvider) issueSession() http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		if t.isAuthenticated(r) == true {
-			w.WriteHeader(http.StatusOK)
-		} else {
-			w.WriteHeader(http.StatusProxyAuthRequired)
+		ctx := r.Context()
+		googleUser, err := google.UserFromContext(ctx)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		user := &provider.User{
+			Subject:       googleUser.Id,
+			Provider:      t.Config.Name,
+			Email:         googleUser.Email,
+			EmailVerified: googleUser.VerifiedEmail != nil && *googleUser.VerifiedEmail,
+			Name:          googleUser.Name,
+			GivenName:     googleUser.GivenName,
+			FamilyName:    googleUser.FamilyName,
+			Picture:       googleUser.Picture,
+			Locale:        googleUser.Locale,
+			Raw:           provider.RawClaims(googleUser),
+		}
+		// the userinfo hd field is not signed, the ID token's is
+		if claims, ok := ctx.Value(claimsKey{}).(jwt.Claims); ok {
+			user.HostedDomain = claims.String("hd")
+		}
+
+		if !t.hostedDomainAllowed(user.HostedDomain) {
+			provider.AccessDenied(w, r, user, fmt.Errorf("google: hosted domain %q is not allowed", user.HostedDomain))
+			return
+		}
+
+		if t.Config.Directory != nil && user.Email != "" {
+			user.Groups, err = t.Config.Directory.Groups(ctx, user.Email)
+			if err != nil {
+				flow.Fail(w, r, err)
+				return
+			}
 		}
+
+		if err := provider.Authorize(r, user); err != nil {
+			provider.AccessDenied(w, r, user, err)
+			return
+		}
+
+		token, err := oauth2Login.TokenFromContext(ctx)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		_, err = t.Sessions.Issue(w, r, user, token)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		provider.Deliver(w, r, t.Config.UpstreamSuccessRedirectURL, user)
 	}
 
 	return http.HandlerFunc(fn)
 }
 
-// isAuthenticated returns true if the user has a signed session cookie.
-func (t *GoogleProvider) isAuthenticated(r *http.Request) bool {
-	if _, err := t.CookieStore.Get(r, t.Config.CookieSessionName); err == nil {
+// hostedDomainAllowed reports whether domain is one of the HostedDomains,
+// which allow any domain when empty.
+func (t *GoogleProvider) hostedDomainAllowed(domain string) bool {
+	if len(t.Config.HostedDomains) == 0 {
 		return true
 	}
+	for _, allowed := range t.Config.HostedDomains {
+		if domain != "" && strings.EqualFold(domain, allowed) {
+			return true
+		}
+	}
 	return false
 }
@@ -0,0 +1,264 @@
+package oidcprovider
+
+import (
+	"context"
+	"errors"
+	oauth2Login "github.com/dghubble/gologin/v2/oauth2"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"github.com/ozankasikci/one-oauth/internal/jwt"
+	"github.com/ozankasikci/one-oauth/internal/oidc"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"github.com/ozankasikci/one-oauth/internal/session"
+	"golang.org/x/oauth2"
+	"net/http"
+)
+
+var (
+	errSubjectMismatch = errors.New("oidc: userinfo subject does not match ID token")
+	errMissingClaims   = errors.New("oidc: context missing claims")
+)
+
+type Config struct {
+	// Name is the provider instance name reported as User.Provider.
+	Name                       string
+	CookieSessionName          string
+	CookieSessionSecret        string
+	ClientID                   string
+	ClientSecret               string
+	IssuerURL                  string
+	OIDCRedirectURL            string
+	UpstreamSuccessRedirectURL string
+	Scopes                     []string
+	// CookieSessionKeys encrypt session cookies, newest first; older keys
+	// only open cookies issued before a rotation. Defaults to a single key
+	// made of CookieSessionSecret.
+	CookieSessionKeys []session.Key
+	// SessionStore holds server-side sessions; defaults to an in-memory store.
+	SessionStore    session.Store
+	SessionLifetime session.Lifetime
+	// Cookie sets the login and session cookie attributes; defaults to
+	// cookie.Default, which requires HTTPS.
+	Cookie *cookie.Options
+	// HTTPClient is used for discovery, key set and userinfo requests.
+	// Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// DisablePKCE omits the PKCE code challenge, for servers rejecting it.
+	DisablePKCE bool
+}
+
+type OIDCProvider struct {
+	session.Provider
+	Config      *Config
+	StateConfig cookie.Config
+	Verifier    *oidc.Verifier
+}
+
+type claimsKey struct{}
+
+func (t OIDCProvider) LoginHandler() http.Handler {
+	return t.loginHandler()
+}
+
+func (t OIDCProvider) CallbackHandler() http.Handler {
+	return t.callbackHandler()
+}
+
+func (t OIDCProvider) RedirectURL() string {
+	return t.Config.OIDCRedirectURL
+}
+
+func New(config *Config) provider.ProviderInterface {
+	cookieOptions := cookie.Default
+	if config.Cookie != nil {
+		cookieOptions = *config.Cookie
+	}
+
+	sessionConfig := session.ProviderConfig{
+		CookieName: config.CookieSessionName,
+		Keys:       config.CookieSessionKeys,
+		Secret:     config.CookieSessionSecret,
+		Store:      config.SessionStore,
+		Lifetime:   config.SessionLifetime,
+		Cookie:     cookieOptions,
+	}
+
+	stateConfig := cookieOptions.LoginConfig(flow.LoginCookieName(config.Name))
+
+	p := OIDCProvider{
+		Config:      config,
+		StateConfig: stateConfig,
+		Verifier: &oidc.Verifier{
+			Remote:   oidc.NewRemote(config.IssuerURL, config.HTTPClient),
+			ClientID: config.ClientID,
+		},
+	}
+	// tokens are refreshed at the discovered token endpoint
+	p.Provider = session.NewProvider(sessionConfig, p.oauth2Config)
+	return p
+}
+
+// oauth2Config builds the oauth2 config from the discovered endpoints.
+func (t *OIDCProvider) oauth2Config(ctx context.Context) (*oauth2.Config, error) {
+	endpoint, err := t.Verifier.Remote.Endpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := []string{"openid"}
+	for _, scope := range t.Config.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return &oauth2.Config{
+		ClientID:     t.Config.ClientID,
+		ClientSecret: t.Config.ClientSecret,
+		RedirectURL:  t.Config.OIDCRedirectURL,
+		Endpoint:     endpoint,
+		Scopes:       scopes,
+	}, nil
+}
+
+// loginHandler redirects to the discovered authorization endpoint with the
+// state, PKCE code challenge and a fresh nonce.
+func (t *OIDCProvider) loginHandler() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		oauth2Config, err := t.oauth2Config(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		options := flow.Options{DisablePKCE: t.Config.DisablePKCE, Nonce: true}
+		flow.LoginHandler(t.StateConfig, oauth2Config, options).ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func (t *OIDCProvider) callbackHandler() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		oauth2Config, err := t.oauth2Config(r.Context())
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		success := t.verifyHandler(oauth2Config, t.issueSession())
+		flow.CallbackHandler(t.StateConfig, oauth2Config, success, nil).ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// verifyHandler verifies the ID token returned alongside the access token and
+// adds its claims, merged with the userinfo response if available, to the ctx.
+func (t *OIDCProvider) verifyHandler(oauth2Config *oauth2.Config, success http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		token, err := oauth2Login.TokenFromContext(ctx)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		nonce, err := flow.NonceFromContext(ctx)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		claims, err := t.Verifier.VerifyToken(ctx, token, nonce)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		userinfo, err := t.userinfo(ctx, oauth2Config, token)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+		if userinfo != nil {
+			if userinfo.String("sub") != claims.String("sub") {
+				flow.Fail(w, r, errSubjectMismatch)
+				return
+			}
+			for name, value := range userinfo {
+				if _, ok := claims[name]; !ok {
+					claims[name] = value
+				}
+			}
+		}
+
+		ctx = context.WithValue(ctx, claimsKey{}, claims)
+		success.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// userinfo fetches the userinfo endpoint if the issuer advertises one.
+func (t *OIDCProvider) userinfo(ctx context.Context, oauth2Config *oauth2.Config, token *oauth2.Token) (jwt.Claims, error) {
+	m, err := t.Verifier.Remote.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if m.UserinfoEndpoint == "" {
+		return nil, nil
+	}
+
+	var claims jwt.Claims
+	if err := oidc.GetJSON(ctx, oauth2Config.Client(ctx, token), m.UserinfoEndpoint, &claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// issueSession issues a cookie session after successful OpenID Connect login
+func (t *OIDCProvider) issueSession() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(claimsKey{}).(jwt.Claims)
+		if !ok {
+			flow.Fail(w, r, errMissingClaims)
+			return
+		}
+
+		user := &provider.User{
+			Subject:       claims.String("sub"),
+			Provider:      t.Config.Name,
+			Email:         claims.String("email"),
+			EmailVerified: claims.Bool("email_verified"),
+			Name:          claims.String("name"),
+			GivenName:     claims.String("given_name"),
+			FamilyName:    claims.String("family_name"),
+			Picture:       claims.String("picture"),
+			Locale:        claims.String("locale"),
+			Raw:           claims,
+		}
+
+		if err := provider.Authorize(r, user); err != nil {
+			provider.AccessDenied(w, r, user, err)
+			return
+		}
+
+		token, err := oauth2Login.TokenFromContext(r.Context())
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		_, err = t.Sessions.Issue(w, r, user, token)
+		if err != nil {
+			flow.Fail(w, r, err)
+			return
+		}
+
+		provider.Deliver(w, r, t.Config.UpstreamSuccessRedirectURL, user)
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,227 @@
+package oidcprovider
+
+import (
+	"encoding/json"
+	"github.com/dghubble/gologin/v2"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"github.com/ozankasikci/one-oauth/internal/jwt"
+	"github.com/ozankasikci/one-oauth/internal/oidc"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIssuer is an OpenID provider whose token endpoint returns an ID token
+// with the nonce of the last authorization request, changed by modify and
+// signed by tokenSigner.
+type fakeIssuer struct {
+	*httptest.Server
+	signer      *jwt.Signer
+	tokenSigner *jwt.Signer
+	nonce       string
+	modify      func(jwt.Claims)
+	userinfo    jwt.Claims
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+	signer, err := jwt.GenerateSigner("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &fakeIssuer{signer: signer, tokenSigner: signer, modify: func(jwt.Claims) {}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidc.Metadata{
+			Issuer:                issuer.URL,
+			AuthorizationEndpoint: issuer.URL + "/authorize",
+			TokenEndpoint:         issuer.URL + "/token",
+			UserinfoEndpoint:      issuer.URL + "/userinfo",
+			JWKSURI:               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwt.KeySet{Keys: []jwt.JSONWebKey{issuer.signer.JSONWebKey()}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "code" || r.FormValue("code_verifier") == "" {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		claims := jwt.Claims{
+			"iss":   issuer.URL,
+			"sub":   "1",
+			"aud":   "client",
+			"exp":   now.Add(time.Hour).Unix(),
+			"iat":   now.Unix(),
+			"nonce": issuer.nonce,
+			"email": "alice@example.com",
+		}
+		issuer.modify(claims)
+		idToken, err := issuer.tokenSigner.Sign(claims)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(issuer.userinfo)
+	})
+	issuer.Server = httptest.NewServer(mux)
+	issuer.userinfo = jwt.Claims{"sub": "1", "name": "Alice", "email": "userinfo@example.com"}
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func newTestProvider(issuer *fakeIssuer) OIDCProvider {
+	return New(&Config{
+		Name:                       "idp",
+		CookieSessionName:          "session",
+		CookieSessionSecret:        "test cookie secret, at least 32 bytes",
+		ClientID:                   "client",
+		ClientSecret:               "secret",
+		IssuerURL:                  issuer.URL,
+		OIDCRedirectURL:            "https://auth.example.com/auth/idp/callback",
+		UpstreamSuccessRedirectURL: "https://app.example.com/",
+		Scopes:                     []string{"email"},
+		Cookie:                     &cookie.Dev,
+	}).(OIDCProvider)
+}
+
+// login runs the login and callback handlers of p against issuer and returns
+// the callback response.
+func login(t *testing.T, p OIDCProvider, issuer *fakeIssuer) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	p.LoginHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/idp/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login = %d %s", w.Code, w.Body.String())
+	}
+	authorize, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authorize.Query()
+	if authorize.Path != "/authorize" || query.Get("client_id") != "client" || query.Get("scope") != "openid email" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization request = %s", authorize)
+	}
+	issuer.nonce = query.Get("nonce")
+	if issuer.nonce == "" {
+		t.Fatal("authorization request has no nonce")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/auth/idp/callback?code=code&state="+url.QueryEscape(query.Get("state")), nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	p.CallbackHandler().ServeHTTP(w, r.WithContext(flow.WithFailureHandler(r.Context(), http.HandlerFunc(failed))))
+	return w
+}
+
+// failed stands in for the sign-in failure page, answering 401 with the
+// error in a header.
+func failed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Error", gologin.ErrorFromContext(r.Context()).Error())
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func TestLogin(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	p := newTestProvider(issuer)
+
+	w := login(t, p, issuer)
+	if w.Code != http.StatusFound {
+		t.Fatalf("callback = %d %s", w.Code, w.Body.String())
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Host != "app.example.com" {
+		t.Errorf("redirected to %s", location)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	user, err := p.Authenticate(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ID token claims take precedence over userinfo
+	if user.Subject != "1" || user.Provider != "idp" || user.Email != "alice@example.com" || user.Name != "Alice" {
+		t.Errorf("user = %+v", user)
+	}
+	token, err := p.Token(httptest.NewRecorder(), r)
+	if err != nil || token.AccessToken != "access" {
+		t.Errorf("token = %v, %v", token, err)
+	}
+}
+
+// TestLoginRejects checks that each ID token check fails the login through
+// the failure handler.
+func TestLoginRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(jwt.Claims)
+	}{
+		{"issuer", func(c jwt.Claims) { c["iss"] = "https://evil.example.com" }},
+		{"audience", func(c jwt.Claims) { c["aud"] = "other" }},
+		{"authorized party", func(c jwt.Claims) { c["aud"] = []string{"client", "other"}; c["azp"] = "other" }},
+		{"expired", func(c jwt.Claims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"nonce", func(c jwt.Claims) { c["nonce"] = "replayed" }},
+		{"no subject", func(c jwt.Claims) { delete(c, "sub") }},
+	}
+
+	for _, test := range tests {
+		issuer := newFakeIssuer(t)
+		issuer.modify = test.modify
+		w := login(t, newTestProvider(issuer), issuer)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: callback = %d, want 401", test.name, w.Code)
+		}
+		if strings.Contains(strings.Join(w.Header()["Set-Cookie"], "\n"), "session=") {
+			t.Errorf("%s: issued a session", test.name)
+		}
+	}
+}
+
+func TestLoginRejectsSignature(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	forged, err := jwt.GenerateSigner("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.Kid = issuer.signer.Kid
+	issuer.tokenSigner = forged
+
+	if w := login(t, newTestProvider(issuer), issuer); w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("X-Error"), "signature") {
+		t.Errorf("callback = %d with %q, want the failure handler", w.Code, w.Header().Get("X-Error"))
+	}
+}
+
+func TestLoginRejectsUserinfoSubject(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	issuer.userinfo = jwt.Claims{"sub": "2"}
+	if w := login(t, newTestProvider(issuer), issuer); w.Code != http.StatusUnauthorized || w.Header().Get("X-Error") != errSubjectMismatch.Error() {
+		t.Errorf("callback = %d with %q, want the failure handler", w.Code, w.Header().Get("X-Error"))
+	}
+}
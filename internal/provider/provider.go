@@ -1,10 +1,31 @@
 package provider
 
-import "net/http"
+import (
+	"golang.org/x/oauth2"
+	"net/http"
+)
 
 type ProviderInterface interface {
 	LoginHandler() http.Handler
 	LogoutHandler() http.Handler
 	CallbackHandler() http.Handler
 	IsAuthenticatedHandler() http.Handler
+	// Authenticate returns the user behind the request's session, or an
+	// error if it has none. It may renew the session cookie on w.
+	Authenticate(w http.ResponseWriter, r *http.Request) (*User, error)
+}
+
+// TokenProvider is implemented by providers that keep the user's upstream
+// OAuth2 token in the session.
+type TokenProvider interface {
+	// Token returns a valid access token for the request's session,
+	// refreshing it if needed.
+	Token(w http.ResponseWriter, r *http.Request) (*oauth2.Token, error)
+}
+
+// RedirectURLProvider is implemented by providers receiving OAuth2
+// callbacks, exposing the callback URL registered with the identity
+// provider.
+type RedirectURLProvider interface {
+	RedirectURL() string
 }
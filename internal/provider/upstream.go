@@ -0,0 +1,51 @@
+package provider
+
+import (
+	"context"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"net/http"
+)
+
+// Upstream delivers an authenticated user to the upstream application at
+// redirectURL once a provider has completed its login flow.
+type Upstream interface {
+	Deliver(w http.ResponseWriter, r *http.Request, redirectURL string, user *User)
+}
+
+// UpstreamFunc adapts a function to the Upstream interface.
+type UpstreamFunc func(w http.ResponseWriter, r *http.Request, redirectURL string, user *User)
+
+func (t UpstreamFunc) Deliver(w http.ResponseWriter, r *http.Request, redirectURL string, user *User) {
+	t(w, r, redirectURL, user)
+}
+
+// unexported key type prevents collisions
+type upstreamKey struct{}
+
+// WithUpstream returns a copy of ctx that stores the Upstream.
+func WithUpstream(ctx context.Context, upstream Upstream) context.Context {
+	return context.WithValue(ctx, upstreamKey{}, upstream)
+}
+
+// Deliver hands user to the Upstream stored in the request ctx, falling back
+// to plain query parameters via RedirectUpstream when none is configured.
+// Logins started with a validated return URL are delivered there instead of
+// redirectURL; without an Upstream they are redirected there as is, since the
+// pages behind the proxy read the user from its session.
+func Deliver(w http.ResponseWriter, r *http.Request, redirectURL string, user *User) {
+	returnTo, returning := flow.ReturnToFromContext(r.Context())
+	if returning {
+		redirectURL = returnTo
+	}
+
+	if upstream, ok := r.Context().Value(upstreamKey{}).(Upstream); ok {
+		upstream.Deliver(w, r, redirectURL, user)
+		return
+	}
+	if returning {
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+		return
+	}
+
+	RedirectUpstream(w, r, redirectURL, user)
+}
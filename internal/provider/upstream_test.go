@@ -0,0 +1,61 @@
+package provider
+
+import (
+	"context"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDeliver(t *testing.T) {
+	user := &User{Subject: "1", Provider: "idp", Email: "alice@example.com"}
+	var delivered string
+	upstream := UpstreamFunc(func(w http.ResponseWriter, r *http.Request, redirectURL string, user *User) {
+		delivered = redirectURL
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name     string
+		upstream Upstream
+		returnTo string
+		// location is where users are redirected, or else delivered the
+		// URL passed to the upstream
+		location  string
+		delivered string
+	}{
+		{"query", nil, "", "https://app.example.com/login?" + user.Query().Encode(), ""},
+		{"return URL", nil, "https://app.example.com/docs?page=2", "https://app.example.com/docs?page=2", ""},
+		{"upstream", upstream, "", "", "https://app.example.com/login"},
+		{"upstream with return URL", upstream, "https://app.example.com/docs?page=2", "", "https://app.example.com/docs?page=2"},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.upstream != nil {
+			ctx = WithUpstream(ctx, test.upstream)
+		}
+		if test.returnTo != "" {
+			ctx = flow.WithReturnTo(ctx, test.returnTo)
+		}
+		delivered = ""
+		w := httptest.NewRecorder()
+		Deliver(w, httptest.NewRequest(http.MethodGet, "/auth/idp/callback", nil).WithContext(ctx), "https://app.example.com/login", user)
+
+		if delivered != test.delivered {
+			t.Errorf("%s: delivered to %q, want %q", test.name, delivered, test.delivered)
+		}
+		if test.location == "" {
+			continue
+		}
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := url.Parse(test.location)
+		if w.Code != http.StatusFound || location.Host != want.Host || location.Path != want.Path || location.Query().Encode() != want.Query().Encode() {
+			t.Errorf("%s: %d to %s, want %s", test.name, w.Code, location, test.location)
+		}
+	}
+}
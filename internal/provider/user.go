@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// User is the provider independent profile every provider builds from its
+// own user representation and delivers upstream.
+type User struct {
+	Subject       string
+	Provider      string
+	Email         string
+	EmailVerified bool
+	Name          string
+	GivenName     string
+	FamilyName    string
+	Picture       string
+	Locale        string
+	// HostedDomain is the Google Workspace domain, taken from the verified
+	// ID token.
+	HostedDomain string
+	// Groups are the user's groups, teams or organizations as resolved by
+	// the provider.
+	Groups []string
+	// Raw holds the provider's original user representation.
+	Raw map[string]interface{}
+}
+
+// Query encodes the normalized profile as upstream query parameters. Raw is
+// left out to keep redirect URLs bounded.
+func (t *User) Query() url.Values {
+	q := url.Values{}
+	q.Set("sub", t.Subject)
+	q.Set("provider", t.Provider)
+	q.Set("email", t.Email)
+	q.Set("email_verified", strconv.FormatBool(t.EmailVerified))
+	q.Set("name", t.Name)
+	q.Set("given_name", t.GivenName)
+	q.Set("family_name", t.FamilyName)
+	q.Set("picture", t.Picture)
+	q.Set("locale", t.Locale)
+	for _, group := range t.Groups {
+		q.Add("groups", group)
+	}
+	return q
+}
+
+// RawClaims converts a provider user struct into a generic claims map using
+// its JSON representation.
+func RawClaims(v interface{}) map[string]interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil
+	}
+	return raw
+}
+
+// RedirectUpstream redirects to upstreamURL with the normalized profile added
+// to any query parameters it already has.
+func RedirectUpstream(w http.ResponseWriter, r *http.Request, upstreamURL string, user *User) {
+	successRedirectUrl, err := url.Parse(upstreamURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	q := successRedirectUrl.Query()
+	for key, values := range user.Query() {
+		q[key] = values
+	}
+	successRedirectUrl.RawQuery = q.Encode()
+
+	http.Redirect(w, r, successRedirectUrl.String(), http.StatusFound)
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ACMEConfig obtains and renews certificates automatically from an ACME
+// CA such as Let's Encrypt. Configuring it accepts the CA's terms of
+// service.
+//
+// TLS-ALPN-01 challenges are answered on the TLS listener, which the CA
+// reaches on port 443. HTTP-01 challenges are answered on
+// TLSConfig.RedirectAddress, which the CA reaches on port 80.
+type ACMEConfig struct {
+	// Hosts are the names certificates are issued for; defaults to the
+	// hosts of the providers' redirect URLs and Config.ExternalURL.
+	// Handshakes for other names are rejected.
+	Hosts []string
+	// CacheDir keeps the account key and certificates across restarts.
+	CacheDir string
+	// Email is the optional contact for the CA's expiry notices.
+	Email string
+	// DirectoryURL defaults to Let's Encrypt production; use the staging
+	// directory or a local Pebble server for testing.
+	DirectoryURL string
+	// DirectoryCAFile is a PEM bundle trusted for the directory's HTTPS
+	// certificate, e.g. Pebble's test CA. System roots are used when empty.
+	DirectoryCAFile string
+	// RenewBefore defaults to 30 days before expiry.
+	RenewBefore time.Duration
+}
+
+// manager returns the autocert.Manager for the config. hosts is consulted
+// on each new name when Hosts is empty, so reloaded providers are
+// followed.
+func (t *ACMEConfig) manager(hosts func() []string) (*autocert.Manager, error) {
+	if t.CacheDir == "" {
+		return nil, errors.New("proxy: ACME requires a cache directory")
+	}
+
+	client := &acme.Client{
+		DirectoryURL: t.DirectoryURL,
+		UserAgent:    "one-oauth",
+	}
+	if t.DirectoryCAFile != "" {
+		pem, err := ioutil.ReadFile(t.DirectoryCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: ACME directory CA: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("proxy: ACME directory CA: no certificates in %s", t.DirectoryCAFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+
+	hostPolicy := func(ctx context.Context, host string) error {
+		allowed := t.Hosts
+		if len(allowed) == 0 {
+			allowed = hosts()
+		}
+		for _, h := range allowed {
+			if strings.EqualFold(h, host) {
+				return nil
+			}
+		}
+		return fmt.Errorf("proxy: ACME: host %q not configured", host)
+	}
+
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(t.CacheDir),
+		HostPolicy:  hostPolicy,
+		RenewBefore: t.RenewBefore,
+		Client:      client,
+		Email:       t.Email,
+	}, nil
+}
+
+// acmeHosts returns the hostnames of the providers' redirect URLs and of
+// ExternalURL.
+func (t *Proxy) acmeHosts() []string {
+	var urls []string
+	if t.Config.ExternalURL != "" {
+		urls = append(urls, t.Config.ExternalURL)
+	}
+	for _, p := range t.Providers {
+		if redirect, ok := p.(provider.RedirectURLProvider); ok {
+			urls = append(urls, redirect.RedirectURL())
+		}
+	}
+
+	seen := map[string]bool{}
+	var hosts []string
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
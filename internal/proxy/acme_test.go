@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeDirectory serves an ACME directory over HTTPS and returns it with
+// a PEM file of its certificate.
+func newFakeDirectory(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/directory" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"newNonce": "` + server.URL + `/nonce",
+			"newAccount": "` + server.URL + `/account",
+			"newOrder": "` + server.URL + `/order",
+			"revokeCert": "` + server.URL + `/revoke",
+			"keyChange": "` + server.URL + `/key-change",
+			"meta": {"termsOfService": "` + server.URL + `/terms"}
+		}`))
+	}))
+	t.Cleanup(server.Close)
+
+	dir := tempDir(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, certificate, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return server, caFile
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "one-oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestACMEDirectory(t *testing.T) {
+	server, caFile := newFakeDirectory(t)
+	config := &ACMEConfig{CacheDir: tempDir(t), DirectoryURL: server.URL + "/directory", DirectoryCAFile: caFile}
+
+	manager, err := config.manager(func() []string { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory, err := manager.Client.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if directory.OrderURL != server.URL+"/order" || directory.Terms != server.URL+"/terms" {
+		t.Errorf("directory = %+v", directory)
+	}
+
+	// the directory's certificate is not trusted without the CA file
+	config.DirectoryCAFile = ""
+	manager, err = config.manager(func() []string { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Client.Discover(context.Background()); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("err = %v, want an untrusted certificate", err)
+	}
+}
+
+func TestACMEConfigErrors(t *testing.T) {
+	dir := tempDir(t)
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("no certificates"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		config ACMEConfig
+		want   string
+	}{
+		{ACMEConfig{}, "cache directory"},
+		{ACMEConfig{CacheDir: dir, DirectoryCAFile: filepath.Join(dir, "missing.pem")}, "directory CA"},
+		{ACMEConfig{CacheDir: dir, DirectoryCAFile: empty}, "no certificates"},
+	}
+	for _, test := range tests {
+		if _, err := test.config.manager(func() []string { return nil }); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("manager(%+v) = %v, want an error mentioning %q", test.config, err, test.want)
+		}
+	}
+}
+
+func TestACMEHostPolicy(t *testing.T) {
+	hosts := []string{"auth.example.com"}
+	config := &ACMEConfig{CacheDir: tempDir(t)}
+	manager, err := config.manager(func() []string { return hosts })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := manager.HostPolicy(ctx, "AUTH.example.com"); err != nil {
+		t.Errorf("provider host: %v", err)
+	}
+	if err := manager.HostPolicy(ctx, "evil.example.com"); err == nil {
+		t.Error("accepted an unknown host")
+	}
+
+	// hosts are consulted again, following reloads
+	hosts = []string{"new.example.com"}
+	if err := manager.HostPolicy(ctx, "new.example.com"); err != nil {
+		t.Errorf("reloaded host: %v", err)
+	}
+
+	// configured hosts replace the providers'
+	config.Hosts = []string{"static.example.com"}
+	manager, err = config.manager(func() []string { return hosts })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager.HostPolicy(ctx, "static.example.com") != nil || manager.HostPolicy(ctx, "new.example.com") == nil {
+		t.Error("configured hosts were not used exclusively")
+	}
+}
+
+func TestACMEHosts(t *testing.T) {
+	p := newTestProxy(t, SetExternalURL("https://Auth.example.com:8443/"), AddProvider("other", "generic", genericConfig("other")))
+	if hosts := p.acmeHosts(); strings.Join(hosts, " ") != "auth.example.com" {
+		t.Errorf("hosts = %v", hosts)
+	}
+}
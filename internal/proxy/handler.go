@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/acme/autocert"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Handler serves whichever Proxy was stored last, so a configuration reload
+// can replace routes, providers and upstreams without restarting the
+// listener. Requests in flight finish on the Proxy they started with.
+type Handler struct {
+	current atomic.Value
+
+	mu       sync.Mutex
+	server   *http.Server
+	redirect *http.Server
+}
+
+func NewHandler(proxy *Proxy) *Handler {
+	handler := &Handler{}
+	handler.Store(proxy)
+	return handler
+}
+
+// Store atomically replaces the served Proxy.
+func (t *Handler) Store(proxy *Proxy) {
+	t.current.Store(proxy)
+}
+
+// Load returns the Proxy currently served.
+func (t *Handler) Load() *Proxy {
+	return t.current.Load().(*Proxy)
+}
+
+func (t *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.Load().Router.ServeHTTP(w, r)
+}
+
+// Start listens on the address of the current Proxy and serves until ctx is
+// done, see Serve. Address and server settings of later reloads need a
+// restart.
+func (t *Handler) Start(ctx context.Context) error {
+	listener, err := Listen(t.Load().address())
+	if err != nil {
+		return err
+	}
+	return t.Serve(ctx, listener)
+}
+
+// Serve serves on listener until ctx is done, then stops accepting
+// connections and drains open ones within ServerConfig.ShutdownTimeout.
+// With Config.TLS it serves HTTPS and optionally the HTTP redirect listener.
+// It returns nil after a clean shutdown.
+func (t *Handler) Serve(ctx context.Context, listener net.Listener) error {
+	proxy := t.Load()
+	config := proxy.Config.Server.withDefaults()
+	server := &http.Server{
+		Handler:           t,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+
+	var redirect *http.Server
+	var redirectListener net.Listener
+	if tlsConfig := proxy.Config.TLS; tlsConfig != nil {
+		var manager *autocert.Manager
+		var err error
+		server.TLSConfig, manager, err = tlsConfig.build(func() []string {
+			return t.Load().acmeHosts()
+		})
+		if err != nil {
+			return err
+		}
+		if tlsConfig.RedirectAddress != "" {
+			redirectListener, err = Listen(tlsConfig.RedirectAddress)
+			if err != nil {
+				return err
+			}
+			redirectHandler := RedirectHandler(listener.Addr())
+			if manager != nil {
+				redirectHandler = manager.HTTPHandler(redirectHandler)
+			}
+			redirect = &http.Server{
+				Handler:           redirectHandler,
+				ReadHeaderTimeout: config.ReadHeaderTimeout,
+				ReadTimeout:       config.ReadTimeout,
+				WriteTimeout:      config.WriteTimeout,
+				IdleTimeout:       config.IdleTimeout,
+			}
+		}
+	}
+
+	t.mu.Lock()
+	if t.server != nil {
+		t.mu.Unlock()
+		if redirectListener != nil {
+			redirectListener.Close()
+		}
+		return errors.New("proxy: already serving")
+	}
+	t.server = server
+	t.redirect = redirect
+	t.mu.Unlock()
+
+	errc := make(chan error, 2)
+	if server.TLSConfig != nil {
+		log.Printf("Starting Server listening on %s (TLS)\n", listener.Addr())
+		go func() {
+			errc <- server.ServeTLS(listener, "", "")
+		}()
+	} else {
+		log.Printf("Starting Server listening on %s\n", listener.Addr())
+		go func() {
+			errc <- server.Serve(listener)
+		}()
+	}
+	if redirect != nil {
+		log.Printf("Redirecting HTTP on %s to HTTPS\n", redirectListener.Addr())
+		go func() {
+			errc <- redirect.Serve(redirectListener)
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-errc:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if shutdownErr := t.Shutdown(shutdownCtx); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// Shutdown stops the servers gracefully, waiting for active requests until
+// ctx is done. Afterwards the Handler may Serve again.
+func (t *Handler) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	server, redirect := t.server, t.redirect
+	t.server, t.redirect = nil, nil
+	t.mu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	log.Printf("Shutting down server")
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
+	return server.Shutdown(ctx)
+}
+
+func (t *Proxy) address() string {
+	if t.Config.Address != "" {
+		return t.Config.Address
+	}
+	return fmt.Sprintf(":%s", t.Config.Port)
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unixClient returns a client sending every request to the socket at path.
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+// serve runs handler.Serve on a fresh unix socket in dir, returning the
+// socket path and the channel receiving the result of Serve.
+func serve(t *testing.T, handler *Handler, ctx context.Context, dir string) (string, chan error) {
+	t.Helper()
+	path := filepath.Join(dir, "proxy.sock")
+	listener, err := Listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- handler.Serve(ctx, listener)
+	}()
+	return path, errc
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	// the upstream holds requests until released
+	arrived, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	p := newTestProxy(t, AddUpstreamConfig(&UpstreamConfig{URL: upstream.URL}))
+	cookies := signIn(t, p, "idp", alice)
+	handler := NewHandler(p)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	path, errc := serve(t, handler, ctx, tempDir(t))
+
+	// a request in flight when the context is done still completes
+	type response struct {
+		status int
+		body   string
+		err    error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		r, _ := http.NewRequest(http.MethodGet, "http://proxy/app", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		resp, err := unixClient(path).Do(r)
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		responses <- response{resp.StatusCode, string(body), err}
+	}()
+
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not reach the upstream")
+	}
+	cancel()
+	select {
+	case err := <-errc:
+		t.Fatalf("Serve returned %v before the request finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	if got := <-responses; got.err != nil || got.status != http.StatusOK || got.body != "upstream" {
+		t.Errorf("in-flight request = %+v", got)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Serve = %v, want nil after a clean shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after shutdown")
+	}
+	if _, err := unixClient(path).Get("http://proxy/auth/sign_in"); err == nil {
+		t.Error("still serving after shutdown")
+	}
+
+	// the handler serves again after shutting down
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	path, errc = serve(t, handler, ctx, filepath.Dir(path))
+	resp, err := unixClient(path).Get("http://proxy/auth/sign_in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("sign-in page = %d", resp.StatusCode)
+	}
+	if err := handler.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Serve after Shutdown = %v", err)
+	}
+}
+
+func TestServeTwice(t *testing.T) {
+	handler := NewHandler(newTestProxy(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	dir := tempDir(t)
+	path, errc := serve(t, handler, ctx, dir)
+	// wait until serving
+	for i := 0; ; i++ {
+		resp, err := unixClient(path).Get("http://proxy/auth/sign_in")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "other.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err := handler.Serve(context.Background(), listener); err == nil || !strings.Contains(err.Error(), "already serving") {
+		t.Errorf("second Serve = %v", err)
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListenUnixKeepsFiles(t *testing.T) {
+	// a regular file at the socket path is not removed
+	path := filepath.Join(tempDir(t), "proxy.sock")
+	if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if listener, err := Listen("unix:" + path); err == nil {
+		listener.Close()
+		t.Fatal("listened over a regular file")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "data" {
+		t.Errorf("file = %q, %v", data, err)
+	}
+}
+
+// setenv sets the environment variable key to value until the test ends.
+func setenv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestListenSystemdErrors(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name    string
+		address string
+		env     map[string]string
+	}{
+		{"not activated", "systemd", nil},
+		{"other process", "systemd", map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}},
+		{"no sockets", "systemd", map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "0"}},
+		{"unknown name", "systemd:web", map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "1", "LISTEN_FDNAMES": "admin"}},
+	}
+	for _, test := range tests {
+		for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			setenv(t, key, test.env[key])
+		}
+		if listener, err := Listen(test.address); err == nil {
+			listener.Close()
+			t.Errorf("%s: listened", test.name)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// file descriptor of the first socket passed by systemd
+const systemdFirstFD = 3
+
+// Listen creates the listener for address, which is one of
+//
+//	host:port         a TCP address, e.g. ":4999"
+//	unix:/path        a Unix socket, replacing a stale socket file
+//	systemd           the first socket passed by systemd socket activation
+//	systemd:name      the socket passed with FileDescriptorName=name
+func Listen(address string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		path := strings.TrimPrefix(address, "unix:")
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	case address == "systemd" || strings.HasPrefix(address, "systemd:"):
+		return systemdListener(strings.TrimPrefix(strings.TrimPrefix(address, "systemd"), ":"))
+	default:
+		return net.Listen("tcp", address)
+	}
+}
+
+// systemdListener returns the activated socket named name, or the first one
+// if name is empty, following sd_listen_fds(3).
+func systemdListener(name string) (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("proxy: no sockets passed by systemd")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("proxy: no sockets passed by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < count; i++ {
+		if name != "" && (i >= len(names) || names[i] != name) {
+			continue
+		}
+
+		file := os.NewFile(uintptr(systemdFirstFD+i), "systemd-socket-"+strconv.Itoa(i))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("proxy: systemd socket %d: %v", i, err)
+		}
+		return listener, nil
+	}
+
+	return nil, fmt.Errorf("proxy: systemd passed no socket named %q", name)
+}
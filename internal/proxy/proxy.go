@@ -1,35 +1,125 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/ozankasikci/one-oauth/internal/access"
+	"github.com/ozankasikci/one-oauth/internal/assertion"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"github.com/ozankasikci/one-oauth/internal/policy"
 	"github.com/ozankasikci/one-oauth/internal/provider"
 	facebookprovider "github.com/ozankasikci/one-oauth/internal/provider/facebook"
+	genericprovider "github.com/ozankasikci/one-oauth/internal/provider/generic"
 	githubprovider "github.com/ozankasikci/one-oauth/internal/provider/github"
 	googleprovider "github.com/ozankasikci/one-oauth/internal/provider/google"
-	"log"
+	oidcprovider "github.com/ozankasikci/one-oauth/internal/provider/oidc"
+	"github.com/ozankasikci/one-oauth/internal/redirect"
+	"github.com/ozankasikci/one-oauth/internal/session"
+	"html/template"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 )
 
+// provider names become a path segment of the /auth/{name}/... routes
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
 type Config struct {
 	UpstreamSuccessRedirectURL string
 	Port                       string
-	GoogleConfig               *googleprovider.Config
-	GithubConfig               *githubprovider.Config
-	FacebookConfig             *facebookprovider.Config
+	// Address is the listen address, e.g. "127.0.0.1:4999", "unix:/path" or
+	// "systemd", see Listen. Defaults to all interfaces on Port.
+	Address string
+	// ExternalURL is the base URL browsers use to reach the proxy, used for
+	// absolute login hints. Relative paths are used when empty.
+	ExternalURL string
+	Providers   map[string]*ProviderConfig
+	// Assertion makes the proxy pass a signed token upstream instead of
+	// plain query parameters when set.
+	Assertion *assertion.Config
+	// Access restricts who is issued a session when set.
+	Access *access.Config
+	// Rules restrict which signed in users may reach which hosts and paths,
+	// in forward-auth and reverse proxy mode.
+	Rules []*policy.Rule
+	// SignIn customizes the sign-in page unauthenticated users are sent to.
+	SignIn *SignInConfig
+	// ReturnTo lists the hosts and paths users may ask to return to after
+	// login, in addition to relative paths and the host of ExternalURL.
+	ReturnTo *redirect.Allowlist
+	// Expression must hold for users to be issued a session, and for every
+	// request in forward-auth and reverse proxy mode, see policy.Expression.
+	// At sign in, request describes the return URL of the login; without
+	// one its host and method are empty.
+	Expression string
+	// Upstreams enables reverse proxy mode: requests not handled by the
+	// proxy's own routes are forwarded to the matching upstream.
+	Upstreams []*UpstreamConfig
+	// SessionStore is shared by all providers that do not set their own.
+	SessionStore session.Store
+	// SessionLifetime is the default for providers that do not set their own.
+	SessionLifetime session.Lifetime
+	// Cookie is the default cookie options for providers that do not set
+	// their own. Providers fall back to cookie.Default, which requires HTTPS;
+	// use cookie.Dev for local development over plain HTTP.
+	Cookie *cookie.Options
+	// Server tunes timeouts and limits of the listening http.Server.
+	Server ServerConfig
+	// TLS makes the proxy serve HTTPS when set.
+	TLS *TLSConfig
+	// PassAccessToken exposes the user's upstream access token through the
+	// X-Forwarded-Access-Token header and /auth/{name}/token.
+	PassAccessToken bool
+	// Debug also logs allowed authorization decisions; denials are always
+	// logged.
+	Debug bool
+}
+
+// ProviderConfig selects a registered provider type and carries the config
+// value its Factory expects, e.g. *googleprovider.Config for "google".
+type ProviderConfig struct {
+	Type    string
+	Config  interface{}
+	Display ProviderDisplay
+}
+
+// ProviderDisplay is how a provider is listed on the sign-in page.
+type ProviderDisplay struct {
+	// Name defaults to the name of the provider type, e.g. "Google", or else
+	// the provider name.
+	Name string
+	// Icon is an image URL shown next to the name, which may be a data: URL.
+	Icon string
+	// Order sorts providers in ascending order, then by provider name.
+	Order int
 }
 
 type Proxy struct {
-	Config           *Config
-	Router           *mux.Router
-	GoogleProvider   provider.ProviderInterface
-	GithubProvider   provider.ProviderInterface
-	FacebookProvider provider.ProviderInterface
+	Config         *Config
+	Router         *mux.Router
+	Providers      map[string]provider.ProviderInterface
+	Assertion      *assertion.Assertion
+	Access         *access.Policy
+	Policy         *policy.Policy
+	Expression     *policy.Expression
+	ReturnTo       *redirect.Allowlist
+	upstreams      []*upstream
+	signInTemplate *template.Template
+	serverMu       sync.Mutex
+	server         *Handler
 }
 
 func NewConfig(port string, options ...func(*Config)) *Config {
 	config := &Config{
-		Port: port,
+		Port:      port,
+		Providers: map[string]*ProviderConfig{},
 	}
 
 	for _, option := range options {
@@ -39,64 +129,295 @@ func NewConfig(port string, options ...func(*Config)) *Config {
 	return config
 }
 
-func AddGoogleConfig(config *googleprovider.Config) func(*Config) {
+// AddProvider adds a provider instance of a registered type under name. The
+// same type may be added several times under different names.
+func AddProvider(name, providerType string, config interface{}) func(*Config) {
 	return func(c *Config) {
-		c.GoogleConfig = config
+		c.Providers[name] = &ProviderConfig{
+			Type:   providerType,
+			Config: config,
+		}
 	}
 }
 
-func AddGithubConfig(config *githubprovider.Config) func(*Config) {
+// SetProviderDisplay sets how the provider added under name is listed on the
+// sign-in page.
+func SetProviderDisplay(name string, display ProviderDisplay) func(*Config) {
 	return func(c *Config) {
-		c.GithubConfig = config
+		if providerConfig, ok := c.Providers[name]; ok {
+			providerConfig.Display = display
+		}
 	}
 }
 
+func AddGoogleConfig(config *googleprovider.Config) func(*Config) {
+	return AddProvider("google", "google", config)
+}
+
+func AddGithubConfig(config *githubprovider.Config) func(*Config) {
+	return AddProvider("github", "github", config)
+}
+
 func AddFacebookConfig(config *facebookprovider.Config) func(*Config) {
+	return AddProvider("facebook", "facebook", config)
+}
+
+func AddOIDCConfig(config *oidcprovider.Config) func(*Config) {
+	return AddProvider("oidc", "oidc", config)
+}
+
+func AddGenericConfig(config *genericprovider.Config) func(*Config) {
+	return AddProvider("generic", "generic", config)
+}
+
+func AddAssertionConfig(config *assertion.Config) func(*Config) {
+	return func(c *Config) {
+		c.Assertion = config
+	}
+}
+
+func AddAccessConfig(config *access.Config) func(*Config) {
+	return func(c *Config) {
+		c.Access = config
+	}
+}
+
+func AddRules(rules ...*policy.Rule) func(*Config) {
 	return func(c *Config) {
-		c.FacebookConfig = config
+		c.Rules = append(c.Rules, rules...)
 	}
 }
 
-func New(config *Config) *Proxy {
+func AddSignInConfig(config *SignInConfig) func(*Config) {
+	return func(c *Config) {
+		c.SignIn = config
+	}
+}
+
+func AddReturnToAllowlist(allowlist *redirect.Allowlist) func(*Config) {
+	return func(c *Config) {
+		c.ReturnTo = allowlist
+	}
+}
+
+func SetExpression(expression string) func(*Config) {
+	return func(c *Config) {
+		c.Expression = expression
+	}
+}
+
+func AddSessionStore(store session.Store) func(*Config) {
+	return func(c *Config) {
+		c.SessionStore = store
+	}
+}
+
+func AddSessionLifetime(lifetime session.Lifetime) func(*Config) {
+	return func(c *Config) {
+		c.SessionLifetime = lifetime
+	}
+}
+
+func AddCookieOptions(options cookie.Options) func(*Config) {
+	return func(c *Config) {
+		c.Cookie = &options
+	}
+}
+
+func SetAddress(address string) func(*Config) {
+	return func(c *Config) {
+		c.Address = address
+	}
+}
+
+func SetExternalURL(externalURL string) func(*Config) {
+	return func(c *Config) {
+		c.ExternalURL = externalURL
+	}
+}
+
+func AddServerConfig(config ServerConfig) func(*Config) {
+	return func(c *Config) {
+		c.Server = config
+	}
+}
+
+func SetPassAccessToken(pass bool) func(*Config) {
+	return func(c *Config) {
+		c.PassAccessToken = pass
+	}
+}
+
+func SetDebug(debug bool) func(*Config) {
+	return func(c *Config) {
+		c.Debug = debug
+	}
+}
+
+func New(config *Config) (*Proxy, error) {
 	router := mux.NewRouter()
 	proxy := &Proxy{
-		Config: config,
-		Router: router,
+		Config:    config,
+		Router:    router,
+		Providers: map[string]provider.ProviderInterface{},
+		ReturnTo:  &redirect.Allowlist{},
+	}
+
+	if config.ReturnTo != nil {
+		*proxy.ReturnTo = *config.ReturnTo
+	}
+	// the proxy's own pages are always safe to return to
+	if u, err := url.Parse(config.ExternalURL); err == nil && u.Hostname() != "" {
+		proxy.ReturnTo.Hosts = append(append([]string{}, proxy.ReturnTo.Hosts...), u.Hostname())
+	}
+
+	signInTemplate, err := newSignInTemplate(config.SignIn)
+	if err != nil {
+		return nil, err
+	}
+	proxy.signInTemplate = signInTemplate
+
+	if config.Assertion != nil {
+		if config.Assertion.Signer == nil {
+			return nil, errors.New("proxy: assertion config requires a signer")
+		}
+		proxy.Assertion = assertion.New(config.Assertion)
+		router.Handle("/.well-known/jwks.json", proxy.Assertion.JWKSHandler())
 	}
 
-	if config.GoogleConfig != nil {
-		googleProvider := googleprovider.New(config.GoogleConfig)
-		router.Handle("/auth/google/login", googleProvider.LoginHandler())
-		router.Handle("/auth/google/logout", googleProvider.LogoutHandler())
-		router.Handle("/auth/google/callback", googleProvider.CallbackHandler())
-		proxy.GoogleProvider = googleProvider
+	if config.Access != nil {
+		policy, err := access.New(config.Access)
+		if err != nil {
+			return nil, err
+		}
+		proxy.Access = policy
 	}
 
-	if config.GithubConfig != nil {
-		githubProvider := githubprovider.New(config.GithubConfig)
-		router.Handle("/auth/github/login", githubProvider.LoginHandler())
-		router.Handle("/auth/github/logout", githubProvider.LogoutHandler())
-		router.Handle("/auth/github/callback", githubProvider.CallbackHandler())
-		proxy.GithubProvider = githubProvider
+	if len(config.Rules) > 0 {
+		rules, err := policy.New(config.Rules)
+		if err != nil {
+			return nil, err
+		}
+		proxy.Policy = rules
 	}
 
-	if config.FacebookConfig != nil {
-		facebookProvider := facebookprovider.New(config.FacebookConfig)
-		router.Handle("/auth/facebook/login", facebookProvider.LoginHandler())
-		router.Handle("/auth/facebook/logout", facebookProvider.LogoutHandler())
-		router.Handle("/auth/facebook/callback", facebookProvider.CallbackHandler())
-		proxy.FacebookProvider = facebookProvider
+	if config.Expression != "" {
+		expression, err := policy.Compile(config.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: expression %s", strings.TrimPrefix(err.Error(), "policy: "))
+		}
+		proxy.Expression = expression
 	}
 
-	return proxy
+	names := make([]string, 0, len(config.Providers))
+	for name := range config.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		providerConfig := config.Providers[name]
+		if !providerNamePattern.MatchString(name) || name == ClientCertProvider {
+			return nil, fmt.Errorf("proxy: invalid provider name %q", name)
+		}
+
+		factory, ok := lookupFactory(providerConfig.Type)
+		if !ok {
+			return nil, fmt.Errorf("proxy: provider %q has unknown type %q", name, providerConfig.Type)
+		}
+
+		env := ProviderEnv{
+			Name:            name,
+			SessionStore:    config.SessionStore,
+			SessionLifetime: config.SessionLifetime,
+			Cookie:          config.Cookie,
+		}
+		p, err := factory(env, providerConfig.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix := fmt.Sprintf("/auth/%s", name)
+		router.Handle(prefix+"/login", proxy.withLogin(p.LoginHandler()))
+		router.Handle(prefix+"/logout", p.LogoutHandler())
+		router.Handle(prefix+"/callback", proxy.withCallback(name, p.CallbackHandler()))
+		router.Handle(prefix+"/status", p.IsAuthenticatedHandler())
+		if tokenProvider, ok := p.(provider.TokenProvider); ok && config.PassAccessToken {
+			router.Handle(prefix+"/token", proxy.TokenHandler(tokenProvider))
+		}
+		proxy.Providers[name] = p
+	}
+
+	router.Handle(SignInPath, proxy.SignInHandler())
+	router.Handle("/auth/verify", proxy.VerifyHandler())
+
+	for _, upstreamConfig := range config.Upstreams {
+		u, err := newUpstream(upstreamConfig)
+		if err != nil {
+			return nil, err
+		}
+		proxy.upstreams = append(proxy.upstreams, u)
+	}
+	if len(proxy.upstreams) > 0 {
+		// registered last so the proxy's own routes take precedence
+		router.PathPrefix("/").Handler(proxy.ReverseProxyHandler())
+	}
+
+	return proxy, nil
 }
 
-func (t *Proxy) Start() {
-	address := fmt.Sprintf(":%s", t.Config.Port)
+// withLogin makes providers keep return URLs the proxy allows.
+func (t *Proxy) withLogin(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := flow.WithValidator(r.Context(), t.ReturnTo)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
 
-	log.Printf("Starting Server listening on %s\n", address)
-	err := http.ListenAndServe(address, t.Router)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	return http.HandlerFunc(fn)
+}
+
+// withCallback makes providers check the proxy's access policy and
+// expression, return users to where they started, and otherwise deliver them
+// through its configured upstream mechanism. Failed callbacks of provider
+// name go back to the sign-in page.
+func (t *Proxy) withCallback(name string, next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := flow.WithValidator(r.Context(), t.ReturnTo)
+		ctx = flow.WithFailureHandler(ctx, t.signInFailure(name))
+		if t.Assertion != nil {
+			ctx = provider.WithUpstream(ctx, t.Assertion)
+		}
+		if t.Access != nil || t.Expression != nil {
+			ctx = provider.WithAuthorizer(ctx, t.authorizer())
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// Start serves the proxy on its address until ctx is done, then drains
+// connections, see Handler.Serve.
+func (t *Proxy) Start(ctx context.Context) error {
+	return t.handler().Start(ctx)
+}
+
+// Serve is Start on a provided listener, e.g. from Listen.
+func (t *Proxy) Serve(ctx context.Context, listener net.Listener) error {
+	return t.handler().Serve(ctx, listener)
+}
+
+// Shutdown gracefully stops a proxy started with Start or Serve.
+func (t *Proxy) Shutdown(ctx context.Context) error {
+	return t.handler().Shutdown(ctx)
+}
+
+func (t *Proxy) handler() *Handler {
+	t.serverMu.Lock()
+	defer t.serverMu.Unlock()
+
+	if t.server == nil {
+		t.server = NewHandler(t)
 	}
+	return t.server
 }
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	facebookprovider "github.com/ozankasikci/one-oauth/internal/provider/facebook"
+	genericprovider "github.com/ozankasikci/one-oauth/internal/provider/generic"
+	githubprovider "github.com/ozankasikci/one-oauth/internal/provider/github"
+	googleprovider "github.com/ozankasikci/one-oauth/internal/provider/google"
+	oidcprovider "github.com/ozankasikci/one-oauth/internal/provider/oidc"
+	"github.com/ozankasikci/one-oauth/internal/session"
+	"sort"
+	"sync"
+)
+
+// ProviderEnv carries the instance name and proxy-wide settings to a Factory.
+type ProviderEnv struct {
+	Name string
+	// SessionStore is the proxy-wide session store, nil if not configured.
+	SessionStore session.Store
+	// SessionLifetime applies to providers that leave theirs zero.
+	SessionLifetime session.Lifetime
+	// Cookie is the proxy-wide cookie options, nil if not configured.
+	Cookie *cookie.Options
+}
+
+// Factory builds a provider instance from its type specific config. Built-in
+// factories copy the config, set its Name from env and fill unset proxy-wide
+// settings.
+type Factory func(env ProviderEnv, config interface{}) (provider.ProviderInterface, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+func init() {
+	Register("google", googleFactory)
+	Register("github", githubFactory)
+	Register("facebook", facebookFactory)
+	Register("oidc", oidcFactory)
+	Register("generic", genericFactory)
+}
+
+// googleFactory builds "google" providers. Like the other built-in factories,
+// which differ only in their Config type, it fills a copy of the config
+// through builtinFields.
+func googleFactory(env ProviderEnv, config interface{}) (provider.ProviderInterface, error) {
+	c, ok := config.(*googleprovider.Config)
+	if !ok || c == nil {
+		return nil, configTypeError(env.Name, c, config)
+	}
+	named := *c
+	fields := builtinFields{&named.Name, named.CookieSessionSecret, named.CookieSessionKeys, &named.SessionStore, &named.SessionLifetime, &named.Cookie}
+	if err := fields.fill(env); err != nil {
+		return nil, err
+	}
+	return googleprovider.New(&named), nil
+}
+
+func githubFactory(env ProviderEnv, config interface{}) (provider.ProviderInterface, error) {
+	c, ok := config.(*githubprovider.Config)
+	if !ok || c == nil {
+		return nil, configTypeError(env.Name, c, config)
+	}
+	named := *c
+	fields := builtinFields{&named.Name, named.CookieSessionSecret, named.CookieSessionKeys, &named.SessionStore, &named.SessionLifetime, &named.Cookie}
+	if err := fields.fill(env); err != nil {
+		return nil, err
+	}
+	return githubprovider.New(&named), nil
+}
+
+func facebookFactory(env ProviderEnv, config interface{}) (provider.ProviderInterface, error) {
+	c, ok := config.(*facebookprovider.Config)
+	if !ok || c == nil {
+		return nil, configTypeError(env.Name, c, config)
+	}
+	named := *c
+	fields := builtinFields{&named.Name, named.CookieSessionSecret, named.CookieSessionKeys, &named.SessionStore, &named.SessionLifetime, &named.Cookie}
+	if err := fields.fill(env); err != nil {
+		return nil, err
+	}
+	return facebookprovider.New(&named), nil
+}
+
+func oidcFactory(env ProviderEnv, config interface{}) (provider.ProviderInterface, error) {
+	c, ok := config.(*oidcprovider.Config)
+	if !ok || c == nil {
+		return nil, configTypeError(env.Name, c, config)
+	}
+	named := *c
+	fields := builtinFields{&named.Name, named.CookieSessionSecret, named.CookieSessionKeys, &named.SessionStore, &named.SessionLifetime, &named.Cookie}
+	if err := fields.fill(env); err != nil {
+		return nil, err
+	}
+	return oidcprovider.New(&named), nil
+}
+
+func genericFactory(env ProviderEnv, config interface{}) (provider.ProviderInterface, error) {
+	c, ok := config.(*genericprovider.Config)
+	if !ok || c == nil {
+		return nil, configTypeError(env.Name, c, config)
+	}
+	named := *c
+	fields := builtinFields{&named.Name, named.CookieSessionSecret, named.CookieSessionKeys, &named.SessionStore, &named.SessionLifetime, &named.Cookie}
+	if err := fields.fill(env); err != nil {
+		return nil, err
+	}
+	return genericprovider.New(&named), nil
+}
+
+// builtinFields points into the copy of a built-in provider Config.
+type builtinFields struct {
+	name            *string
+	secret          string
+	keys            []session.Key
+	sessionStore    *session.Store
+	sessionLifetime *session.Lifetime
+	cookie          **cookie.Options
+}
+
+// fill sets the name from env and the proxy-wide settings left unset, then
+// checks the cookie options and session keys.
+func (t builtinFields) fill(env ProviderEnv) error {
+	*t.name = env.Name
+	if *t.sessionStore == nil && env.SessionStore != nil {
+		*t.sessionStore = env.SessionStore
+	}
+	if *t.sessionLifetime == (session.Lifetime{}) {
+		*t.sessionLifetime = env.SessionLifetime
+	}
+	if *t.cookie == nil {
+		*t.cookie = env.Cookie
+	}
+
+	if err := validateCookie(env.Name, *t.cookie); err != nil {
+		return err
+	}
+	return validateSessionKeys(env.Name, t.keys, t.secret)
+}
+
+// Register makes a provider type available to Config.Providers. It panics if
+// factory is nil or the type is registered twice, like database/sql drivers.
+func Register(providerType string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("proxy: Register factory is nil")
+	}
+	if _, dup := registry[providerType]; dup {
+		panic("proxy: Register called twice for provider type " + providerType)
+	}
+	registry[providerType] = factory
+}
+
+// ProviderTypes returns the sorted list of registered provider types.
+func ProviderTypes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	types := make([]string, 0, len(registry))
+	for providerType := range registry {
+		types = append(types, providerType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func lookupFactory(providerType string) (Factory, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	factory, ok := registry[providerType]
+	return factory, ok
+}
+
+// validateCookie checks the options a provider ends up with; nil means
+// cookie.Default, which is valid.
+func validateCookie(name string, options *cookie.Options) error {
+	if options == nil {
+		return nil
+	}
+	if err := options.Validate(); err != nil {
+		return fmt.Errorf("proxy: provider %q: %v", name, err)
+	}
+	return nil
+}
+
+// validateSessionKeys checks the keys sealing session cookies, falling back
+// to the secret like the providers do.
+func validateSessionKeys(name string, keys []session.Key, secret string) error {
+	if len(keys) == 0 {
+		keys = []session.Key{{Secret: secret}}
+	}
+
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if err := key.Validate(); err != nil {
+			return fmt.Errorf("proxy: provider %q: %v", name, err)
+		}
+		if key.ID != "" && seen[key.ID] {
+			return fmt.Errorf("proxy: provider %q: duplicate session key id %q", name, key.ID)
+		}
+		seen[key.ID] = true
+	}
+	return nil
+}
+
+func configTypeError(name string, expected, got interface{}) error {
+	return fmt.Errorf("proxy: provider %q expects config of type %T, got %T", name, expected, got)
+}
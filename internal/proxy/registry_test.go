@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	facebookprovider "github.com/ozankasikci/one-oauth/internal/provider/facebook"
+	genericprovider "github.com/ozankasikci/one-oauth/internal/provider/generic"
+	githubprovider "github.com/ozankasikci/one-oauth/internal/provider/github"
+	googleprovider "github.com/ozankasikci/one-oauth/internal/provider/google"
+	oidcprovider "github.com/ozankasikci/one-oauth/internal/provider/oidc"
+	"github.com/ozankasikci/one-oauth/internal/session"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "test cookie secret, at least 32 bytes"
+
+func TestBuiltinFactories(t *testing.T) {
+	store := session.NewMemoryStore()
+	env := ProviderEnv{Name: "work", SessionStore: store, SessionLifetime: session.Lifetime{MaxAge: time.Hour}, Cookie: &cookie.Dev}
+	configs := map[string]interface{}{
+		"google":   &googleprovider.Config{CookieSessionSecret: testSecret},
+		"github":   &githubprovider.Config{CookieSessionSecret: testSecret},
+		"facebook": &facebookprovider.Config{CookieSessionSecret: testSecret},
+		"oidc":     &oidcprovider.Config{CookieSessionSecret: testSecret},
+		"generic":  &genericprovider.Config{CookieSessionSecret: testSecret},
+	}
+
+	for providerType, config := range configs {
+		factory, ok := lookupFactory(providerType)
+		if !ok {
+			t.Fatalf("%s is not registered", providerType)
+		}
+		p, err := factory(env, config)
+		if err != nil {
+			t.Fatalf("%s: %v", providerType, err)
+		}
+		var name string
+		var sessions *session.Manager
+		switch p := p.(type) {
+		case googleprovider.GoogleProvider:
+			name, sessions = p.Config.Name, p.Sessions
+		case githubprovider.GithubProvider:
+			name, sessions = p.Config.Name, p.Sessions
+		case facebookprovider.FacebookProvider:
+			name, sessions = p.Config.Name, p.Sessions
+		case oidcprovider.OIDCProvider:
+			name, sessions = p.Config.Name, p.Sessions
+		case genericprovider.GenericProvider:
+			name, sessions = p.Config.Name, p.Sessions
+		default:
+			t.Fatalf("%s: unexpected provider %T", providerType, p)
+		}
+		if name != "work" || sessions.Store != store || sessions.Lifetime.MaxAge != time.Hour || sessions.Cookie != cookie.Dev {
+			t.Errorf("%s: name %q and sessions %+v, want the env's", providerType, name, sessions)
+		}
+	}
+
+	// each factory only accepts the config of its own type
+	for providerType := range configs {
+		factory, _ := lookupFactory(providerType)
+		for otherType, config := range configs {
+			if _, err := factory(env, config); otherType != providerType && (err == nil || !strings.Contains(err.Error(), "expects config of type")) {
+				t.Errorf("%s factory with the %s config = %v", providerType, otherType, err)
+			}
+		}
+	}
+
+	// the factories copy the config
+	if name := configs["google"].(*googleprovider.Config).Name; name != "" {
+		t.Errorf("factory set the name %q on the caller's config", name)
+	}
+}
+
+func TestBuiltinFactoryErrors(t *testing.T) {
+	factory, _ := lookupFactory("google")
+	env := ProviderEnv{Name: "work", Cookie: &cookie.Dev}
+
+	tests := []struct {
+		config interface{}
+		want   string
+	}{
+		{nil, "expects config of type *googleprovider.Config, got <nil>"},
+		{(*googleprovider.Config)(nil), "expects config of type *googleprovider.Config"},
+		{&githubprovider.Config{}, "got *githubprovider.Config"},
+		{googleprovider.Config{}, "got googleprovider.Config"},
+		{&googleprovider.Config{CookieSessionKeys: []session.Key{{ID: "a", Secret: testSecret}, {ID: "a", Secret: testSecret + "2"}}}, "duplicate session key id"},
+		{&googleprovider.Config{}, "key secret is empty"},
+		{&googleprovider.Config{CookieSessionSecret: "secret"}, "at least 32 bytes"},
+		{&googleprovider.Config{CookieSessionSecret: testSecret, Cookie: &cookie.Options{}}, "Secure"},
+	}
+	for _, test := range tests {
+		if _, err := factory(env, test.config); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("factory(%#v) = %v, want an error mentioning %q", test.config, err, test.want)
+		}
+	}
+}
+
+func TestLoginCookiePerProvider(t *testing.T) {
+	p := newTestProxy(t, AddProvider("other", "generic", genericConfig("other")))
+
+	names := map[string]string{}
+	for _, provider := range []string{"idp", "other"} {
+		w := httptest.NewRecorder()
+		p.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/"+provider+"/login", nil))
+		cookies := w.Result().Cookies()
+		if w.Code != http.StatusFound || len(cookies) != 1 {
+			t.Fatalf("%s: login = %d with cookies %v", provider, w.Code, cookies)
+		}
+		names[provider] = cookies[0].Name
+	}
+	if names["idp"] == names["other"] {
+		t.Errorf("both providers use the login cookie %q", names["idp"])
+	}
+}
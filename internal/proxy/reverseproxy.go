@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ozankasikci/one-oauth/internal/policy"
+	"github.com/ozankasikci/one-oauth/internal/session"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// identityHeaders are set by the proxy only; copies sent by clients are
+// removed before forwarding so upstreams can trust them.
+var identityHeaders = []string{
+	HeaderAuthUser,
+	HeaderAuthEmail,
+	HeaderAuthProvider,
+	HeaderAuthGroups,
+	"X-Forwarded-User",
+	"X-Forwarded-Email",
+	"X-Forwarded-Groups",
+	HeaderForwardedAccessToken,
+}
+
+// UpstreamConfig routes requests matching Host and PathPrefix to URL once
+// the user is authenticated.
+type UpstreamConfig struct {
+	URL string
+	// Host optionally restricts the upstream to requests for this host.
+	Host string
+	// PathPrefix selects the requests routed here; defaults to "/".
+	PathPrefix string
+	// StripPrefix removes PathPrefix from the path before forwarding.
+	StripPrefix bool
+}
+
+type upstream struct {
+	config *UpstreamConfig
+	proxy  *httputil.ReverseProxy
+}
+
+func AddUpstreamConfig(config *UpstreamConfig) func(*Config) {
+	return func(c *Config) {
+		c.Upstreams = append(c.Upstreams, config)
+	}
+}
+
+func newUpstream(config *UpstreamConfig) (*upstream, error) {
+	target, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid upstream URL %q: %v", config.URL, err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+		return nil, fmt.Errorf("proxy: upstream URL %q must be an absolute http(s) URL", config.URL)
+	}
+	if config.PathPrefix == "" {
+		config.PathPrefix = "/"
+	}
+	if !strings.HasPrefix(config.PathPrefix, "/") {
+		return nil, errors.New("proxy: upstream path prefix must start with /")
+	}
+	// "/app" must not match "/application"
+	if !strings.HasSuffix(config.PathPrefix, "/") {
+		config.PathPrefix += "/"
+	}
+	strip := strings.TrimSuffix(config.PathPrefix, "/")
+
+	director := func(r *http.Request) {
+		if config.StripPrefix {
+			r.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, strip), "/")
+			r.URL.RawPath = ""
+		}
+
+		forwardedProto := "http"
+		if r.TLS != nil {
+			forwardedProto = "https"
+		}
+		r.Header.Set("X-Forwarded-Host", r.Host)
+		r.Header.Set("X-Forwarded-Proto", forwardedProto)
+
+		r.URL.Scheme = target.Scheme
+		r.URL.Host = target.Host
+		r.URL.Path = singleJoiningSlash(target.Path, r.URL.Path)
+		r.Host = target.Host
+		if target.RawQuery != "" && r.URL.RawQuery != "" {
+			r.URL.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
+		} else if target.RawQuery != "" {
+			r.URL.RawQuery = target.RawQuery
+		}
+	}
+
+	return &upstream{
+		config: config,
+		proxy:  &httputil.ReverseProxy{Director: director},
+	}, nil
+}
+
+func (t *upstream) matches(r *http.Request) bool {
+	if t.config.Host != "" && !strings.EqualFold(stripPort(r.Host), t.config.Host) {
+		return false
+	}
+	prefix := t.config.PathPrefix
+	return r.URL.Path == strings.TrimSuffix(prefix, "/") || strings.HasPrefix(r.URL.Path, prefix)
+}
+
+// ReverseProxyHandler forwards authenticated requests to the matching
+// upstream with identity headers injected. Unauthenticated page loads are
+// redirected to sign in; other requests get 401. Users a rule denies get 403.
+func (t *Proxy) ReverseProxyHandler() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		target := t.matchUpstream(r)
+		if target == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		stripIdentityHeaders(r.Header)
+
+		// in reverse proxy mode the client certificate is the caller's
+		user, ok := clientCertUser(r)
+		var s *session.Session
+		if !ok {
+			user, s, ok = t.authenticate(w, r)
+		}
+		if !ok {
+			redirect := t.loginURL(r.URL.RequestURI())
+			if redirect == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				if redirect != "" {
+					w.Header().Set(HeaderAuthRedirect, redirect)
+				}
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(w, r, redirect, http.StatusFound)
+			return
+		}
+
+		request := policy.Request{Host: r.Host, Path: r.URL.Path, Method: r.Method}
+		if !t.authorize(request, user, s) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		r.Header.Set(HeaderAuthUser, user.Subject)
+		r.Header.Set(HeaderAuthEmail, user.Email)
+		r.Header.Set(HeaderAuthProvider, user.Provider)
+		r.Header.Set("X-Forwarded-User", user.Subject)
+		r.Header.Set("X-Forwarded-Email", user.Email)
+		if len(user.Groups) > 0 {
+			groups := strings.Join(user.Groups, ",")
+			r.Header.Set(HeaderAuthGroups, groups)
+			r.Header.Set("X-Forwarded-Groups", groups)
+		}
+		if accessToken := t.accessToken(r.Context(), user, s); accessToken != "" {
+			r.Header.Set(HeaderForwardedAccessToken, accessToken)
+		}
+
+		target.proxy.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// stripIdentityHeaders removes identityHeaders from h, including spellings
+// with underscores, which Go keeps apart but CGI-style upstreams read as the
+// same header.
+func stripIdentityHeaders(h http.Header) {
+	for key := range h {
+		name := http.CanonicalHeaderKey(strings.ReplaceAll(key, "_", "-"))
+		for _, header := range identityHeaders {
+			if name == header {
+				delete(h, key)
+				break
+			}
+		}
+	}
+}
+
+// matchUpstream returns the upstream with the longest matching path prefix,
+// preferring host specific upstreams on ties.
+func (t *Proxy) matchUpstream(r *http.Request) *upstream {
+	var best *upstream
+	for _, u := range t.upstreams {
+		if !u.matches(r) {
+			continue
+		}
+		if best == nil || len(u.config.PathPrefix) > len(best.config.PathPrefix) ||
+			len(u.config.PathPrefix) == len(best.config.PathPrefix) && best.config.Host == "" && u.config.Host != "" {
+			best = u
+		}
+	}
+	return best
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+func stripPort(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+		return host[:i]
+	}
+	return host
+}
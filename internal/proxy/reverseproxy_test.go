@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// received is what the echo upstream saw of a request.
+type received struct {
+	Path    string
+	Query   string
+	Host    string
+	Headers http.Header
+}
+
+// newEchoUpstream returns an upstream answering with the request it received.
+func newEchoUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(received{Path: r.URL.Path, Query: r.URL.RawQuery, Host: r.Host, Headers: r.Header})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// proxyRequest sends r through p's router and decodes what the upstream
+// received.
+func proxyRequest(t *testing.T, p *Proxy, r *http.Request) received {
+	t.Helper()
+	w := httptest.NewRecorder()
+	p.Router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s = %d %s", r.URL, w.Code, w.Body.String())
+	}
+	var got received
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestReverseProxyStripsIdentityHeaders(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	p := newTestProxy(t, AddUpstreamConfig(&UpstreamConfig{URL: upstream.URL}))
+	bob := *alice
+	bob.Groups = nil
+	cookies := signIn(t, p, "idp", &bob)
+
+	spoofed := []string{
+		HeaderAuthUser, HeaderAuthEmail, HeaderAuthProvider, HeaderAuthGroups,
+		"X-Forwarded-User", "X-Forwarded-Email", "X-Forwarded-Groups", HeaderForwardedAccessToken,
+	}
+	requests := map[string]*http.Request{
+		"session":            httptest.NewRequest(http.MethodGet, "/app", nil),
+		"client certificate": withClientCert(httptest.NewRequest(http.MethodGet, "/app", nil), "build-bot"),
+	}
+	for name, r := range requests {
+		for _, header := range spoofed {
+			r.Header.Set(header, "mallory")
+			r.Header[strings.ToLower(header)] = []string{"mallory"}
+			r.Header[strings.ReplaceAll(header, "-", "_")] = []string{"mallory"}
+		}
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+
+		got := proxyRequest(t, p, r)
+		for key, values := range got.Headers {
+			for _, value := range values {
+				if strings.Contains(value, "mallory") {
+					t.Errorf("%s: upstream received %s: %s", name, key, value)
+				}
+			}
+		}
+		// groups are only sent for users with groups
+		if got.Headers.Get(HeaderAuthGroups) != "" || got.Headers.Get("X-Forwarded-Groups") != "" {
+			t.Errorf("%s: upstream received groups %q", name, got.Headers.Get(HeaderAuthGroups))
+		}
+	}
+
+	got := proxyRequest(t, p, requests["session"])
+	if got.Headers.Get(HeaderAuthUser) != "1" || got.Headers.Get("X-Forwarded-Email") != "alice@example.com" || got.Headers.Get(HeaderAuthProvider) != "idp" {
+		t.Errorf("identity headers = %v", got.Headers)
+	}
+}
+
+func TestReverseProxyUpstreams(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	p := newTestProxy(t,
+		AddUpstreamConfig(&UpstreamConfig{URL: upstream.URL + "/root"}),
+		AddUpstreamConfig(&UpstreamConfig{URL: upstream.URL + "/api?key=1", PathPrefix: "/api", StripPrefix: true}),
+		AddUpstreamConfig(&UpstreamConfig{URL: upstream.URL + "/v2", PathPrefix: "/api/v2/", StripPrefix: true}),
+		AddUpstreamConfig(&UpstreamConfig{URL: upstream.URL + "/admin-api", Host: "admin.example.com", PathPrefix: "/api"}),
+	)
+	cookies := signIn(t, p, "idp", alice)
+
+	tests := []struct {
+		host, target string
+		path, query  string
+	}{
+		{"app.example.com", "/docs", "/root/docs", ""},
+		{"app.example.com", "/api", "/api/", "key=1"},
+		{"app.example.com", "/api/users?page=2", "/api/users", "key=1&page=2"},
+		// prefixes match whole segments
+		{"app.example.com", "/apiary", "/root/apiary", ""},
+		// the longest prefix wins
+		{"app.example.com", "/api/v2/users", "/v2/users", ""},
+		{"app.example.com", "/api/v2", "/v2/", ""},
+		// host specific upstreams win ties, without stripping
+		{"Admin.example.com:443", "/api/users", "/admin-api/api/users", ""},
+		{"admin.example.com", "/api/v2/users", "/v2/users", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.target, nil)
+		r.Host = test.host
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		got := proxyRequest(t, p, r)
+		if got.Path != test.path || got.Query != test.query {
+			t.Errorf("%s%s forwarded to %s?%s, want %s?%s", test.host, test.target, got.Path, got.Query, test.path, test.query)
+		}
+		if got.Headers.Get("X-Forwarded-Host") != test.host {
+			t.Errorf("%s%s: X-Forwarded-Host = %q", test.host, test.target, got.Headers.Get("X-Forwarded-Host"))
+		}
+	}
+}
+
+func TestReverseProxyUnauthenticated(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	p := newTestProxy(t, AddUpstreamConfig(&UpstreamConfig{URL: upstream.URL, PathPrefix: "/app"}))
+
+	// page loads are sent to sign in, other requests get 401 with a hint
+	w := httptest.NewRecorder()
+	p.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/app/docs?page=2", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/auth/sign_in?rd=%2Fapp%2Fdocs%3Fpage%3D2" {
+		t.Errorf("GET = %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	w = httptest.NewRecorder()
+	p.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/app/docs", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get(HeaderAuthRedirect) == "" {
+		t.Errorf("POST = %d with %q", w.Code, w.Header().Get(HeaderAuthRedirect))
+	}
+
+	// requests no upstream matches are not forwarded
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/other", nil)
+	for _, c := range signIn(t, p, "idp", alice) {
+		r.AddCookie(c)
+	}
+	p.Router.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unmatched = %d, want 404", w.Code)
+	}
+}
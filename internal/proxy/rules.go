@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"github.com/ozankasikci/one-oauth/internal/policy"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"github.com/ozankasikci/one-oauth/internal/session"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// authorize evaluates the rules and the expression for user making request,
+// logging denials, and with Config.Debug allowed decisions too. Everyone
+// authenticated is allowed without either.
+func (t *Proxy) authorize(request policy.Request, user *provider.User, s *session.Session) bool {
+	if t.Policy == nil && t.Expression == nil {
+		return true
+	}
+
+	input := &policy.Input{Request: request, User: policyUser(user)}
+	if s != nil {
+		input.Session = &policy.Session{CreatedAt: s.CreatedAt, LastSeenAt: s.LastSeenAt, ExpiresAt: s.ExpiresAt}
+	}
+
+	if t.Policy != nil {
+		decision := t.Policy.Evaluate(input)
+		if !decision.Allowed {
+			log.Printf("rule %s denied %s user %q %s %s%s: %s",
+				decision.Rule, user.Provider, user.Subject, request.Method, request.Host, request.Path, decision.Reason)
+			return false
+		}
+		if t.Config.Debug {
+			rule := decision.Rule
+			if rule == "" {
+				rule = "(none matched)"
+			}
+			log.Printf("rule %s allowed %s user %q %s %s%s",
+				rule, user.Provider, user.Subject, request.Method, request.Host, request.Path)
+		}
+	}
+	return t.evaluate(input) == nil
+}
+
+// authorizer checks users at sign in against the access policy and the
+// expression, evaluated with the session about to be issued and the request
+// users return to, see signInRequest.
+func (t *Proxy) authorizer() provider.Authorizer {
+	fn := func(r *http.Request, user *provider.User) error {
+		if t.Access != nil {
+			if err := t.Access.Authorize(r, user); err != nil {
+				return err
+			}
+		}
+		if t.Expression == nil {
+			return nil
+		}
+		return t.evaluate(&policy.Input{
+			Request: signInRequest(r),
+			User:    policyUser(user),
+			Session: &policy.Session{CreatedAt: time.Now()},
+		})
+	}
+
+	return provider.AuthorizerFunc(fn)
+}
+
+// signInRequest is the GET of the validated return URL of the callback r,
+// relative ones on the proxy's host, rather than the callback itself. Users
+// without a return URL go to the provider's success redirect URL, which the
+// proxy does not see: host and method are then empty, and the path is "/".
+func signInRequest(r *http.Request) policy.Request {
+	returnTo, ok := flow.ReturnToFromContext(r.Context())
+	if !ok {
+		return policy.Request{}
+	}
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return policy.Request{}
+	}
+	request := policy.Request{Host: u.Host, Path: u.Path, Method: http.MethodGet}
+	if request.Host == "" {
+		request.Host = r.Host
+	}
+	return request
+}
+
+// evaluate checks the expression, logging denials and evaluation errors,
+// and with Config.Debug allowed requests.
+func (t *Proxy) evaluate(input *policy.Input) error {
+	if t.Expression == nil {
+		return nil
+	}
+
+	ok, reason, err := t.Expression.Evaluate(input)
+	user, request := input.User, input.Request
+	if ok {
+		if t.Config.Debug {
+			log.Printf("expression allowed %s user %q %s %s%s", user.Provider, user.Subject, request.Method, request.Host, request.Path)
+		}
+		return nil
+	}
+	if err != nil {
+		reason = err.Error()
+		log.Printf("expression failed for %s user %q %s %s%s: %s", user.Provider, user.Subject, request.Method, request.Host, request.Path, reason)
+	} else {
+		log.Printf("expression denied %s user %q %s %s%s: %s", user.Provider, user.Subject, request.Method, request.Host, request.Path, reason)
+	}
+	return errors.New("proxy: expression denied access: " + reason)
+}
+
+func policyUser(user *provider.User) *policy.User {
+	return &policy.User{
+		Subject:       user.Subject,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Name:          user.Name,
+		Provider:      user.Provider,
+		HostedDomain:  user.HostedDomain,
+		Groups:        user.Groups,
+		Claims:        user.Raw,
+	}
+}
+
+// forwardedRequest returns the original request of a forward-auth
+// subrequest, as described by the X-Forwarded-Method, -Host and -Uri headers
+// of Traefik and Caddy, or X-Original-Method and X-Original-URI or
+// X-Original-URL set for nginx. It fails if the URI cannot be parsed.
+func forwardedRequest(r *http.Request) (policy.Request, bool) {
+	request := policy.Request{
+		Host:   firstHeader(r, "X-Forwarded-Host"),
+		Method: firstHeader(r, "X-Forwarded-Method", "X-Original-Method"),
+	}
+
+	if uri := firstHeader(r, "X-Forwarded-Uri", "X-Original-URI", "X-Original-URL"); uri != "" {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return request, false
+		}
+		request.Path = u.Path
+		if request.Host == "" {
+			request.Host = u.Host
+		}
+	} else {
+		request.Path = r.URL.Path
+	}
+
+	if request.Host == "" {
+		request.Host = r.Host
+	}
+	if request.Method == "" {
+		request.Method = r.Method
+	}
+	return request, true
+}
+
+func firstHeader(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
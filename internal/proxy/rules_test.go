@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bytes"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"github.com/ozankasikci/one-oauth/internal/policy"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateLogsDenialsOnly(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	p := newTestProxy(t, SetExpression(`"admins" in user.groups && user.claims.level > 1`))
+	input := func(groups ...string) *policy.Input {
+		return &policy.Input{
+			Request: policy.Request{Host: "app.example.com", Path: "/", Method: "GET"},
+			User:    &policy.User{Subject: "1", Provider: "idp", Groups: groups, Claims: map[string]interface{}{"level": 2.0}},
+		}
+	}
+
+	if err := p.evaluate(input("admins")); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("allowed request logged %q", buf.String())
+	}
+
+	if err := p.evaluate(input("eng")); err == nil {
+		t.Error("want a denial")
+	}
+	if !strings.Contains(buf.String(), "expression denied idp user \"1\"") {
+		t.Errorf("log = %q, want the denial", buf.String())
+	}
+
+	buf.Reset()
+	denied := input("admins")
+	denied.User.Claims = nil
+	if err := p.evaluate(denied); err == nil {
+		t.Error("want a denial")
+	}
+	if !strings.Contains(buf.String(), "expression failed for idp user") {
+		t.Errorf("log = %q, want the evaluation error", buf.String())
+	}
+}
+
+func TestDebugLogsAllowedDecisions(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	rule := &policy.Rule{Name: "admins", Paths: []string{"/admin"}, AnyOf: policy.Requirement{Groups: []string{"eng"}}}
+	request := policy.Request{Host: "app.example.com", Path: "/admin", Method: "GET"}
+	for _, debug := range []bool{false, true} {
+		buf.Reset()
+		p := newTestProxy(t, AddRules(rule), SetExpression(`user.email_verified`), SetDebug(debug))
+		if !p.authorize(request, alice, nil) {
+			t.Fatal("denied")
+		}
+		logged := buf.String()
+		if !debug && logged != "" {
+			t.Errorf("allowed request logged without debug: %q", logged)
+		}
+		if debug && (!strings.Contains(logged, `rule admins allowed idp user "1" GET app.example.com/admin`) ||
+			!strings.Contains(logged, `expression allowed idp user "1"`)) {
+			t.Errorf("log = %q, want the allowing rule and expression", logged)
+		}
+	}
+
+	// requests no rule matches are logged as such
+	buf.Reset()
+	p := newTestProxy(t, AddRules(rule), SetDebug(true))
+	if !p.authorize(policy.Request{Host: "app.example.com", Path: "/docs", Method: "GET"}, alice, nil) {
+		t.Fatal("denied")
+	}
+	if !strings.Contains(buf.String(), "rule (none matched) allowed") {
+		t.Errorf("log = %q", buf.String())
+	}
+}
+
+func TestSignInRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		returnTo string
+		want     policy.Request
+	}{
+		{"absolute", "https://app.example.com/docs?page=2", policy.Request{Host: "app.example.com", Path: "/docs", Method: "GET"}},
+		{"relative", "/admin/users", policy.Request{Host: "auth.example.com", Path: "/admin/users", Method: "GET"}},
+		{"none", "", policy.Request{}},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "https://auth.example.com/auth/idp/callback?code=code", nil)
+		if test.returnTo != "" {
+			r = r.WithContext(flow.WithReturnTo(r.Context(), test.returnTo))
+		}
+		if got := signInRequest(r); got != test.want {
+			t.Errorf("%s: request = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	// the expression sees where users return to, not the callback
+	p := newTestProxy(t, SetExpression(`!request.path.startsWith("/admin") || "admins" in user.groups`))
+	authorize := func(returnTo string) error {
+		r := httptest.NewRequest(http.MethodGet, "/auth/idp/callback", nil)
+		return p.authorizer().Authorize(r.WithContext(flow.WithReturnTo(r.Context(), returnTo)), alice)
+	}
+	if err := authorize("/docs"); err != nil {
+		t.Errorf("returning to /docs: %v", err)
+	}
+	if err := authorize("/admin"); err == nil {
+		t.Error("signed in to return to /admin without the admins group")
+	}
+}
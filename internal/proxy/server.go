@@ -0,0 +1,54 @@
+package proxy
+
+import "time"
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 60 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultShutdownTimeout   = 30 * time.Second
+	// room for several session cookies on top of regular headers
+	defaultMaxHeaderBytes = 64 << 10
+)
+
+// ServerConfig tunes the http.Server the proxy listens with. Zero values
+// select the defaults.
+type ServerConfig struct {
+	// ReadHeaderTimeout defaults to 10 seconds.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout covers reading the whole request; defaults to 30 seconds.
+	ReadTimeout time.Duration
+	// WriteTimeout covers writing the response, including proxied upstream
+	// responses; defaults to 60 seconds.
+	WriteTimeout time.Duration
+	// IdleTimeout closes idle keep-alive connections; defaults to 2 minutes.
+	IdleTimeout time.Duration
+	// MaxHeaderBytes defaults to 64 KiB.
+	MaxHeaderBytes int
+	// ShutdownTimeout bounds draining connections when the context passed
+	// to Start is done; defaults to 30 seconds.
+	ShutdownTimeout time.Duration
+}
+
+func (t ServerConfig) withDefaults() ServerConfig {
+	if t.ReadHeaderTimeout == 0 {
+		t.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if t.ReadTimeout == 0 {
+		t.ReadTimeout = defaultReadTimeout
+	}
+	if t.WriteTimeout == 0 {
+		t.WriteTimeout = defaultWriteTimeout
+	}
+	if t.IdleTimeout == 0 {
+		t.IdleTimeout = defaultIdleTimeout
+	}
+	if t.MaxHeaderBytes == 0 {
+		t.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if t.ShutdownTimeout == 0 {
+		t.ShutdownTimeout = defaultShutdownTimeout
+	}
+	return t
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/dghubble/gologin/v2"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// SignInPath serves the sign-in page listing the configured providers.
+const SignInPath = "/auth/sign_in"
+
+// error codes of failed callbacks, passed to the sign-in page as the error
+// parameter; the page only shows messages for codes it knows, so the
+// parameter cannot be used to put arbitrary text on it
+const (
+	signInErrorDenied  = "denied"
+	signInErrorExpired = "expired"
+	signInErrorFailed  = "failed"
+)
+
+var signInErrorMessages = map[string]string{
+	signInErrorDenied:  "Sign in was cancelled or denied by the provider.",
+	signInErrorExpired: "Your sign in attempt expired. Please try again.",
+	signInErrorFailed:  "Sign in failed. Please try again.",
+}
+
+// display names of the built-in provider types, used when a provider sets
+// none
+var providerDisplayNames = map[string]string{
+	"google":   "Google",
+	"github":   "GitHub",
+	"facebook": "Facebook",
+	"oidc":     "OpenID Connect",
+	"generic":  "OAuth 2.0",
+}
+
+// SignInConfig customizes the sign-in page.
+type SignInConfig struct {
+	// Title defaults to "Sign in".
+	Title string
+	// Template is html/template source parsed over the default page, so it
+	// may redefine any of its "title", "style", "header", "providers" and
+	// "footer" templates, or the whole "sign_in" page. It is executed with
+	// a SignInPage.
+	Template string
+	// CSS is appended to the default style sheet.
+	CSS string
+}
+
+// SignInPage is the data the sign-in template is executed with.
+type SignInPage struct {
+	Title     string
+	Providers []SignInProvider
+	// ReturnTo is the validated URL users return to after signing in.
+	ReturnTo string
+	// Error describes why the last sign in failed, if it did.
+	Error string
+	CSS   template.CSS
+}
+
+// SignInProvider is a provider as listed on the sign-in page.
+type SignInProvider struct {
+	Name        string
+	DisplayName string
+	Icon        template.URL
+	// Initial is the first letter of DisplayName, shown without an icon.
+	Initial string
+	// LoginURL starts the login, keeping the return URL.
+	LoginURL string
+}
+
+var signInTemplate = template.Must(template.New("sign_in").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{block "title" .}}{{.Title}}{{end}}</title>
+<style>
+{{block "style" .}}body { font-family: sans-serif; max-width: 24em; margin: 4em auto; padding: 0 1em; color: #222; }
+h1 { font-size: 1.5em; }
+.error { padding: .75em 1em; border-radius: 4px; background: #fdecea; color: #8a1c1c; }
+.providers { list-style: none; padding: 0; }
+.providers li { margin: .5em 0; }
+.providers a { display: flex; align-items: center; padding: .75em 1em; border: 1px solid #ccc; border-radius: 4px; color: inherit; text-decoration: none; }
+.providers a:hover { background: #f5f5f5; }
+.providers img, .providers .initial { width: 1.5em; height: 1.5em; margin-right: .75em; }
+.providers .initial { display: inline-block; border-radius: 50%; background: #ddd; text-align: center; line-height: 1.5em; }
+{{end}}{{.CSS}}
+</style>
+</head>
+<body>
+{{block "header" .}}<h1>{{.Title}}</h1>
+{{end}}{{if .Error}}<p class="error">{{.Error}}</p>
+{{end}}{{block "providers" .}}<ul class="providers">
+{{range .Providers}}<li><a href="{{.LoginURL}}">{{if .Icon}}<img src="{{.Icon}}" alt="">{{else}}<span class="initial">{{.Initial}}</span>{{end}}Sign in with {{.DisplayName}}</a></li>
+{{else}}<li>No sign in methods are configured.</li>
+{{end}}</ul>
+{{end}}{{block "footer" .}}{{end}}</body>
+</html>
+`))
+
+// newSignInTemplate parses config's template over the default page.
+func newSignInTemplate(config *SignInConfig) (*template.Template, error) {
+	if config == nil || config.Template == "" {
+		return signInTemplate, nil
+	}
+	tmpl, err := template.Must(signInTemplate.Clone()).Parse(config.Template)
+	if err != nil {
+		return nil, errors.New("proxy: sign-in template: " + strings.TrimPrefix(err.Error(), "template: "))
+	}
+	return tmpl, nil
+}
+
+// SignInHandler renders the sign-in page. A valid rd or return_to parameter
+// is passed on to the providers' login, and a known error code is shown as
+// a message.
+func (t *Proxy) SignInHandler() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		returnTo := query.Get("rd")
+		if returnTo == "" {
+			returnTo = query.Get("return_to")
+		}
+		if returnTo != "" {
+			var err error
+			if returnTo, err = t.ReturnTo.Validate(returnTo); err != nil {
+				returnTo = ""
+			}
+		}
+
+		page := SignInPage{
+			Title:    "Sign in",
+			ReturnTo: returnTo,
+			Error:    signInErrorMessages[query.Get("error")],
+		}
+		if signIn := t.Config.SignIn; signIn != nil {
+			if signIn.Title != "" {
+				page.Title = signIn.Title
+			}
+			page.CSS = template.CSS(signIn.CSS)
+		}
+		for _, name := range t.signInProviderNames() {
+			page.Providers = append(page.Providers, t.signInProvider(name, returnTo))
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := t.signInTemplate.Execute(w, page); err != nil {
+			log.Printf("proxy: sign-in page: %v", err)
+		}
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// signInProviderNames returns the provider names by their configured order,
+// then by name.
+func (t *Proxy) signInProviderNames() []string {
+	names := t.providerNames()
+	sort.SliceStable(names, func(i, j int) bool {
+		return t.providerDisplay(names[i]).Order < t.providerDisplay(names[j]).Order
+	})
+	return names
+}
+
+func (t *Proxy) providerDisplay(name string) ProviderDisplay {
+	if providerConfig, ok := t.Config.Providers[name]; ok {
+		return providerConfig.Display
+	}
+	return ProviderDisplay{}
+}
+
+func (t *Proxy) signInProvider(name, returnTo string) SignInProvider {
+	display := t.providerDisplay(name)
+	p := SignInProvider{
+		Name:        name,
+		DisplayName: display.Name,
+		// icons come from the configuration, which may use data: URLs
+		Icon:     template.URL(display.Icon),
+		LoginURL: t.proxyURL("/auth/"+name+"/login", url.Values{"rd": {returnTo}}),
+	}
+	if p.DisplayName == "" {
+		p.DisplayName = providerDisplayNames[t.Config.Providers[name].Type]
+	}
+	if p.DisplayName == "" {
+		p.DisplayName = name
+	}
+	for _, r := range p.DisplayName {
+		p.Initial = strings.ToUpper(string(r))
+		break
+	}
+	return p
+}
+
+// signInFailure sends users whose callback failed back to the sign-in page,
+// with an error code and the URL they were returning to.
+func (t *Proxy) signInFailure(name string) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		err := gologin.ErrorFromContext(r.Context())
+		log.Printf("sign in with %s failed: %v", name, err)
+
+		code := signInErrorFailed
+		var authorizationErr *flow.AuthorizationError
+		switch {
+		case errors.As(err, &authorizationErr) && authorizationErr.Code == "access_denied":
+			code = signInErrorDenied
+		case err == flow.ErrMissingCookie || err == flow.ErrInvalidState:
+			code = signInErrorExpired
+		}
+
+		returnTo, _ := flow.ReturnToFromContext(r.Context())
+		http.Redirect(w, r, t.proxyURL(SignInPath, url.Values{"rd": {returnTo}, "error": {code}}), http.StatusFound)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// proxyURL returns path on the proxy, absolute when ExternalURL is set, with
+// the non-empty query values.
+func (t *Proxy) proxyURL(path string, values url.Values) string {
+	query := url.Values{}
+	for key, value := range values {
+		if len(value) > 0 && value[0] != "" {
+			query[key] = value
+		}
+	}
+
+	u := strings.TrimSuffix(t.Config.ExternalURL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/ozankasikci/one-oauth/internal/flow"
+	"github.com/ozankasikci/one-oauth/internal/redirect"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// signInPage returns the sign-in page at target.
+func signInPage(t *testing.T, p *Proxy, target string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	p.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s = %d", target, w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestSignInPage(t *testing.T) {
+	p := newTestProxy(t,
+		SetExternalURL("https://auth.example.com"),
+		AddProvider("work", "generic", genericConfig("work")),
+		SetProviderDisplay("work", ProviderDisplay{Name: "Work SSO", Order: -1}),
+		AddReturnToAllowlist(&redirect.Allowlist{Hosts: []string{"app.example.com"}}),
+	)
+
+	page := signInPage(t, p, SignInPath+"?rd="+url.QueryEscape("https://app.example.com/docs"))
+	work := strings.Index(page, "Sign in with Work SSO")
+	idp := strings.Index(page, "Sign in with OAuth 2.0")
+	if work < 0 || idp < 0 || work > idp {
+		t.Errorf("providers not listed by order:\n%s", page)
+	}
+	if !strings.Contains(page, `href="https://auth.example.com/auth/idp/login?rd=https%3A%2F%2Fapp.example.com%2Fdocs"`) {
+		t.Errorf("login URL does not keep the return URL:\n%s", page)
+	}
+	if strings.Contains(page, `class="error"`) {
+		t.Errorf("error shown without one:\n%s", page)
+	}
+
+	// invalid return URLs and unknown error codes are dropped
+	page = signInPage(t, p, SignInPath+"?rd=https://evil.com/&error=<script>")
+	if strings.Contains(page, "evil.com") || strings.Contains(page, "script") || strings.Contains(page, `class="error"`) {
+		t.Errorf("page shows untrusted input:\n%s", page)
+	}
+}
+
+func TestSignInFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		message string
+	}{
+		{"denied", &flow.AuthorizationError{Code: "access_denied"}, signInErrorMessages[signInErrorDenied]},
+		{"expired", flow.ErrInvalidState, signInErrorMessages[signInErrorExpired]},
+		{"failed", errors.New("userinfo: internal detail"), signInErrorMessages[signInErrorFailed]},
+	}
+	p := newTestProxy(t)
+	for _, test := range tests {
+		// a provider failing its callback with flow.Fail
+		r := httptest.NewRequest(http.MethodGet, "/auth/idp/callback", nil)
+		r = r.WithContext(flow.WithFailureHandler(r.Context(), p.signInFailure("idp")))
+		w := httptest.NewRecorder()
+		flow.Fail(w, r, test.err)
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		if w.Code != http.StatusFound || err != nil || location.Path != SignInPath {
+			t.Errorf("%s: %d to %q, want the sign-in page", test.name, w.Code, w.Header().Get("Location"))
+			continue
+		}
+		page := signInPage(t, p, location.String())
+		if !strings.Contains(page, `<p class="error">`+template.HTMLEscapeString(test.message)) || strings.Contains(page, "internal detail") {
+			t.Errorf("%s: page does not show %q:\n%s", test.name, test.message, page)
+		}
+	}
+}
+
+// TestCallbackFailure logs in through a provider whose userinfo endpoint
+// fails, and checks that users land on the sign-in page with a generic
+// message and the URL they were returning to.
+func TestCallbackFailure(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "token", "token_type": "Bearer"}`))
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal detail", http.StatusInternalServerError)
+	})
+	idp := httptest.NewServer(mux)
+	defer idp.Close()
+
+	config := genericConfig("idp")
+	config.TokenURL = idp.URL + "/token"
+	config.UserInfoURL = idp.URL + "/userinfo"
+	p := newTestProxy(t, AddProvider("idp", "generic", config), AddReturnToAllowlist(&redirect.Allowlist{Hosts: []string{"app.example.com"}}))
+
+	w := httptest.NewRecorder()
+	p.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/idp/login?rd="+url.QueryEscape("https://app.example.com/docs"), nil))
+	authorize, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil {
+		t.Fatalf("login = %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	r := httptest.NewRequest(http.MethodGet, "/auth/idp/callback?code=code&state="+url.QueryEscape(authorize.Query().Get("state")), nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	p.Router.ServeHTTP(w, r)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil || location.Path != SignInPath || location.Query().Get("rd") != "https://app.example.com/docs" {
+		t.Fatalf("callback = %d to %q, want the sign-in page", w.Code, w.Header().Get("Location"))
+	}
+	page := signInPage(t, p, location.String())
+	if !strings.Contains(page, signInErrorMessages[signInErrorFailed]) || strings.Contains(page, "internal detail") {
+		t.Errorf("page does not show the failure:\n%s", page)
+	}
+
+	// without the login cookie the attempt has expired
+	w = httptest.NewRecorder()
+	p.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/idp/callback?code=code&state=state", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != SignInPath+"?error="+signInErrorExpired {
+		t.Errorf("callback without cookie = %d to %q", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultCertReloadInterval = 10 * time.Second
+
+// ClientCertProvider is the User.Provider of callers authenticated by a
+// verified client certificate.
+const ClientCertProvider = "client-certificate"
+
+// TLSConfig makes the proxy serve HTTPS with either a certificate from
+// files or certificates obtained through ACME.
+type TLSConfig struct {
+	// CertFile and KeyFile are PEM files, reloaded when they change so
+	// renewed certificates are picked up without a restart.
+	CertFile string
+	KeyFile  string
+	// ACME obtains certificates automatically instead of CertFile and
+	// KeyFile.
+	ACME *ACMEConfig
+	// ReloadInterval is how often handshakes check the files for changes;
+	// defaults to 10 seconds.
+	ReloadInterval time.Duration
+	// MinVersion defaults to TLS 1.2.
+	MinVersion uint16
+	// CipherSuites restricts the TLS 1.0-1.2 cipher suites; nil selects Go's
+	// defaults. TLS 1.3 suites are not configurable.
+	CipherSuites []uint16
+	// ClientCAFile enables client certificates verified against the PEM CA
+	// bundle. In reverse proxy mode, requests with a verified certificate
+	// are authenticated as ClientCertProvider users without a session;
+	// forward-auth ignores certificates, which belong to the proxy in front.
+	ClientCAFile string
+	// ClientAuth defaults to tls.VerifyClientCertIfGiven when ClientCAFile
+	// is set, so browsers can still sign in; use
+	// tls.RequireAndVerifyClientCert to only admit machine callers.
+	ClientAuth tls.ClientAuthType
+	// RedirectAddress, e.g. ":80", listens for plain HTTP and redirects
+	// every request to HTTPS, answering ACME HTTP-01 challenges.
+	RedirectAddress string
+}
+
+func AddTLSConfig(config *TLSConfig) func(*Config) {
+	return func(c *Config) {
+		c.TLS = config
+	}
+}
+
+// build returns the tls.Config, failing if the certificate or CA bundle
+// cannot be loaded. With ACME it also returns the manager, whose HTTP
+// handler answers HTTP-01 challenges; hosts lists the default ACME hosts.
+func (t *TLSConfig) build(hosts func() []string) (*tls.Config, *autocert.Manager, error) {
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	var manager *autocert.Manager
+	nextProtos := []string{"h2", "http/1.1"}
+
+	switch {
+	case t.ACME != nil && (t.CertFile != "" || t.KeyFile != ""):
+		return nil, nil, errors.New("proxy: TLS uses either certificate files or ACME")
+	case t.ACME != nil:
+		var err error
+		manager, err = t.ACME.manager(hosts)
+		if err != nil {
+			return nil, nil, err
+		}
+		getCertificate = manager.GetCertificate
+		// answers TLS-ALPN-01 challenges
+		nextProtos = append(nextProtos, acme.ALPNProto)
+	case t.CertFile == "" || t.KeyFile == "":
+		return nil, nil, errors.New("proxy: TLS requires a certificate and key file")
+	default:
+		certificate := &certificateFile{
+			certFile: t.CertFile,
+			keyFile:  t.KeyFile,
+			interval: t.ReloadInterval,
+		}
+		if certificate.interval <= 0 {
+			certificate.interval = defaultCertReloadInterval
+		}
+		if err := certificate.load(); err != nil {
+			return nil, nil, err
+		}
+		getCertificate = certificate.GetCertificate
+	}
+
+	config := &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     t.MinVersion,
+		CipherSuites:   t.CipherSuites,
+		ClientAuth:     t.ClientAuth,
+		NextProtos:     nextProtos,
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	if t.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("proxy: client CA: %v", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("proxy: client CA: no certificates in %s", t.ClientCAFile)
+		}
+		if config.ClientAuth == tls.NoClientCert {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	} else if config.ClientAuth >= tls.VerifyClientCertIfGiven {
+		return nil, nil, errors.New("proxy: verifying client certificates requires a client CA file")
+	}
+
+	return config, manager, nil
+}
+
+// certificateFile serves a key pair from disk, reloading it when either
+// file's modification time changes. A failed reload keeps the previous pair.
+type certificateFile struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+	checked     time.Time
+}
+
+func (t *certificateFile) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.checked) >= t.interval {
+		t.checked = time.Now()
+		if t.latestModTime().After(t.modTime) {
+			if err := t.loadLocked(); err != nil {
+				log.Printf("proxy: keeping the current certificate: %v", err)
+			} else {
+				log.Printf("proxy: reloaded certificate %s", t.certFile)
+			}
+		}
+	}
+	return t.certificate, nil
+}
+
+func (t *certificateFile) load() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.checked = time.Now()
+	return t.loadLocked()
+}
+
+func (t *certificateFile) loadLocked() error {
+	modTime := t.latestModTime()
+	certificate, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return fmt.Errorf("proxy: certificate: %v", err)
+	}
+	t.certificate = &certificate
+	t.modTime = modTime
+	return nil
+}
+
+func (t *certificateFile) latestModTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{t.certFile, t.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// clientCertUser returns the caller identified by a verified client
+// certificate: the subject common name, or the first DNS name, and the
+// first email address.
+func clientCertUser(r *http.Request) (*provider.User, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	certificate := r.TLS.VerifiedChains[0][0]
+	user := &provider.User{
+		Subject:  certificate.Subject.CommonName,
+		Provider: ClientCertProvider,
+	}
+	if user.Subject == "" && len(certificate.DNSNames) > 0 {
+		user.Subject = certificate.DNSNames[0]
+	}
+	if len(certificate.EmailAddresses) > 0 {
+		user.Email = certificate.EmailAddresses[0]
+		user.EmailVerified = true
+	}
+	if user.Subject == "" {
+		user.Subject = user.Email
+	}
+	return user, user.Subject != ""
+}
+
+// RedirectHandler permanently redirects plain HTTP requests to the same host,
+// path and query over HTTPS, on the port of the TLS listener at httpsAddr.
+// 308 keeps the method and body of non-GET requests.
+func RedirectHandler(httpsAddr net.Addr) http.Handler {
+	port := ""
+	if addr, ok := httpsAddr.(*net.TCPAddr); ok && addr.Port != 443 {
+		port = ":" + strconv.Itoa(addr.Port)
+	}
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "" {
+			http.Error(w, "missing Host header", http.StatusBadRequest)
+			return
+		}
+		target := "https://" + stripPort(r.Host) + port + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for commonName and its
+// key to certFile and keyFile, dated modTime.
+func writeCertificate(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	}
+	for path, block := range files {
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedName returns the common name of the certificate listener presents.
+func servedName(t *testing.T, listener net.Listener) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := tempDir(t)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	modTime := time.Now().Add(-time.Minute)
+	writeCertificate(t, certFile, keyFile, "first", modTime)
+
+	tlsConfig, _, err := (&TLSConfig{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Nanosecond}).build(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.NotFoundHandler())
+
+	if name := servedName(t, listener); name != "first" {
+		t.Fatalf("served %q, want first", name)
+	}
+
+	// a renewed certificate is served on the next handshake
+	modTime = modTime.Add(time.Second)
+	writeCertificate(t, certFile, keyFile, "renewed", modTime)
+	if name := servedName(t, listener); name != "renewed" {
+		t.Errorf("served %q after renewal, want renewed", name)
+	}
+
+	// an unreadable pair keeps the previous certificate
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime = modTime.Add(time.Second)
+	os.Chtimes(keyFile, modTime, modTime)
+	if name := servedName(t, listener); name != "renewed" {
+		t.Errorf("served %q after a broken renewal, want renewed", name)
+	}
+}
+
+func TestCertificateReloadInterval(t *testing.T) {
+	dir := tempDir(t)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	modTime := time.Now().Add(-time.Minute)
+	writeCertificate(t, certFile, keyFile, "first", modTime)
+
+	certificate := &certificateFile{certFile: certFile, keyFile: keyFile, interval: time.Hour}
+	if err := certificate.load(); err != nil {
+		t.Fatal(err)
+	}
+	writeCertificate(t, certFile, keyFile, "renewed", modTime.Add(time.Second))
+
+	// the files are not checked again within the interval
+	served, _ := certificate.GetCertificate(nil)
+	if leaf, _ := x509.ParseCertificate(served.Certificate[0]); leaf.Subject.CommonName != "first" {
+		t.Errorf("served %q within the interval, want first", leaf.Subject.CommonName)
+	}
+	certificate.checked = certificate.checked.Add(-time.Hour)
+	served, _ = certificate.GetCertificate(nil)
+	if leaf, _ := x509.ParseCertificate(served.Certificate[0]); leaf.Subject.CommonName != "renewed" {
+		t.Errorf("served %q after the interval, want renewed", leaf.Subject.CommonName)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		addr   net.Addr
+		method string
+		target string
+		host   string
+		want   string
+	}{
+		{"default port", &net.TCPAddr{Port: 443}, http.MethodGet, "/docs?page=2&q=a%20b", "app.example.com", "https://app.example.com/docs?page=2&q=a%20b"},
+		{"HTTP port dropped", &net.TCPAddr{Port: 443}, http.MethodGet, "/", "app.example.com:80", "https://app.example.com/"},
+		{"TLS port", &net.TCPAddr{Port: 8443}, http.MethodGet, "/docs", "app.example.com:8080", "https://app.example.com:8443/docs"},
+		{"IPv6", &net.TCPAddr{Port: 443}, http.MethodGet, "/", "[::1]:80", "https://[::1]/"},
+		{"POST", &net.TCPAddr{Port: 443}, http.MethodPost, "/form?a=1", "app.example.com", "https://app.example.com/form?a=1"},
+		{"unix socket", &net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}, http.MethodGet, "/", "app.example.com", "https://app.example.com/"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		RedirectHandler(test.addr).ServeHTTP(w, r)
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != test.want {
+			t.Errorf("%s: %d to %q, want 308 to %q", test.name, w.Code, w.Header().Get("Location"), test.want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = ""
+	w := httptest.NewRecorder()
+	RedirectHandler(&net.TCPAddr{Port: 443}).ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("without Host = %d, want 400", w.Code)
+	}
+}
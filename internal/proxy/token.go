@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"github.com/ozankasikci/one-oauth/internal/session"
+	"golang.org/x/oauth2"
+	"net/http"
+	"time"
+)
+
+// HeaderForwardedAccessToken carries the user's upstream OAuth2 access token
+// when Config.PassAccessToken is set.
+const HeaderForwardedAccessToken = "X-Forwarded-Access-Token"
+
+type tokenResponse struct {
+	AccessToken string     `json:"access_token"`
+	TokenType   string     `json:"token_type,omitempty"`
+	Expiry      *time.Time `json:"expiry,omitempty"`
+}
+
+// TokenHandler returns the session's access token, refreshed if expired, as
+// JSON for the given provider.
+func (t *Proxy) TokenHandler(p provider.TokenProvider) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		token, err := p.Token(w, r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		res := tokenResponse{
+			AccessToken: token.AccessToken,
+			TokenType:   token.Type(),
+		}
+		if !token.Expiry.IsZero() {
+			res.Expiry = &token.Expiry
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// sessionTokenProvider is implemented by providers returning the token of
+// a session already loaded by authenticate.
+type sessionTokenProvider interface {
+	SessionToken(ctx context.Context, s *session.Session) (*oauth2.Token, error)
+}
+
+// accessToken returns the access token of s, the session of user, or "" if
+// tokens are not passed or unavailable.
+func (t *Proxy) accessToken(ctx context.Context, user *provider.User, s *session.Session) string {
+	if !t.Config.PassAccessToken || s == nil {
+		return ""
+	}
+
+	p, ok := t.Providers[user.Provider].(sessionTokenProvider)
+	if !ok {
+		return ""
+	}
+
+	token, err := p.SessionToken(ctx, s)
+	if err != nil {
+		return ""
+	}
+	return token.AccessToken
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"github.com/ozankasikci/one-oauth/internal/session"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// headers set on successful forward-auth responses
+const (
+	HeaderAuthUser     = "X-Auth-User"
+	HeaderAuthEmail    = "X-Auth-Email"
+	HeaderAuthProvider = "X-Auth-Provider"
+	// HeaderAuthGroups is a comma separated list, omitted without groups.
+	HeaderAuthGroups   = "X-Auth-Groups"
+	HeaderAuthRedirect = "X-Auth-Redirect"
+)
+
+// VerifyHandler answers nginx auth_request and Traefik/Caddy forwardAuth
+// subrequests: 200 with identity headers when any configured provider has a
+// valid session, 401 with a login hint in X-Auth-Redirect otherwise, and 403
+// when a rule denies the signed in user the original request.
+func (t *Proxy) VerifyHandler() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		user, s, ok := t.authenticate(w, r)
+		if !ok {
+			if redirect := t.loginURL(originalURL(r)); redirect != "" {
+				w.Header().Set(HeaderAuthRedirect, redirect)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		request, ok := forwardedRequest(r)
+		if !ok {
+			http.Error(w, "invalid forwarded URI", http.StatusBadRequest)
+			return
+		}
+		if !t.authorize(request, user, s) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set(HeaderAuthUser, user.Subject)
+		w.Header().Set(HeaderAuthEmail, user.Email)
+		w.Header().Set(HeaderAuthProvider, user.Provider)
+		if len(user.Groups) > 0 {
+			w.Header().Set(HeaderAuthGroups, strings.Join(user.Groups, ","))
+		}
+		if accessToken := t.accessToken(r.Context(), user, s); accessToken != "" {
+			w.Header().Set(HeaderForwardedAccessToken, accessToken)
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// sessionProvider is implemented by providers exposing the session behind
+// Authenticate.
+type sessionProvider interface {
+	Session(w http.ResponseWriter, r *http.Request) (*session.Session, error)
+}
+
+// authenticate returns the user of the first provider, by name, holding a
+// valid session for the request, along with the session if the provider
+// exposes it. Client certificates are not considered: forward-auth
+// subrequests carry the certificate of the proxy in front, not the user's.
+func (t *Proxy) authenticate(w http.ResponseWriter, r *http.Request) (*provider.User, *session.Session, bool) {
+	for _, name := range t.providerNames() {
+		p := t.Providers[name]
+		if sessions, ok := p.(sessionProvider); ok {
+			if s, err := sessions.Session(w, r); err == nil {
+				return s.User, s, true
+			}
+			continue
+		}
+		if user, err := p.Authenticate(w, r); err == nil {
+			return user, nil, true
+		}
+	}
+	return nil, nil, false
+}
+
+// loginURL returns the sign-in page unauthenticated users should be sent to,
+// returning to returnTo afterwards if set, or "" without providers.
+func (t *Proxy) loginURL(returnTo string) string {
+	if len(t.Providers) == 0 {
+		return ""
+	}
+	return t.proxyURL(SignInPath, url.Values{"rd": {returnTo}})
+}
+
+// originalURL returns the URL of the original request of a forward-auth
+// subrequest, or "" if the headers do not describe it.
+func originalURL(r *http.Request) string {
+	if u := r.Header.Get("X-Original-URL"); u != "" {
+		return u
+	}
+
+	uri := firstHeader(r, "X-Forwarded-Uri", "X-Original-URI")
+	host := r.Header.Get("X-Forwarded-Host")
+	if uri == "" || host == "" {
+		return ""
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto != "http" && proto != "https" {
+		proto = "https"
+	}
+	return proto + "://" + host + uri
+}
+
+func (t *Proxy) providerNames() []string {
+	names := make([]string, 0, len(t.Providers))
+	for name := range t.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/policy"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	genericprovider "github.com/ozankasikci/one-oauth/internal/provider/generic"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func genericConfig(name string) *genericprovider.Config {
+	return &genericprovider.Config{
+		CookieSessionName:          "one-oauth-" + name,
+		CookieSessionSecret:        "test cookie secret, at least 32 bytes",
+		ClientID:                   "client",
+		ClientSecret:               "secret",
+		AuthURL:                    "https://idp.example.com/authorize",
+		TokenURL:                   "https://idp.example.com/token",
+		UserInfoURL:                "https://idp.example.com/userinfo",
+		RedirectURL:                "https://auth.example.com/auth/" + name + "/callback",
+		UpstreamSuccessRedirectURL: "https://app.example.com/",
+		Cookie:                     &cookie.Dev,
+	}
+}
+
+func newTestProxy(t *testing.T, options ...func(*Config)) *Proxy {
+	t.Helper()
+	options = append([]func(*Config){AddProvider("idp", "generic", genericConfig("idp"))}, options...)
+	p, err := New(NewConfig("4999", options...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// signIn issues a session of the provider added under name to user and
+// returns its cookies.
+func signIn(t *testing.T, p *Proxy, name string, user *provider.User) []*http.Cookie {
+	t.Helper()
+	generic, ok := p.Providers[name].(genericprovider.GenericProvider)
+	if !ok {
+		t.Fatalf("%s is a %T", name, p.Providers[name])
+	}
+	w := httptest.NewRecorder()
+	if _, err := generic.Sessions.Issue(w, httptest.NewRequest(http.MethodGet, "/", nil), user, &oauth2.Token{AccessToken: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()
+}
+
+// verify sends a forward-auth subrequest for the original request to uri
+// on app.example.com.
+func verify(p *Proxy, uri string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/auth/verify", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "app.example.com")
+	r.Header.Set("X-Forwarded-Uri", uri)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	p.Router.ServeHTTP(w, r)
+	return w
+}
+
+var alice = &provider.User{Subject: "1", Provider: "idp", Email: "alice@example.com", EmailVerified: true, Groups: []string{"eng", "ops"}}
+
+func TestVerify(t *testing.T) {
+	p := newTestProxy(t)
+	w := verify(p, "/docs", signIn(t, p, "idp", alice))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	headers := map[string]string{
+		HeaderAuthUser:     "1",
+		HeaderAuthEmail:    "alice@example.com",
+		HeaderAuthProvider: "idp",
+		HeaderAuthGroups:   "eng,ops",
+		HeaderAuthRedirect: "",
+		"Cache-Control":    "no-store",
+	}
+	for header, want := range headers {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	// another provider's session is accepted too
+	p = newTestProxy(t, AddProvider("other", "generic", genericConfig("other")))
+	if w := verify(p, "/docs", signIn(t, p, "other", alice)); w.Code != http.StatusOK {
+		t.Errorf("other provider = %d, want 200", w.Code)
+	}
+}
+
+func TestVerifyUnauthenticated(t *testing.T) {
+	p := newTestProxy(t, SetExternalURL("https://auth.example.com/"))
+
+	tests := []struct {
+		name    string
+		cookies []*http.Cookie
+	}{
+		{"no session", nil},
+		{"unknown session", []*http.Cookie{{Name: "one-oauth-idp", Value: "forged"}}},
+	}
+	for _, test := range tests {
+		w := verify(p, "/docs?page=2", test.cookies)
+		if w.Code != http.StatusUnauthorized || w.Header().Get(HeaderAuthUser) != "" {
+			t.Errorf("%s: status = %d with user %q, want 401", test.name, w.Code, w.Header().Get(HeaderAuthUser))
+		}
+		// browsers are sent to the sign-in page, returning to the original URL
+		if got, want := w.Header().Get(HeaderAuthRedirect), "https://auth.example.com/auth/sign_in?rd=https%3A%2F%2Fapp.example.com%2Fdocs%3Fpage%3D2"; got != want {
+			t.Errorf("%s: %s = %q, want %q", test.name, HeaderAuthRedirect, got, want)
+		}
+	}
+
+	// X-Original-URL, as sent by nginx, wins
+	r := httptest.NewRequest(http.MethodGet, "/auth/verify", nil)
+	r.Header.Set("X-Original-URL", "http://app.example.com/admin")
+	w := httptest.NewRecorder()
+	p.Router.ServeHTTP(w, r)
+	if got := w.Header().Get(HeaderAuthRedirect); got != "https://auth.example.com/auth/sign_in?rd=http%3A%2F%2Fapp.example.com%2Fadmin" {
+		t.Errorf("%s = %q", HeaderAuthRedirect, got)
+	}
+}
+
+func TestVerifyRules(t *testing.T) {
+	admins := &policy.Rule{Name: "admins", Paths: []string{"/admin"}, AnyOf: policy.Requirement{Groups: []string{"admins"}}}
+	p := newTestProxy(t, AddRules(admins))
+	cookies := signIn(t, p, "idp", alice)
+
+	if w := verify(p, "/admin/users", cookies); w.Code != http.StatusForbidden || w.Header().Get(HeaderAuthUser) != "" {
+		t.Errorf("denied = %d with user %q, want 403", w.Code, w.Header().Get(HeaderAuthUser))
+	}
+	if w := verify(p, "/administrator", cookies); w.Code != http.StatusOK {
+		t.Errorf("unmatched path = %d, want 200", w.Code)
+	}
+
+	admin := *alice
+	admin.Groups = []string{"admins"}
+	if w := verify(p, "/admin/users", signIn(t, p, "idp", &admin)); w.Code != http.StatusOK {
+		t.Errorf("allowed = %d, want 200", w.Code)
+	}
+}
+
+// withClientCert returns r as if received over TLS with a verified client
+// certificate.
+func withClientCert(r *http.Request, commonName string) *http.Request {
+	certificate := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+	r.TLS = &tls.ConnectionState{
+		HandshakeComplete: true,
+		PeerCertificates:  []*x509.Certificate{certificate},
+		VerifiedChains:    [][]*x509.Certificate{{certificate}},
+	}
+	return r
+}
+
+func TestVerifyIgnoresClientCert(t *testing.T) {
+	p := newTestProxy(t)
+
+	r := withClientCert(httptest.NewRequest(http.MethodGet, "/auth/verify", nil), "nginx")
+	r.Header.Set("X-Forwarded-Host", "app.example.com")
+	r.Header.Set("X-Forwarded-Uri", "/admin")
+	w := httptest.NewRecorder()
+	p.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401 for the certificate of the fronting proxy", w.Code)
+	}
+	if got := w.Header().Get(HeaderAuthUser); got != "" {
+		t.Errorf("%s = %q, want none", HeaderAuthUser, got)
+	}
+	if got := w.Header().Get(HeaderAuthRedirect); got != "/auth/sign_in?rd=https%3A%2F%2Fapp.example.com%2Fadmin" {
+		t.Errorf("%s = %q", HeaderAuthRedirect, got)
+	}
+}
+
+func TestReverseProxyClientCert(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(HeaderAuthUser) + " " + r.Header.Get(HeaderAuthProvider)))
+	}))
+	defer upstream.Close()
+	p := newTestProxy(t, AddUpstreamConfig(&UpstreamConfig{URL: upstream.URL}))
+
+	w := httptest.NewRecorder()
+	p.Router.ServeHTTP(w, withClientCert(httptest.NewRequest(http.MethodGet, "/app", nil), "build-bot"))
+	if w.Code != http.StatusOK || w.Body.String() != "build-bot "+ClientCertProvider {
+		t.Errorf("with certificate = %d %q, want the certificate's identity upstream", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	p.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/app", nil))
+	if w.Code != http.StatusFound {
+		t.Errorf("without certificate = %d, want a redirect to sign in", w.Code)
+	}
+}
@@ -0,0 +1,163 @@
+// Package redirect validates the URLs users are sent back to after signing
+// in, so the login endpoint cannot be used as an open redirect.
+package redirect
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// maxLength bounds return URLs, which travel in the login cookie.
+const maxLength = 2048
+
+// unescapes is how many times paths are decoded looking for hidden
+// separators, e.g. %252F%252F.
+const unescapes = 3
+
+var errInvalid = errors.New("redirect: invalid return URL")
+
+// Allowlist lists where users may return to. Relative paths stay on the
+// proxy's host and are always allowed, subject to PathPrefixes.
+type Allowlist struct {
+	// Hosts allows absolute http(s) URLs on these hosts; "*.example.com"
+	// allows any subdomain of example.com.
+	Hosts []string
+	// PathPrefixes restricts return URLs to paths under the prefixes, at
+	// segment boundaries. Any path is allowed when empty.
+	PathPrefixes []string
+}
+
+// Validate returns raw if it is a safe return URL, or an error naming the
+// problem. It rejects protocol-relative and backslash URLs such as
+// //evil.com and /\evil.com, schemes other than http and https, user info,
+// control characters, and dot segments or separators hidden by percent
+// encoding.
+func (t *Allowlist) Validate(raw string) (string, error) {
+	if raw == "" || len(raw) > maxLength {
+		return "", errInvalid
+	}
+	// control characters, space, backslashes and non-ASCII characters are
+	// normalized differently by browsers
+	for i := 0; i < len(raw); i++ {
+		if c := raw[i]; unsafeByte(c) || c == ' ' || c == '\\' || c >= 0x80 {
+			return "", fmt.Errorf("redirect: return URL contains %q", c)
+		}
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", errInvalid
+	}
+	if u.Opaque != "" || u.User != nil {
+		return "", errInvalid
+	}
+
+	switch {
+	case u.Scheme == "":
+		if u.Host != "" || !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") {
+			return "", errors.New("redirect: return URL must be an absolute path or URL")
+		}
+	case u.Scheme == "http" || u.Scheme == "https":
+		if !strings.HasPrefix(raw[len(u.Scheme):], "://") || !validHost(u.Host) || !t.hostAllowed(u.Hostname()) {
+			return "", fmt.Errorf("redirect: host %q is not allowed", u.Host)
+		}
+	default:
+		return "", errors.New("redirect: return URL must use http or https")
+	}
+
+	if err := t.checkPath(u.EscapedPath()); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+func unsafeByte(c byte) bool {
+	return c < ' ' || c == 0x7f
+}
+
+// ambiguousRune reports runes browsers may drop or read as a slash.
+func ambiguousRune(r rune) bool {
+	return r == '\\' || r < 0x80 && unsafeByte(byte(r))
+}
+
+// validHost accepts host names, IP addresses and ports only.
+func validHost(host string) bool {
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-.:[]", c) >= 0) {
+			return false
+		}
+	}
+	return host != ""
+}
+
+func (t *Allowlist) hostAllowed(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return false
+	}
+	for _, allowed := range t.Hosts {
+		allowed = strings.ToLower(allowed)
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPath decodes the escaped path repeatedly, rejecting dot segments,
+// backslashes and empty leading segments at any level, and checks the
+// prefixes against the decoded path.
+func (t *Allowlist) checkPath(escaped string) error {
+	if escaped == "" {
+		escaped = "/"
+	}
+
+	decoded := escaped
+	for i := 0; i <= unescapes; i++ {
+		if strings.HasPrefix(decoded, "//") || strings.IndexFunc(decoded, ambiguousRune) >= 0 {
+			return errors.New("redirect: return URL path is ambiguous")
+		}
+		for _, segment := range strings.Split(decoded, "/") {
+			if segment == "." || segment == ".." {
+				return errors.New("redirect: return URL path has dot segments")
+			}
+		}
+		if i == 0 && !strings.HasPrefix(decoded, "/") {
+			return errInvalid
+		}
+
+		next, err := url.PathUnescape(decoded)
+		if err != nil {
+			return errInvalid
+		}
+		if next == decoded {
+			break
+		}
+		if i == unescapes {
+			return errors.New("redirect: return URL path is encoded too many times")
+		}
+		decoded = next
+	}
+
+	if len(t.PathPrefixes) == 0 {
+		return nil
+	}
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return errInvalid
+	}
+	for _, prefix := range t.PathPrefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return nil
+		}
+	}
+	return errors.New("redirect: return URL path is not allowed")
+}
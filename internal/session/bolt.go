@@ -0,0 +1,104 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+var boltBucket = []byte("sessions")
+
+// BoltStore persists sessions in a local BoltDB file, surviving restarts of
+// a single instance.
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (t *BoltStore) Get(ctx context.Context, id string) (*Session, error) {
+	var session *Session
+	err := t.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(boltBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		session = &Session{}
+		return json.Unmarshal(data, session)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Expired(time.Now()) {
+		t.Delete(ctx, id)
+		return nil, ErrNotFound
+	}
+	return session, nil
+}
+
+func (t *BoltStore) Save(ctx context.Context, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	return t.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(session.ID), data)
+	})
+}
+
+func (t *BoltStore) Delete(ctx context.Context, id string) error {
+	return t.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(id))
+	})
+}
+
+// List returns live sessions and removes expired ones from the file.
+func (t *BoltStore) List(ctx context.Context) ([]*Session, error) {
+	var sessions []*Session
+	now := time.Now()
+
+	err := t.db.Update(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(boltBucket).Cursor()
+		for key, data := cursor.First(); key != nil; key, data = cursor.Next() {
+			session := &Session{}
+			if err := json.Unmarshal(data, session); err != nil {
+				return err
+			}
+			if session.Expired(now) {
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+				continue
+			}
+			sessions = append(sessions, session)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (t *BoltStore) Close() error {
+	return t.db.Close()
+}
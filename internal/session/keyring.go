@@ -0,0 +1,180 @@
+package session
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// key IDs are written into sealed values next to a "." separator
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var errUnknownKey = errors.New("session: sealed with unknown key")
+
+// MinSecretLength is the shortest secret a Key accepts, in bytes.
+const MinSecretLength = 32
+
+// Key is one secret of a Keyring. ID is stored alongside sealed values to
+// pick the key when opening; it defaults to a fingerprint of Secret.
+type Key struct {
+	ID     string
+	Secret string
+}
+
+// Validate rejects secrets shorter than MinSecretLength and IDs that cannot
+// be embedded in cookies.
+func (t Key) Validate() error {
+	if t.Secret == "" {
+		return errors.New("session: key secret is empty")
+	}
+	if len(t.Secret) < MinSecretLength {
+		return fmt.Errorf("session: key secret must be at least %d bytes, got %d", MinSecretLength, len(t.Secret))
+	}
+	if t.ID != "" && !keyIDPattern.MatchString(t.ID) {
+		return fmt.Errorf("session: key id %q must match %s", t.ID, keyIDPattern)
+	}
+	return nil
+}
+
+// Keyring encrypts session cookies and tokens at rest with AES-256-GCM. The
+// first key is the newest and seals; every key opens. Rotate by prepending
+// a new key and reloading, then drop the old key once its sessions ended.
+type Keyring struct {
+	keys []keyringEntry
+}
+
+type keyringEntry struct {
+	id     string
+	cookie cipher.AEAD
+	token  cipher.AEAD
+}
+
+func NewKeyring(keys ...Key) *Keyring {
+	keyring := &Keyring{}
+	for _, key := range keys {
+		id := key.ID
+		if id == "" {
+			sum := sha256.Sum256([]byte("one-oauth session key id\x00" + key.Secret))
+			id = base64.RawURLEncoding.EncodeToString(sum[:6])
+		}
+		keyring.keys = append(keyring.keys, keyringEntry{
+			id:     id,
+			cookie: newAEAD(key.Secret, "one-oauth session cookie encryption"),
+			token:  newAEAD(key.Secret, "one-oauth session token encryption"),
+		})
+	}
+	return keyring
+}
+
+// newAEAD derives an AES-256-GCM key from secret with HKDF-SHA256, using
+// info as the label so one secret yields independent keys per use.
+func newAEAD(secret, info string) cipher.AEAD {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(info)), key); err != nil {
+		panic(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// sealCookie encrypts value bound to the cookie name as "<key id>.<data>".
+func (t *Keyring) sealCookie(name, value string) (string, error) {
+	if len(t.keys) == 0 {
+		return "", errors.New("session: keyring is empty")
+	}
+	key := t.keys[0]
+
+	sealed, err := seal(key.cookie, []byte(value), []byte(name))
+	if err != nil {
+		return "", err
+	}
+	return key.id + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (t *Keyring) openCookie(name, value string) (string, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return "", errors.New("session: malformed cookie")
+	}
+	key, ok := t.find(parts[0])
+	if !ok {
+		return "", errUnknownKey
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(key.cookie, sealed, []byte(name))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// sealToken encrypts plaintext bound to additionalData as "<key id>.<data>".
+func (t *Keyring) sealToken(plaintext, additionalData []byte) ([]byte, error) {
+	if len(t.keys) == 0 {
+		return nil, errors.New("session: keyring is empty")
+	}
+	key := t.keys[0]
+
+	sealed, err := seal(key.token, plaintext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(key.id+"."), sealed...), nil
+}
+
+func (t *Keyring) openToken(sealed, additionalData []byte) ([]byte, error) {
+	i := bytes.IndexByte(sealed, '.')
+	if i < 0 {
+		return nil, errUnknownKey
+	}
+	key, ok := t.find(string(sealed[:i]))
+	if !ok {
+		return nil, errUnknownKey
+	}
+	return open(key.token, sealed[i+1:], additionalData)
+}
+
+func (t *Keyring) find(id string) (keyringEntry, bool) {
+	for _, key := range t.keys {
+		if key.id == id {
+			return key, true
+		}
+	}
+	return keyringEntry{}, false
+}
+
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("session: sealed value too short")
+	}
+	return aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData)
+}
@@ -0,0 +1,229 @@
+package session
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestKeyringCookie(t *testing.T) {
+	keyring := NewKeyring(Key{ID: "new", Secret: "new secret"})
+
+	sealed, err := keyring.sealCookie("session", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, "new.") {
+		t.Errorf("sealed = %q, want the key id prefix", sealed)
+	}
+	if value, err := keyring.openCookie("session", sealed); err != nil || value != "id" {
+		t.Errorf("openCookie = %q, %v", value, err)
+	}
+
+	// sealing twice differs by nonce
+	if again, _ := keyring.sealCookie("session", "id"); again == sealed {
+		t.Error("sealed values repeat")
+	}
+
+	// the cookie name is bound
+	if _, err := keyring.openCookie("other", sealed); err == nil {
+		t.Error("opened a cookie under another name")
+	}
+}
+
+func TestKeyringToken(t *testing.T) {
+	keyring := NewKeyring(Key{ID: "new", Secret: "new secret"})
+
+	sealed, err := keyring.sealToken([]byte("token"), []byte("session-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, []byte("new.")) {
+		t.Errorf("sealed = %q, want the key id prefix", sealed)
+	}
+	if plaintext, err := keyring.openToken(sealed, []byte("session-a")); err != nil || string(plaintext) != "token" {
+		t.Errorf("openToken = %q, %v", plaintext, err)
+	}
+
+	// tokens are bound to their session
+	if _, err := keyring.openToken(sealed, []byte("session-b")); err == nil {
+		t.Error("opened a token of another session")
+	}
+
+	// cookie and token keys are independent
+	cookie, err := keyring.sealCookie("session-a", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(cookie, "new."))
+	if _, err := keyring.openToken(append([]byte("new."), data...), []byte("session-a")); err == nil {
+		t.Error("opened a sealed cookie as a token")
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old := NewKeyring(Key{ID: "old", Secret: "old secret"})
+	cookie, err := old.sealCookie("session", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := old.sealToken([]byte("token"), []byte("id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new key is prepended: it seals, and the old one still opens
+	rotated := NewKeyring(Key{ID: "new", Secret: "new secret"}, Key{ID: "old", Secret: "old secret"})
+	if value, err := rotated.openCookie("session", cookie); err != nil || value != "id" {
+		t.Errorf("old cookie = %q, %v", value, err)
+	}
+	if plaintext, err := rotated.openToken(token, []byte("id")); err != nil || string(plaintext) != "token" {
+		t.Errorf("old token = %q, %v", plaintext, err)
+	}
+	if sealed, _ := rotated.sealCookie("session", "id"); !strings.HasPrefix(sealed, "new.") {
+		t.Errorf("rotated keyring sealed %q, want the new key", sealed)
+	}
+	if sealed, _ := rotated.sealToken([]byte("token"), []byte("id")); !bytes.HasPrefix(sealed, []byte("new.")) {
+		t.Errorf("rotated keyring sealed %q, want the new key", sealed)
+	}
+
+	// once the old key is dropped its values no longer open
+	dropped := NewKeyring(Key{ID: "new", Secret: "new secret"})
+	if _, err := dropped.openCookie("session", cookie); err != errUnknownKey {
+		t.Errorf("dropped key cookie err = %v, want errUnknownKey", err)
+	}
+	if _, err := dropped.openToken(token, []byte("id")); err != errUnknownKey {
+		t.Errorf("dropped key token err = %v, want errUnknownKey", err)
+	}
+
+	// default ids are fingerprints of the secret, stable across restarts
+	a, b := NewKeyring(Key{Secret: "secret"}), NewKeyring(Key{Secret: "secret"})
+	sealed, err := a.sealCookie("session", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := b.openCookie("session", sealed); err != nil || value != "id" {
+		t.Errorf("default id = %q, %v", value, err)
+	}
+	if _, err := NewKeyring(Key{Secret: "other"}).openCookie("session", sealed); err != errUnknownKey {
+		t.Errorf("other secret err = %v, want errUnknownKey", err)
+	}
+}
+
+func TestKeyringRejectsTampering(t *testing.T) {
+	keyring := NewKeyring(Key{ID: "new", Secret: "new secret"})
+	// another secret under the same id
+	impostor := NewKeyring(Key{ID: "new", Secret: "guessed secret"})
+
+	cookie, err := keyring.sealCookie("session", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(cookie, "new."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)-1] ^= 1
+	forged, _ := impostor.sealCookie("session", "other")
+
+	cookies := map[string]string{
+		"flipped bit":   "new." + base64.RawURLEncoding.EncodeToString(flipped),
+		"truncated":     "new." + base64.RawURLEncoding.EncodeToString(data[:len(data)-1]),
+		"too short":     "new." + base64.RawURLEncoding.EncodeToString(data[:4]),
+		"empty":         "new.",
+		"no key id":     base64.RawURLEncoding.EncodeToString(data),
+		"unknown id":    "old." + base64.RawURLEncoding.EncodeToString(data),
+		"not base64":    "new.!!!",
+		"another key":   forged,
+		"plain session": "id",
+	}
+	for name, value := range cookies {
+		if got, err := keyring.openCookie("session", value); err == nil {
+			t.Errorf("%s: opened %q", name, got)
+		}
+	}
+
+	token, err := keyring.sealToken([]byte("token"), []byte("id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flippedToken := append([]byte(nil), token...)
+	flippedToken[len(flippedToken)-1] ^= 1
+	forgedToken, _ := impostor.sealToken([]byte("other"), []byte("id"))
+
+	tokens := map[string][]byte{
+		"flipped bit": flippedToken,
+		"truncated":   token[:len(token)-1],
+		"too short":   token[:len("new.")+4],
+		"no key id":   token[len("new."):],
+		"unknown id":  append([]byte("old."), token[len("new."):]...),
+		"another key": forgedToken,
+		"empty":       nil,
+	}
+	for name, value := range tokens {
+		if got, err := keyring.openToken(value, []byte("id")); err == nil {
+			t.Errorf("%s: opened %q", name, got)
+		}
+	}
+
+	if _, err := NewKeyring().sealCookie("session", "id"); err == nil {
+		t.Error("sealed with an empty keyring")
+	}
+}
+
+func TestKeyringDerivation(t *testing.T) {
+	secret := strings.Repeat("s", MinSecretLength)
+	keyring := NewKeyring(Key{ID: "a", Secret: secret})
+
+	// the cookie key is HKDF-SHA256 of the secret labeled for cookies
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte("one-oauth session cookie encryption")), key); err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := seal(aead, []byte("id"), []byte("session"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := keyring.openCookie("session", "a."+base64.RawURLEncoding.EncodeToString(sealed)); err != nil || value != "id" {
+		t.Errorf("cookie sealed with the HKDF key = %q, %v", value, err)
+	}
+
+	// the token key is independent of it
+	if _, err := keyring.openToken(append([]byte("a."), sealed...), []byte("session")); err == nil {
+		t.Error("token key opened a cookie")
+	}
+}
+
+func TestKeyValidate(t *testing.T) {
+	secret := strings.Repeat("s", MinSecretLength)
+	valid := []Key{{Secret: secret}, {ID: "key-1_A", Secret: secret}}
+	invalid := []Key{
+		{}, {ID: "a", Secret: ""}, {ID: "a", Secret: secret[1:]},
+		{ID: "a.b", Secret: secret}, {ID: "a b", Secret: secret}, {ID: "a;b", Secret: secret},
+	}
+	for _, key := range valid {
+		if err := key.Validate(); err != nil {
+			t.Errorf("%+v: %v", key, err)
+		}
+	}
+	for _, key := range invalid {
+		if err := key.Validate(); err == nil {
+			t.Errorf("%+v: valid", key)
+		}
+	}
+}
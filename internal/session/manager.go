@@ -0,0 +1,170 @@
+package session
+
+import (
+	"context"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"golang.org/x/oauth2"
+	"net/http"
+	"time"
+)
+
+const defaultMaxAge = 7 * 24 * time.Hour
+
+// Lifetime bounds how long sessions stay valid.
+type Lifetime struct {
+	// MaxAge is the absolute session lifetime; defaults to one week.
+	MaxAge time.Duration
+	// IdleTimeout ends sessions without activity for this long. Activity
+	// past half the timeout renews the session cookie. Zero disables it.
+	IdleTimeout time.Duration
+}
+
+// Manager ties an encrypted cookie carrying only an opaque session ID to the
+// server-side Store holding the session itself.
+type Manager struct {
+	Store      Store
+	Keyring    *Keyring
+	CookieName string
+	Cookie     cookie.Options
+	Lifetime   Lifetime
+	locks      sessionLocks
+	// now is the clock sessions are timed with, replaced in tests.
+	now func() time.Time
+}
+
+func NewManager(store Store, cookieName string, keyring *Keyring, lifetime Lifetime, cookieOptions cookie.Options) *Manager {
+	if lifetime.MaxAge <= 0 {
+		lifetime.MaxAge = defaultMaxAge
+	}
+
+	return &Manager{
+		Store:      store,
+		Keyring:    keyring,
+		CookieName: cookieName,
+		Cookie:     cookieOptions,
+		Lifetime:   lifetime,
+		now:        time.Now,
+	}
+}
+
+// Issue stores a new session for user and token and sets its cookie.
+func (t *Manager) Issue(w http.ResponseWriter, r *http.Request, user *provider.User, token *oauth2.Token) (*Session, error) {
+	now := t.now()
+	s := &Session{
+		ID:         NewID(),
+		User:       user,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(t.Lifetime.MaxAge),
+	}
+	if token != nil {
+		sealed, err := t.sealToken(s.ID, token)
+		if err != nil {
+			return nil, err
+		}
+		s.SealedToken = sealed
+	}
+
+	if err := t.Store.Save(r.Context(), s); err != nil {
+		return nil, err
+	}
+	if err := t.saveCookie(w, s, now); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Load returns the session referenced by the request's cookie, or
+// ErrNotFound if there is no valid cookie, the session was revoked or it
+// expired. Activity past half the idle timeout renews the session and
+// re-issues its cookie on w.
+func (t *Manager) Load(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	id := t.sessionID(r)
+	if id == "" {
+		return nil, ErrNotFound
+	}
+
+	s, err := t.Store.Get(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := t.now()
+	idle := t.Lifetime.IdleTimeout
+	if s.Expired(now) || idle > 0 && now.Sub(s.LastSeenAt) >= idle {
+		t.Store.Delete(r.Context(), id)
+		return nil, ErrNotFound
+	}
+
+	if idle > 0 && now.Sub(s.LastSeenAt) >= idle/2 {
+		if s, err = t.touch(r.Context(), id, now); err != nil {
+			return nil, err
+		}
+		if err := t.saveCookie(w, s, now); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// touch records activity on the stored session. It shares the session's
+// refresh lock so it cannot write back a token replaced by a concurrent
+// refresh.
+func (t *Manager) touch(ctx context.Context, id string, now time.Time) (*Session, error) {
+	unlock := t.locks.lock(id)
+	defer unlock()
+
+	s, err := t.Store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s.LastSeenAt = now
+	if err := t.Store.Save(ctx, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// saveCookie sets the session cookie to live until the session would expire
+// through either its absolute or its idle lifetime.
+func (t *Manager) saveCookie(w http.ResponseWriter, s *Session, now time.Time) error {
+	lifetime := s.ExpiresAt.Sub(now)
+	if idle := t.Lifetime.IdleTimeout; idle > 0 && idle < lifetime {
+		lifetime = idle
+	}
+
+	value, err := t.Keyring.sealCookie(t.CookieName, s.ID)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, cookie.New(t.Cookie.SessionConfig(t.CookieName, lifetime), value))
+	return nil
+}
+
+// sessionID returns the session ID sealed in the request's cookie, or an
+// empty string if it is missing or does not open with any key.
+func (t *Manager) sessionID(r *http.Request) string {
+	c, err := r.Cookie(t.CookieName)
+	if err != nil {
+		return ""
+	}
+	id, err := t.Keyring.openCookie(t.CookieName, c.Value)
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// Destroy revokes the request's session server-side and expires its cookie.
+func (t *Manager) Destroy(w http.ResponseWriter, r *http.Request) error {
+	// expire with the same Domain and Path, or browsers keep the cookie
+	defer http.SetCookie(w, cookie.Expire(t.Cookie.SessionConfig(t.CookieName, 0)))
+
+	if id := t.sessionID(r); id != "" {
+		return t.Store.Delete(r.Context(), id)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package session
+
+import (
+	"context"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// clock is a manually advanced Manager clock.
+type clock struct {
+	now time.Time
+}
+
+func (t *clock) Now() time.Time {
+	return t.now
+}
+
+func (t *clock) advance(d time.Duration) {
+	t.now = t.now.Add(d)
+}
+
+// newClockedManager returns a manager for lifetime timed by a clock starting
+// now, and the request cookie of a session issued to it.
+func newClockedManager(t *testing.T, lifetime Lifetime) (*Manager, *clock, *http.Cookie) {
+	t.Helper()
+	c := &clock{now: time.Now()}
+	manager := NewManager(NewMemoryStore(), "session", NewKeyring(Key{Secret: "test secret"}), lifetime, cookie.Dev)
+	manager.now = c.Now
+
+	w := httptest.NewRecorder()
+	if _, err := manager.Issue(w, httptest.NewRequest(http.MethodGet, "/", nil), &provider.User{Subject: "1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return manager, c, w.Result().Cookies()[0]
+}
+
+// load loads the session of sessionCookie, returning any re-issued cookie.
+func load(manager *Manager, sessionCookie *http.Cookie) (*Session, *http.Cookie, error) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(sessionCookie)
+	w := httptest.NewRecorder()
+	s, err := manager.Load(w, r)
+	if cookies := w.Result().Cookies(); len(cookies) > 0 {
+		return s, cookies[0], err
+	}
+	return s, nil, err
+}
+
+func TestAbsoluteExpiry(t *testing.T) {
+	manager, c, sessionCookie := newClockedManager(t, Lifetime{MaxAge: time.Hour})
+	if sessionCookie.MaxAge != 3600 {
+		t.Errorf("cookie Max-Age = %d, want the session lifetime", sessionCookie.MaxAge)
+	}
+
+	c.advance(time.Hour - time.Second)
+	if _, _, err := load(manager, sessionCookie); err != nil {
+		t.Fatalf("before expiry: %v", err)
+	}
+
+	c.advance(time.Second)
+	if _, _, err := load(manager, sessionCookie); err != ErrNotFound {
+		t.Errorf("at expiry err = %v, want ErrNotFound", err)
+	}
+	if sessions, _ := manager.Store.List(context.Background()); len(sessions) != 0 {
+		t.Errorf("expired session kept: %v", sessions)
+	}
+}
+
+func TestIdleExpiry(t *testing.T) {
+	manager, c, sessionCookie := newClockedManager(t, Lifetime{MaxAge: time.Hour, IdleTimeout: 10 * time.Minute})
+	if sessionCookie.MaxAge != 600 {
+		t.Errorf("cookie Max-Age = %d, want the idle timeout", sessionCookie.MaxAge)
+	}
+
+	c.advance(10 * time.Minute)
+	if _, _, err := load(manager, sessionCookie); err != ErrNotFound {
+		t.Errorf("idle err = %v, want ErrNotFound", err)
+	}
+	if sessions, _ := manager.Store.List(context.Background()); len(sessions) != 0 {
+		t.Errorf("idle session kept: %v", sessions)
+	}
+}
+
+func TestIdleRenewal(t *testing.T) {
+	manager, c, sessionCookie := newClockedManager(t, Lifetime{MaxAge: time.Hour, IdleTimeout: 10 * time.Minute})
+	issued := c.now
+
+	// activity before half the timeout is not recorded
+	c.advance(4 * time.Minute)
+	s, renewed, err := load(manager, sessionCookie)
+	if err != nil || renewed != nil || !s.LastSeenAt.Equal(issued) {
+		t.Fatalf("early activity = %v, cookie %v, last seen %v", err, renewed, s.LastSeenAt)
+	}
+
+	// past half the timeout the session and its cookie are renewed
+	c.advance(2 * time.Minute)
+	s, renewed, err = load(manager, sessionCookie)
+	if err != nil || renewed == nil || renewed.MaxAge != 600 || !s.LastSeenAt.Equal(c.now) {
+		t.Fatalf("renewal = %v, cookie %v, last seen %v", err, renewed, s.LastSeenAt)
+	}
+	if stored, _ := manager.Store.Get(context.Background(), s.ID); !stored.LastSeenAt.Equal(c.now) {
+		t.Errorf("stored last seen = %v, want %v", stored.LastSeenAt, c.now)
+	}
+
+	// so it outlives the timeout counted from sign in
+	c.advance(9 * time.Minute)
+	if _, _, err := load(manager, sessionCookie); err != nil {
+		t.Errorf("after renewal: %v", err)
+	}
+
+	// renewals never extend past the absolute lifetime
+	for c.now.Sub(issued) < 55*time.Minute {
+		c.advance(5 * time.Minute)
+		if _, _, err := load(manager, sessionCookie); err != nil {
+			t.Fatalf("at %v: %v", c.now.Sub(issued), err)
+		}
+	}
+	c.advance(5 * time.Minute)
+	if _, _, err := load(manager, sessionCookie); err != ErrNotFound {
+		t.Errorf("past the absolute lifetime err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestIdleRenewalCookieLifetime(t *testing.T) {
+	manager, c, sessionCookie := newClockedManager(t, Lifetime{MaxAge: time.Hour, IdleTimeout: 10 * time.Minute})
+	for i := 0; i < 10; i++ {
+		c.advance(5 * time.Minute)
+		if _, _, err := load(manager, sessionCookie); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// renewed 56 minutes in, the cookie lives until the absolute expiry
+	c.advance(6 * time.Minute)
+	_, renewed, err := load(manager, sessionCookie)
+	if err != nil || renewed == nil || renewed.MaxAge != 4*60 {
+		t.Errorf("renewal near expiry = %v, cookie %v", err, renewed)
+	}
+}
+
+func TestIdleTimeoutDisabled(t *testing.T) {
+	manager, c, sessionCookie := newClockedManager(t, Lifetime{MaxAge: time.Hour})
+	issued := c.now
+
+	c.advance(50 * time.Minute)
+	s, renewed, err := load(manager, sessionCookie)
+	if err != nil {
+		t.Fatalf("without idle timeout: %v", err)
+	}
+	if renewed != nil || !s.LastSeenAt.Equal(issued) {
+		t.Errorf("renewed without idle timeout: cookie %v, last seen %v", renewed, s.LastSeenAt)
+	}
+}
@@ -0,0 +1,71 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps sessions in process memory. Sessions are lost on restart
+// and not shared between instances.
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: map[string]*Session{},
+	}
+}
+
+func (t *MemoryStore) Get(ctx context.Context, id string) (*Session, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, ok := t.sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if session.Expired(time.Now()) {
+		delete(t.sessions, id)
+		return nil, ErrNotFound
+	}
+
+	copied := *session
+	return &copied, nil
+}
+
+func (t *MemoryStore) Save(ctx context.Context, session *Session) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	copied := *session
+	t.sessions[session.ID] = &copied
+	return nil
+}
+
+func (t *MemoryStore) Delete(ctx context.Context, id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.sessions, id)
+	return nil
+}
+
+func (t *MemoryStore) List(ctx context.Context) ([]*Session, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	sessions := make([]*Session, 0, len(t.sessions))
+	for id, session := range t.sessions {
+		if session.Expired(now) {
+			delete(t.sessions, id)
+			continue
+		}
+		copied := *session
+		sessions = append(sessions, &copied)
+	}
+	return sessions, nil
+}
@@ -0,0 +1,114 @@
+package session
+
+import (
+	"context"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"golang.org/x/oauth2"
+	"net/http"
+)
+
+// ProviderConfig holds the session settings all providers accept.
+type ProviderConfig struct {
+	CookieName string
+	// Keys encrypt session cookies, newest first. Defaults to a single key
+	// made of Secret.
+	Keys   []Key
+	Secret string
+	// Store defaults to an in-memory store.
+	Store    Store
+	Lifetime Lifetime
+	Cookie   cookie.Options
+}
+
+// Provider implements the session side of a provider: authenticating
+// requests, their tokens and the logout and is-authenticated handlers.
+// Providers embed it next to their login and callback handlers.
+type Provider struct {
+	Sessions *Manager
+	// OAuth2Config returns the config tokens are refreshed with.
+	OAuth2Config func(ctx context.Context) (*oauth2.Config, error)
+}
+
+// NewProvider returns a Provider for config refreshing tokens with
+// oauth2Config.
+func NewProvider(config ProviderConfig, oauth2Config func(ctx context.Context) (*oauth2.Config, error)) Provider {
+	store := config.Store
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	keys := config.Keys
+	if len(keys) == 0 {
+		keys = []Key{{Secret: config.Secret}}
+	}
+
+	return Provider{
+		Sessions:     NewManager(store, config.CookieName, NewKeyring(keys...), config.Lifetime, config.Cookie),
+		OAuth2Config: oauth2Config,
+	}
+}
+
+// StaticConfig returns an OAuth2Config func always returning config.
+func StaticConfig(config *oauth2.Config) func(ctx context.Context) (*oauth2.Config, error) {
+	return func(ctx context.Context) (*oauth2.Config, error) {
+		return config, nil
+	}
+}
+
+func (t Provider) Authenticate(w http.ResponseWriter, r *http.Request) (*provider.User, error) {
+	s, err := t.Sessions.Load(w, r)
+	if err != nil {
+		return nil, err
+	}
+	return s.User, nil
+}
+
+// Session returns the request's session, as Authenticate.
+func (t Provider) Session(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	return t.Sessions.Load(w, r)
+}
+
+func (t Provider) Token(w http.ResponseWriter, r *http.Request) (*oauth2.Token, error) {
+	s, err := t.Sessions.Load(w, r)
+	if err != nil {
+		return nil, err
+	}
+	return t.SessionToken(r.Context(), s)
+}
+
+// SessionToken returns the token of s, a session of this provider.
+func (t Provider) SessionToken(ctx context.Context, s *Session) (*oauth2.Token, error) {
+	oauth2Config, err := t.OAuth2Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return t.Sessions.Token(ctx, s, oauth2Config)
+}
+
+// LogoutHandler revokes the session on POSTs.
+func (t Provider) LogoutHandler() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			err := t.Sessions.Destroy(w, r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// IsAuthenticatedHandler answers 200 if the user has a live session, 407
+// otherwise.
+func (t Provider) IsAuthenticatedHandler() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if _, err := t.Authenticate(w, r); err == nil {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+		}
+	}
+
+	return http.HandlerFunc(fn)
+}
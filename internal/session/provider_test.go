@@ -0,0 +1,55 @@
+package session
+
+import (
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProvider(t *testing.T) {
+	p := NewProvider(ProviderConfig{CookieName: "session", Secret: "test secret", Cookie: cookie.Dev}, StaticConfig(&oauth2.Config{}))
+	s := issue(t, p.Sessions, &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)})
+
+	request := func(method string, authenticated bool) *http.Request {
+		r := httptest.NewRequest(method, "/", nil)
+		if authenticated {
+			value, err := p.Sessions.Keyring.sealCookie("session", s.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.AddCookie(&http.Cookie{Name: "session", Value: value})
+		}
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	p.IsAuthenticatedHandler().ServeHTTP(w, request(http.MethodGet, false))
+	if w.Code != http.StatusProxyAuthRequired {
+		t.Errorf("without session = %d, want 407", w.Code)
+	}
+	w = httptest.NewRecorder()
+	p.IsAuthenticatedHandler().ServeHTTP(w, request(http.MethodGet, true))
+	if w.Code != http.StatusOK {
+		t.Errorf("with session = %d, want 200", w.Code)
+	}
+
+	if user, err := p.Authenticate(httptest.NewRecorder(), request(http.MethodGet, true)); err != nil || user.Subject != "1" {
+		t.Errorf("Authenticate = %v, %v", user, err)
+	}
+	if token, err := p.Token(httptest.NewRecorder(), request(http.MethodGet, true)); err != nil || token.AccessToken != "access" {
+		t.Errorf("Token = %v, %v", token, err)
+	}
+
+	// only POSTs log out
+	p.LogoutHandler().ServeHTTP(httptest.NewRecorder(), request(http.MethodGet, true))
+	if _, err := p.Session(httptest.NewRecorder(), request(http.MethodGet, true)); err != nil {
+		t.Errorf("session after GET logout: %v", err)
+	}
+	p.LogoutHandler().ServeHTTP(httptest.NewRecorder(), request(http.MethodPost, true))
+	if _, err := p.Session(httptest.NewRecorder(), request(http.MethodGet, true)); err != ErrNotFound {
+		t.Errorf("session after POST logout = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,143 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"net"
+	"time"
+)
+
+const defaultRedisKeyPrefix = "one-oauth:session:"
+
+// RedisStore shares sessions between proxy instances through Redis. Keys
+// expire together with their sessions.
+type RedisStore struct {
+	pool      *redis.Pool
+	keyPrefix string
+}
+
+// NewRedisStore connects to a Redis server at a redis:// URL.
+func NewRedisStore(rawURL, keyPrefix string) *RedisStore {
+	if keyPrefix == "" {
+		keyPrefix = defaultRedisKeyPrefix
+	}
+
+	pool := &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 5 * time.Minute,
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			dial := func(_ context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			}
+			return redis.DialURL(rawURL, redis.DialContextFunc(dial))
+		},
+	}
+
+	return &RedisStore{pool: pool, keyPrefix: keyPrefix}
+}
+
+func (t *RedisStore) Get(ctx context.Context, id string) (*Session, error) {
+	conn, err := t.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", t.keyPrefix+id))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, err
+	}
+	if session.Expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return session, nil
+}
+
+func (t *RedisStore) Save(ctx context.Context, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	conn, err := t.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if session.ExpiresAt.IsZero() {
+		_, err = conn.Do("SET", t.keyPrefix+session.ID, data)
+		return err
+	}
+
+	ttl := time.Until(session.ExpiresAt).Milliseconds()
+	if ttl <= 0 {
+		_, err = conn.Do("DEL", t.keyPrefix+session.ID)
+		return err
+	}
+	_, err = conn.Do("SET", t.keyPrefix+session.ID, data, "PX", ttl)
+	return err
+}
+
+func (t *RedisStore) Delete(ctx context.Context, id string) error {
+	conn, err := t.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("DEL", t.keyPrefix+id)
+	return err
+}
+
+// List scans the key prefix; it is meant for administration, not hot paths.
+func (t *RedisStore) List(ctx context.Context) ([]*Session, error) {
+	conn, err := t.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var sessions []*Session
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", t.keyPrefix+"*", "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			session, err := t.Get(ctx, key[len(t.keyPrefix):])
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			sessions = append(sessions, session)
+		}
+
+		if cursor == 0 {
+			return sessions, nil
+		}
+	}
+}
+
+func (t *RedisStore) Close() error {
+	return t.pool.Close()
+}
@@ -0,0 +1,48 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"time"
+)
+
+var ErrNotFound = errors.New("session: not found")
+
+// Session is the server-side state behind an opaque session cookie.
+type Session struct {
+	ID   string         `json:"id"`
+	User *provider.User `json:"user"`
+	// SealedToken is the provider's OAuth2 token encrypted by the Manager.
+	SealedToken []byte    `json:"sealed_token,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	// LastSeenAt is refreshed on activity at most every half idle timeout.
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the session is past its expiry at now.
+func (t *Session) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// Store persists sessions by ID. Implementations must not return expired
+// sessions from Get and may drop them eagerly.
+type Store interface {
+	Get(ctx context.Context, id string) (*Session, error)
+	Save(ctx context.Context, session *Session) error
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context) ([]*Session, error)
+}
+
+// NewID returns a random, URL safe session ID. It panics if the system's
+// random source fails, rather than issue a guessable ID.
+func NewID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("session: reading random bytes: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
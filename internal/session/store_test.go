@@ -0,0 +1,154 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// stores returns each Store implementation, Redis backed by miniredis.
+func stores(t *testing.T) map[string]Store {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "one-oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	bolt, err := NewBoltStore(filepath.Join(dir, "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	redis := NewRedisStore("redis://"+server.Addr(), "")
+	t.Cleanup(func() { redis.Close() })
+
+	return map[string]Store{"memory": NewMemoryStore(), "bolt": bolt, "redis": redis}
+}
+
+func newSession(id string, expiresAt time.Time) *Session {
+	now := time.Now().Round(0)
+	return &Session{
+		ID:          id,
+		User:        &provider.User{Subject: "1", Provider: "idp", Email: "alice@example.com"},
+		SealedToken: []byte("sealed"),
+		CreatedAt:   now,
+		LastSeenAt:  now,
+		ExpiresAt:   expiresAt,
+	}
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range stores(t) {
+		if _, err := store.Get(ctx, "missing"); err != ErrNotFound {
+			t.Errorf("%s: Get missing = %v, want ErrNotFound", name, err)
+		}
+
+		session := newSession("a", time.Now().Add(time.Hour).Round(0))
+		if err := store.Save(ctx, session); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := store.Get(ctx, "a")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got == session || got.User.Email != "alice@example.com" || string(got.SealedToken) != "sealed" || !got.ExpiresAt.Equal(session.ExpiresAt) || !got.CreatedAt.Equal(session.CreatedAt) {
+			t.Errorf("%s: Get = %+v, want a copy of %+v", name, got, session)
+		}
+
+		// saving again replaces the session
+		session.LastSeenAt = session.LastSeenAt.Add(time.Minute)
+		if err := store.Save(ctx, session); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got, err := store.Get(ctx, "a"); err != nil || !got.LastSeenAt.Equal(session.LastSeenAt) {
+			t.Errorf("%s: Get after update = %+v, %v", name, got, err)
+		}
+
+		for _, s := range []*Session{newSession("b", time.Time{}), newSession("expired", time.Now().Add(-time.Second))} {
+			if err := store.Save(ctx, s); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if _, err := store.Get(ctx, "expired"); err != ErrNotFound {
+			t.Errorf("%s: Get expired = %v, want ErrNotFound", name, err)
+		}
+
+		sessions, err := store.List(ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var ids []string
+		for _, s := range sessions {
+			ids = append(ids, s.ID)
+		}
+		sort.Strings(ids)
+		if len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+			t.Errorf("%s: List = %v, want [a b]", name, ids)
+		}
+
+		if err := store.Delete(ctx, "a"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := store.Get(ctx, "a"); err != ErrNotFound {
+			t.Errorf("%s: Get deleted = %v, want ErrNotFound", name, err)
+		}
+		if err := store.Delete(ctx, "a"); err != nil {
+			t.Errorf("%s: Delete twice = %v", name, err)
+		}
+	}
+}
+
+func TestRedisStoreExpiry(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	store := NewRedisStore("redis://"+server.Addr(), "test:")
+	defer store.Close()
+
+	ctx := context.Background()
+	if err := store.Save(ctx, newSession("a", time.Now().Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if !server.Exists("test:a") {
+		t.Fatalf("keys = %v, want test:a", server.Keys())
+	}
+	if ttl := server.TTL("test:a"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL = %s, want up to a minute", ttl)
+	}
+	server.FastForward(time.Minute)
+	if _, err := store.Get(ctx, "a"); err != ErrNotFound {
+		t.Errorf("Get after TTL = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRedisStoreDialContext(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	store := NewRedisStore("redis://"+server.Addr(), "")
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.Get(ctx, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Get with a cancelled ctx = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,122 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"golang.org/x/oauth2"
+	"sync"
+)
+
+var ErrNoToken = errors.New("session: no token stored")
+
+// sealToken encrypts token bound to the session ID, so a sealed token cannot
+// be moved to another session.
+func (t *Manager) sealToken(sessionID string, token *oauth2.Token) ([]byte, error) {
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+	return t.Keyring.sealToken(plaintext, []byte(sessionID))
+}
+
+func (t *Manager) openToken(sessionID string, sealed []byte) (*oauth2.Token, error) {
+	plaintext, err := t.Keyring.openToken(sealed, []byte(sessionID))
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(plaintext, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Token returns the session's OAuth2 token, refreshing it through config
+// when expired and storing the refreshed token back in the session. Only
+// refreshes lock, and only the session being refreshed.
+func (t *Manager) Token(ctx context.Context, s *Session, config *oauth2.Config) (*oauth2.Token, error) {
+	if len(s.SealedToken) == 0 {
+		return nil, ErrNoToken
+	}
+	token, err := t.openToken(s.ID, s.SealedToken)
+	if err != nil {
+		return nil, err
+	}
+	if token.Valid() {
+		return token, nil
+	}
+
+	// serializes refreshes so a rotating refresh token is only redeemed once
+	unlock := t.locks.lock(s.ID)
+	defer unlock()
+
+	// re-read under the lock to observe a refresh done by a concurrent request
+	current, err := t.Store.Get(ctx, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(current.SealedToken) == 0 {
+		return nil, ErrNoToken
+	}
+	token, err = t.openToken(current.ID, current.SealedToken)
+	if err != nil {
+		return nil, err
+	}
+	if token.Valid() {
+		return token, nil
+	}
+
+	refreshed, err := config.TokenSource(ctx, token).Token()
+	if err != nil {
+		return nil, err
+	}
+
+	current.SealedToken, err = t.sealToken(current.ID, refreshed)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Store.Save(ctx, current); err != nil {
+		return nil, err
+	}
+
+	return refreshed, nil
+}
+
+// sessionLocks serializes updates of individual sessions.
+type sessionLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sessionLock
+}
+
+type sessionLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks the session id and returns its unlock function.
+func (t *sessionLocks) lock(id string) func() {
+	t.mu.Lock()
+	if t.locks == nil {
+		t.locks = map[string]*sessionLock{}
+	}
+	l, ok := t.locks[id]
+	if !ok {
+		l = &sessionLock{}
+		t.locks[id] = l
+	}
+	l.users++
+	t.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if l.users--; l.users == 0 {
+			delete(t.locks, id)
+		}
+	}
+}
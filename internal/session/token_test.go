@@ -0,0 +1,115 @@
+package session
+
+import (
+	"context"
+	"github.com/ozankasikci/one-oauth/internal/cookie"
+	"github.com/ozankasikci/one-oauth/internal/provider"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestManager() *Manager {
+	return NewManager(NewMemoryStore(), "session", NewKeyring(Key{Secret: "test secret"}), Lifetime{}, cookie.Dev)
+}
+
+func issue(t *testing.T, manager *Manager, token *oauth2.Token) *Session {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	s, err := manager.Issue(httptest.NewRecorder(), r, &provider.User{Subject: "1"}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// tokenServer answers refresh grants after release is closed, counting them.
+func tokenServer(t *testing.T, release <-chan struct{}, refreshes *int32) *oauth2.Config {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		atomic.AddInt32(refreshes, 1)
+		if r.FormValue("refresh_token") != "refresh" {
+			t.Errorf("refresh_token = %q", r.FormValue("refresh_token"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "refreshed", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	t.Cleanup(server.Close)
+	return &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: server.URL}}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	manager := newTestManager()
+	release := make(chan struct{})
+	var refreshes int32
+	config := tokenServer(t, release, &refreshes)
+
+	expired := issue(t, manager, &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Minute)})
+	valid := issue(t, manager, &oauth2.Token{AccessToken: "valid", Expiry: time.Now().Add(time.Hour)})
+
+	// concurrent refreshes of one session redeem the refresh token once
+	var wg sync.WaitGroup
+	tokens := make([]string, 3)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := manager.Token(context.Background(), expired, config)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			tokens[i] = token.AccessToken
+		}(i)
+	}
+
+	// other sessions are not blocked by the pending refresh
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		token, err := manager.Token(context.Background(), valid, config)
+		if err != nil || token.AccessToken != "valid" {
+			t.Errorf("Token = %v, %v, want the valid token", token, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a valid token waited for another session's refresh")
+	}
+
+	close(release)
+	wg.Wait()
+	for i, token := range tokens {
+		if token != "refreshed" {
+			t.Errorf("tokens[%d] = %q, want refreshed", i, token)
+		}
+	}
+	if n := atomic.LoadInt32(&refreshes); n != 1 {
+		t.Errorf("%d refreshes, want 1", n)
+	}
+
+	stored, err := manager.Store.Get(context.Background(), expired.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := manager.Token(context.Background(), stored, config)
+	if err != nil || token.AccessToken != "refreshed" {
+		t.Errorf("stored token = %v, %v, want refreshed", token, err)
+	}
+	if len(manager.locks.locks) != 0 {
+		t.Errorf("%d session locks left", len(manager.locks.locks))
+	}
+}
+
+func TestTokenMissing(t *testing.T) {
+	manager := newTestManager()
+	s := issue(t, manager, nil)
+	if _, err := manager.Token(context.Background(), s, &oauth2.Config{}); err != ErrNoToken {
+		t.Errorf("err = %v, want ErrNoToken", err)
+	}
+}